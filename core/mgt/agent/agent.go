@@ -16,7 +16,9 @@ package agent
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -28,25 +30,61 @@ import (
 
 	"github.com/99nil/diplomat/pkg/health"
 	"github.com/99nil/diplomat/pkg/logr"
+	"github.com/99nil/diplomat/pkg/storage"
+	"github.com/99nil/diplomat/pkg/types"
 	"github.com/99nil/dsync"
-	badgerstorage "github.com/99nil/dsync/storage/badger"
+	"github.com/99nil/dsync/suid"
 
 	"golang.org/x/sync/errgroup"
 )
 
 func Run(cfg *Config) error {
-	storageClient, err := badgerstorage.New(cfg.Storage.Badger)
+	storageClient, err := storage.New(&cfg.Storage)
 	if err != nil {
 		return err
 	}
 
 	ins, err := dsync.New(
-		dsync.WithStorageOption(storageClient))
+		dsync.WithStorageOption(storageClient),
+		dsync.WithIndexersOption(NewIndexers()),
+		dsync.WithIndexErrorOption(func(item dsync.Item, name string, err error) {
+			logr.WithError(err).WithField("uid", item.UID.String()).Warn("Data item is left unindexed")
+		}),
+		dsync.WithCompactOption(types.MetaNameKey),
+		dsync.WithHistoryOption(cfg.Agent.HistoryLimit),
+		dsync.WithRetryOption(dsync.RetryPolicy{
+			MaxAttempts: cfg.Agent.CallbackAttempts,
+			Backoff:     time.Second,
+			MaxBackoff:  10 * time.Second,
+		}),
+		// The state advances only after an item is handled, so no item is lost when the agent exits.
+		dsync.WithDeliveryOption(dsync.DeliveryCheckpoint))
 	if err != nil {
 		return err
 	}
+	// The keys written by the versions before the badger layout is versioned are moved to the current layout.
+	migrated, err := storage.MigrateLayout(context.Background(), storageClient, ins)
+	if err != nil {
+		return fmt.Errorf("migrate storage layout failed: %v", err)
+	}
+	if migrated > 0 {
+		logr.Infof("Migrated %d keys in storage to the current layout", migrated)
+	}
+	// The values written with the rotated keys are encrypted with the primary key,
+	// and so are the ones written before the encryption is enabled if storage.encryption.allowPlaintext is set.
+	reencrypted, err := storage.Reencrypt(context.Background(), storageClient, ins)
+	if err != nil {
+		return fmt.Errorf("reencrypt storage failed: %v", err)
+	}
+	if reencrypted > 0 {
+		logr.Infof("Reencrypted %d values in storage", reencrypted)
+	}
 
 	healthIns := health.New()
+	// The client is shared, so that the watch carries the mgt-server instance negotiated by the synchronization.
+	client := NewClient(cfg.Server.Host, cfg.Agent.Name)
+	// Notified when the node manifest changes in the cloud
+	changed := make(chan struct{}, 1)
 
 	wg, ctx := errgroup.WithContext(context.Background())
 	wg.Go(func() error {
@@ -57,40 +95,76 @@ func Run(cfg *Config) error {
 			default:
 			}
 
-			err := SyncData(ctx, cfg, ins, healthIns)
+			err := SyncData(ctx, cfg, client, ins, healthIns)
 			if err == dsync.ErrDataNotMatch {
 				continue
 			}
 			if err == nil {
 				// When the synchronization and the cloud are consistent,
-				// wait for a period of time to initiate the request again.
-				logr.Debugf("Sync data finished, wait 10s to continue")
+				// wait for the change notification or a period of time to initiate the request again.
+				logr.Debugf("Sync data finished, wait 10s or manifest changes to continue")
 				// TODO wait time to be configurable
-				time.Sleep(time.Second * 10)
+				select {
+				case <-ctx.Done():
+				case <-changed:
+				case <-time.After(time.Second * 10):
+				}
 				continue
 			}
 			logr.WithError(err).Error("Sync data failed")
 		}
 	})
+	wg.Go(func() error {
+		return WatchManifest(ctx, client, changed)
+	})
 	wg.Go(func() error {
 		return StartAPIServer(ctx)
 	})
+	wg.Go(func() error {
+		return DatasetGC(ctx, ins)
+	})
 	return wg.Wait()
 }
 
 func SyncData(
 	ctx context.Context,
 	cfg *Config,
+	client *Client,
 	ins dsync.Interface,
 	healthIns health.Interface,
 ) error {
 	state := ins.DataSet().State(ctx)
+	publicKey, err := cfg.Server.Key()
+	if err != nil {
+		return err
+	}
 
-	client := NewClient(cfg.Server.Host, cfg.Agent.Name)
-	manifest, err := client.Manifest(ctx, state)
+	if state.IsNil() {
+		return InstallSnapshot(ctx, client, ins, publicKey)
+	}
+	epoch := ins.DataSet().Epoch(ctx)
+	manifest, err := client.Manifest(ctx, state, epoch)
+	if err == dsync.ErrUnknownState {
+		logr.WithField("state", state.String()).Info("State is unknown to mgt-server, bootstrap from snapshot")
+		return InstallSnapshot(ctx, client, ins, publicKey)
+	}
+	if err == dsync.ErrEpochMismatch {
+		logr.WithFields(map[string]interface{}{
+			"state":  state.String(),
+			"synced": epoch,
+		}).Warn("Dataset of mgt-server has been reset, resync from snapshot")
+		return InstallSnapshot(ctx, client, ins, publicKey)
+	}
 	if err != nil {
 		return fmt.Errorf("request manifest failed: %v", err)
 	}
+	// The data synchronized before the epoch is introduced belongs to the current epoch.
+	if epoch == "" && client.Epoch() != "" {
+		if err := ins.DataSet().SetEpoch(ctx, client.Epoch()); err != nil {
+			return fmt.Errorf("set epoch failed: %v", err)
+		}
+		logr.WithField("epoch", client.Epoch()).Info("Epoch of mgt-server dataset recorded")
+	}
 	if manifest == nil {
 		return nil
 	}
@@ -101,35 +175,133 @@ func SyncData(
 		if err := json.Unmarshal([]byte(msg.Data), &items); err != nil {
 			return fmt.Errorf("unmarshal items failed: %v", err)
 		}
-
-		err := ins.DataSet().SyncAndDelete(ctx, items, func(ctx context.Context, item dsync.Item) error {
-			var event v1.Event
-			if err := json.Unmarshal(item.Value, &event); err != nil {
-				return fmt.Errorf("unmarshal event failed: %v", err)
-			}
-
-			var object unstructured.Unstructured
-			if err := object.UnmarshalJSON(event.Data); err != nil {
-				return fmt.Errorf("unmarshal runtime.Object failed: %v", err)
+		// The items may pass through untrusted relays, nothing is synchronized unless all are signed by mgt-server.
+		if publicKey != nil {
+			if err := dsync.VerifySignatures(items, publicKey); err != nil {
+				logr.WithError(err).Error("Data items are not signed by mgt-server, discard the batch")
+				return err
 			}
-			logr.WithFields(map[string]interface{}{
-				"gvk":             object.GroupVersionKind().String(),
-				"namespace":       object.GetNamespace(),
-				"name":            object.GetName(),
-				"resourceVersion": object.GetResourceVersion(),
-			}).Debugf("SyncAndDelete item")
-			// TODO use lite-apiServer storage api to send item
-			// TODO e.g. save and watch event
-			return nil
-		})
+		}
 
+		err := ins.DataSet().SyncAndDelete(ctx, items, handleItem)
 		if err == dsync.ErrDataNotMatch {
 			logr.WithError(err).Debug("Sync and delete data item stopped")
 		}
+		var checksumErr *dsync.ChecksumError
+		if errors.As(err, &checksumErr) {
+			logr.WithError(err).WithField("uid", checksumErr.UID.String()).Error("Data item is corrupted, discard the batch")
+		}
 		return err
 	})
 }
 
+// InstallSnapshot replaces the local data with the snapshot from mgt-server,
+// the subsequent synchronization resumes from the snapshot state.
+// The items of the snapshot are verified with the public key if it is not nil.
+func InstallSnapshot(ctx context.Context, client *Client, ins dsync.Interface, publicKey ed25519.PublicKey) error {
+	snapshot, err := client.Snapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("request snapshot failed: %v", err)
+	}
+	if publicKey != nil {
+		if err := dsync.VerifySignatures(snapshot.Items, publicKey); err != nil {
+			return fmt.Errorf("verify snapshot failed: %v", err)
+		}
+	}
+	if err := ins.DataSet().InstallSnapshotAndDelete(ctx, snapshot, handleItem); err != nil {
+		return fmt.Errorf("install snapshot failed: %v", err)
+	}
+	logr.WithFields(map[string]interface{}{
+		"state": snapshot.State.String(),
+		"epoch": snapshot.Epoch,
+		"items": len(snapshot.Items),
+	}).Info("Snapshot installed")
+	return nil
+}
+
+// handleItem handles the synchronized item, it is called once for each item.
+// It is only called again with the same item if the agent exits right after it returns,
+// before the delivery is recorded, so the downstream deduplicates the item by its UID.
+func handleItem(ctx context.Context, item dsync.Item) error {
+	// The object deleted while the agent was behind is delivered by the snapshot as the tombstone without value.
+	if item.Tombstone && len(item.Value) == 0 {
+		logr.WithField("uid", item.UID.String()).Debugf("Delete item")
+		return nil
+	}
+
+	var event v1.Event
+	if err := json.Unmarshal(item.Value, &event); err != nil {
+		return fmt.Errorf("unmarshal event failed: %v", err)
+	}
+
+	var object unstructured.Unstructured
+	if err := object.UnmarshalJSON(event.Data); err != nil {
+		return fmt.Errorf("unmarshal runtime.Object failed: %v", err)
+	}
+	logr.WithFields(map[string]interface{}{
+		"gvk":             object.GroupVersionKind().String(),
+		"namespace":       object.GetNamespace(),
+		"name":            object.GetName(),
+		"resourceVersion": object.GetResourceVersion(),
+	}).Debugf("SyncAndDelete item")
+	// TODO use lite-apiServer storage api to send item
+	// TODO e.g. save and watch event
+	return nil
+}
+
+// WatchManifest keeps watching the node manifest, and notifies changed when it changes.
+// The polling in SyncData is still the fallback, so the failure is only logged.
+func WatchManifest(ctx context.Context, client *Client, changed chan<- struct{}) error {
+	for {
+		err := client.Watch(ctx, func(uid suid.UID) error {
+			logr.Debugf("Manifest changed, uid: %s", uid)
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			logr.WithError(err).Debug("Watch manifest stopped")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second * 10):
+		}
+	}
+}
+
+// DatasetGC runs the dataset garbage collection
+func DatasetGC(ctx context.Context, ins dsync.Interface) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Minute * 30):
+		}
+
+		result, err := ins.GC(ctx, dsync.GCOptions{
+			TmpExpiration:       time.Hour,
+			OrphanExpiration:    time.Hour,
+			TombstoneExpiration: time.Hour,
+			// The data is deleted after synchronization, the association relationships are still needed.
+			KeepRelates: true,
+		})
+		if err != nil {
+			logr.WithError(err).Error("DataSet GC failed")
+			continue
+		}
+		logr.WithFields(map[string]interface{}{
+			"tmp":       len(result.Tmp),
+			"relate":    len(result.Relate),
+			"dataset":   len(result.Dataset),
+			"tombstone": len(result.Tombstone),
+		}).Info("DataSet GC finished")
+	}
+}
+
 // StartAPIServer
 // TODO APIServer（轻量化 k8s APIServer），供节点直接调用，获取本地存储中的资源，增/改/删 操作需要透传至云端
 func StartAPIServer(ctx context.Context) error {
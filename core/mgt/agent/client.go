@@ -21,11 +21,15 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/99nil/diplomat/global/constants"
 	"github.com/99nil/diplomat/pkg/logr"
 	"github.com/99nil/diplomat/pkg/sse"
+	"github.com/99nil/dsync"
+	"github.com/99nil/dsync/storage/compress"
 	"github.com/99nil/dsync/suid"
 )
 
@@ -36,13 +40,40 @@ func NewClient(host, nodeName string) *Client {
 }
 
 type Client struct {
-	client   *http.Client
-	host     string
-	node     string
+	client *http.Client
+	host   string
+	node   string
+	// mux guards instance, which is shared by the synchronization and the watch of the agent
+	mux      sync.RWMutex
 	instance string
+	// version is the manifest version negotiated with mgt-server
+	version suid.ManifestVersion
+	// epoch is the epoch of the mgt-server dataset responded with the manifest
+	epoch string
 }
 
-func (c *Client) Manifest(ctx context.Context, state suid.UID) (*suid.AssembleManifest, error) {
+// Instance returns the mgt-server instance negotiated by the last manifest or snapshot
+func (c *Client) Instance() string {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.instance
+}
+
+func (c *Client) setInstance(instance string) {
+	c.mux.Lock()
+	c.instance = instance
+	c.mux.Unlock()
+}
+
+// Epoch returns the epoch of the mgt-server dataset responded with the last manifest,
+// it is empty if mgt-server does not support the epoch.
+func (c *Client) Epoch() string {
+	return c.epoch
+}
+
+// Manifest gets the manifest after the state, which is synchronized from the dataset of the epoch.
+// It returns dsync.ErrEpochMismatch if the mgt-server dataset has been reset since.
+func (c *Client) Manifest(ctx context.Context, state suid.UID, epoch string) (*suid.AssembleManifest, error) {
 	uri := c.host + "/api/v1/manifest"
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
 	if err != nil {
@@ -52,6 +83,8 @@ func (c *Client) Manifest(ctx context.Context, state suid.UID) (*suid.AssembleMa
 	req.Header = make(http.Header)
 	req.Header.Set("node", c.node)
 	req.Header.Set("state", state.String())
+	req.Header.Set("epoch", epoch)
+	req.Header.Set("manifest-version", strconv.Itoa(int(suid.LatestManifestVersion)))
 
 	res, err := c.client.Do(req)
 	if err != nil {
@@ -64,6 +97,12 @@ func (c *Client) Manifest(ctx context.Context, state suid.UID) (*suid.AssembleMa
 	if err != nil {
 		return nil, err
 	}
+	if res.StatusCode == http.StatusConflict {
+		return nil, dsync.ErrUnknownState
+	}
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return nil, dsync.ErrEpochMismatch
+	}
 	if res.StatusCode != http.StatusOK {
 		return nil, errors.New(string(body))
 	}
@@ -72,12 +111,65 @@ func (c *Client) Manifest(ctx context.Context, state suid.UID) (*suid.AssembleMa
 	if err := json.Unmarshal(body, &manifest); err != nil {
 		return nil, err
 	}
-	c.instance = instance
+	// The request may be forwarded to another mgt-server instance, check the epoch again.
+	c.epoch = res.Header.Get("epoch")
+	if c.epoch != "" {
+		if err := dsync.CheckEpoch(epoch, c.epoch); err != nil {
+			return nil, err
+		}
+	}
+	c.setInstance(instance)
+	// mgt-server without version support does not respond with the version, so the legacy format is used.
+	c.version = suid.ManifestVersionLegacy
+	if v, err := strconv.Atoi(res.Header.Get("manifest-version")); err == nil {
+		c.version = suid.ManifestVersion(v)
+	}
 	return manifest, nil
 }
 
+// Snapshot gets the latest items and the state they correspond to,
+// the node is bootstrapped from it when its state is nil or unknown to mgt-server.
+func (c *Client) Snapshot(ctx context.Context) (*dsync.Snapshot, error) {
+	uri := c.host + "/api/v1/snapshot"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = make(http.Header)
+	req.Header.Set("node", c.node)
+	req.Header.Set("data-encoding", string(compress.Zstd))
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	instance := res.Header.Get(fmt.Sprintf("%s-mgt-server-instance", constants.ProjectName))
+	logr.Debugf("Request snapshot from mgt-server-instance: %s", instance)
+
+	if res.StatusCode != http.StatusOK {
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New(string(body))
+	}
+
+	var snapshot dsync.Snapshot
+	if err := json.NewDecoder(res.Body).Decode(&snapshot); err != nil {
+		return nil, err
+	}
+	c.setInstance(instance)
+	return &snapshot, nil
+}
+
 func (c *Client) Data(ctx context.Context, manifest *suid.AssembleManifest, fn func(msg *sse.Message) error) error {
-	b, err := json.Marshal(manifest)
+	text, err := manifest.MarshalTextVersion(c.version)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(string(text))
 	if err != nil {
 		return err
 	}
@@ -88,15 +180,41 @@ func (c *Client) Data(ctx context.Context, manifest *suid.AssembleManifest, fn f
 		return err
 	}
 	req.Header.Set("node", c.node)
-	req.Header.Set(fmt.Sprintf("%s-mgt-server-instance", constants.ProjectName), c.instance)
+	req.Header.Set(fmt.Sprintf("%s-mgt-server-instance", constants.ProjectName), c.Instance())
 	req.Header.Set("manifest", string(b))
+	req.Header.Set("data-encoding", string(compress.Zstd))
 
 	res, err := c.client.Do(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
+	return readStream(res.Body, fn)
+}
+
+// Watch watches the changes of the node manifest, fn is called with the UID added to the manifest.
+// It returns when the stream is closed.
+func (c *Client) Watch(ctx context.Context, fn func(uid suid.UID) error) error {
+	uri := c.host + "/api/v1/watch"
+	req, err := sse.NewRequest(uri)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("node", c.node)
+	req.Header.Set(fmt.Sprintf("%s-mgt-server-instance", constants.ProjectName), c.Instance())
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	return readStream(res.Body, func(msg *sse.Message) error {
+		return fn(suid.UID(msg.Data))
+	})
+}
+
+func readStream(body io.ReadCloser, fn func(msg *sse.Message) error) error {
+	defer body.Close()
 
-	reader := sse.NewEventStreamReader(res.Body, 1024*1024)
+	reader := sse.NewEventStreamReader(body, 1024*1024)
 	for {
 		content, err := reader.ReadEvent()
 		if err != nil {
@@ -15,11 +15,14 @@
 package agent
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"os"
 
 	"github.com/99nil/diplomat/pkg/logr"
-	badgerstorage "github.com/99nil/dsync/storage/badger"
+	"github.com/99nil/diplomat/pkg/storage"
 )
 
 func Environ(envPrefix string) *Config {
@@ -33,18 +36,19 @@ func Environ(envPrefix string) *Config {
 }
 
 type Config struct {
-	Logger  logr.Config  `json:"logger,omitempty"`
-	Agent   ConfigAgent  `json:"agent,omitempty"`
-	Server  ConfigServer `json:"server"`
-	Storage Storage      `json:"storage,omitempty"`
+	Logger  logr.Config    `json:"logger,omitempty"`
+	Agent   ConfigAgent    `json:"agent,omitempty"`
+	Server  ConfigServer   `json:"server"`
+	Storage storage.Config `json:"storage,omitempty"`
 }
 
 func (c *Config) Complete() {
-	// TODO When supporting multiple storage backends, we can remove this default setting.
-	if c.Storage.Badger == nil {
-		c.Storage.Badger = &badgerstorage.Config{
-			Path: "/tmp/diplomat/agent/storage",
-		}
+	c.Storage.Complete("/tmp/diplomat/agent/storage")
+	if c.Agent.HistoryLimit == 0 {
+		c.Agent.HistoryLimit = 5
+	}
+	if c.Agent.CallbackAttempts == 0 {
+		c.Agent.CallbackAttempts = 3
 	}
 }
 
@@ -52,17 +56,40 @@ func (c *Config) Validate() error {
 	if c.Server.Host == "" {
 		return errors.New("server.host must exist")
 	}
-	return nil
+	if _, err := c.Server.Key(); err != nil {
+		return err
+	}
+	return c.Storage.Validate()
 }
 
 type ConfigAgent struct {
 	Name string `json:"name"`
+	// HistoryLimit is the number of versions kept for each object to revert,
+	// a negative value disables the history.
+	HistoryLimit int `json:"historyLimit,omitempty"`
+	// CallbackAttempts is the number of attempts to handle a synchronized item before it is dead-lettered,
+	// a negative value disables the retry and the failed item stops the synchronization.
+	CallbackAttempts int `json:"callbackAttempts,omitempty"`
 }
 
 type ConfigServer struct {
 	Host string `json:"host" yaml:"host"`
+	// PublicKey is the base64 encoded ed25519 public key of mgt-server,
+	// the unsigned or badly signed items are rejected if it is set.
+	PublicKey string `json:"publicKey,omitempty" yaml:"publicKey,omitempty"`
 }
 
-type Storage struct {
-	Badger *badgerstorage.Config `json:"badger"`
+// Key returns the pinned ed25519 public key, or nil if the verification is disabled.
+func (c *ConfigServer) Key() (ed25519.PublicKey, error) {
+	if c.PublicKey == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(c.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("server.publicKey is not valid base64: %v", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("server.publicKey has invalid length %d", len(b))
+	}
+	return ed25519.PublicKey(b), nil
 }
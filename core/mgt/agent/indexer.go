@@ -0,0 +1,84 @@
+// Copyright © 2022 99nil.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+
+	v1 "github.com/99nil/diplomat/pkg/api/v1"
+	"github.com/99nil/dsync"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// The names of the indexes maintained for the synchronized objects
+const (
+	// IndexLabel indexes the object by each label in the form of key=value
+	IndexLabel = "label"
+	// IndexOwner indexes the object by the UID of each owner reference
+	IndexOwner = "owner"
+	// IndexNodeName indexes the object by spec.nodeName
+	IndexNodeName = "nodeName"
+)
+
+// NewIndexers returns the indexers over the objects carried by the synchronized events
+func NewIndexers() dsync.Indexers {
+	return dsync.Indexers{
+		IndexLabel:    objectIndexFunc(labelIndexFunc),
+		IndexOwner:    objectIndexFunc(ownerIndexFunc),
+		IndexNodeName: objectIndexFunc(nodeNameIndexFunc),
+	}
+}
+
+// objectIndexFunc decodes the object from the event in the item before calling fn
+func objectIndexFunc(fn func(object *unstructured.Unstructured) ([]string, error)) dsync.IndexFunc {
+	return func(item dsync.Item) ([]string, error) {
+		var event v1.Event
+		if err := json.Unmarshal(item.Value, &event); err != nil {
+			return nil, fmt.Errorf("unmarshal event failed: %v", err)
+		}
+		var object unstructured.Unstructured
+		if err := object.UnmarshalJSON(event.Data); err != nil {
+			return nil, fmt.Errorf("unmarshal runtime.Object failed: %v", err)
+		}
+		return fn(&object)
+	}
+}
+
+func labelIndexFunc(object *unstructured.Unstructured) ([]string, error) {
+	labels := object.GetLabels()
+	values := make([]string, 0, len(labels))
+	for k, v := range labels {
+		values = append(values, k+"="+v)
+	}
+	return values, nil
+}
+
+func ownerIndexFunc(object *unstructured.Unstructured) ([]string, error) {
+	refs := object.GetOwnerReferences()
+	values := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		values = append(values, string(ref.UID))
+	}
+	return values, nil
+}
+
+func nodeNameIndexFunc(object *unstructured.Unstructured) ([]string, error) {
+	nodeName, found, err := unstructured.NestedString(object.Object, "spec", "nodeName")
+	if err != nil || !found || nodeName == "" {
+		return nil, err
+	}
+	return []string{nodeName}, nil
+}
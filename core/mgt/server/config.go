@@ -15,11 +15,14 @@
 package server
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
 	"os"
 
 	"github.com/99nil/diplomat/pkg/logr"
 
-	badgerstorage "github.com/99nil/dsync/storage/badger"
+	"github.com/99nil/diplomat/pkg/storage"
 
 	"github.com/99nil/diplomat/pkg/k8s"
 	"github.com/99nil/gopkg/server"
@@ -41,30 +44,49 @@ func Environ(envPrefix string) *Config {
 }
 
 type Config struct {
-	Logger     logr.Config   `json:"logger,omitempty"`
-	Instance   Instance      `json:"instance,omitempty"`
-	Server     server.Config `json:"server,omitempty"`
-	Kubernetes *k8s.Config   `json:"kubernetes,omitempty"`
-	Storage    Storage       `json:"storage,omitempty"`
+	Logger     logr.Config    `json:"logger,omitempty"`
+	Instance   Instance       `json:"instance,omitempty"`
+	Server     server.Config  `json:"server,omitempty"`
+	Kubernetes *k8s.Config    `json:"kubernetes,omitempty"`
+	Storage    storage.Config `json:"storage,omitempty"`
+	Signing    Signing        `json:"signing,omitempty"`
 }
 
 func (c *Config) Complete() {
-	// TODO When supporting multiple storage backends, we can remove this default setting.
-	if c.Storage.Badger == nil {
-		c.Storage.Badger = &badgerstorage.Config{
-			Path: "/tmp/diplomat/server/storage",
-		}
-	}
+	c.Storage.Complete("/tmp/diplomat/server/storage")
 }
 
 func (c *Config) Validate() error {
-	return nil
+	if _, err := c.Signing.Key(); err != nil {
+		return err
+	}
+	return c.Storage.Validate()
 }
 
 type Instance struct {
 	Name string `json:"name"`
 }
 
-type Storage struct {
-	Badger *badgerstorage.Config `json:"badger"`
+type Signing struct {
+	// PrivateKey is the base64 encoded ed25519 seed or private key to sign the sync items,
+	// the items are not signed if it is empty.
+	PrivateKey string `json:"privateKey,omitempty"`
+}
+
+// Key returns the ed25519 private key, or nil if the signing is disabled.
+func (s *Signing) Key() (ed25519.PrivateKey, error) {
+	if s.PrivateKey == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(s.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing.privateKey is not valid base64: %v", err)
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), nil
+	}
+	return nil, fmt.Errorf("signing.privateKey has invalid length %d", len(b))
 }
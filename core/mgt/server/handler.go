@@ -15,10 +15,13 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/99nil/diplomat/pkg/sse"
@@ -27,6 +30,7 @@ import (
 	"github.com/99nil/diplomat/pkg/logr"
 	"github.com/99nil/diplomat/pkg/nodeset"
 	"github.com/99nil/dsync"
+	"github.com/99nil/dsync/storage/compress"
 	"github.com/99nil/dsync/suid"
 	"github.com/99nil/gopkg/ctr"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -48,110 +52,274 @@ func manifest(
 			return
 		}
 
+		// The state of the agent is meaningless if it was synchronized from a dataset that has been reset since,
+		// the agent needs to bootstrap from the snapshot.
+		epoch := ins.DataSet().Epoch(ctx)
+		w.Header().Set("epoch", epoch)
+		if err := dsync.CheckEpoch(r.Header.Get("epoch"), epoch); err != nil {
+			logr.WithFields(map[string]interface{}{
+				"node":    nodeName,
+				"state":   state,
+				"synced":  r.Header.Get("epoch"),
+				"current": epoch,
+			}).Warn("Node epoch mismatch, force the node to resync from snapshot")
+			ctr.ErrorCode(w, err, http.StatusPreconditionFailed)
+			return
+		}
+
 		syncer := ins.Syncer(nodeName)
 		if !set.Has(nodeName) {
-			node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
-			if err != nil {
-				ctr.InternalError(w, fmt.Errorf("get node(%s) failed: %v", nodeName, err))
+			if err := registerNode(ctx, kubeClient, ins, set, nodeName); err != nil {
+				ctr.InternalError(w, err)
 				return
 			}
 
-			var keys []nodeset.Key
-			// Resolve the ClusterRole associated with the node
-			clusterRoleStr, clusterRoleOK := node.Annotations[constants.AnnotationRelateClusterRole]
-			clusterRoles := strings.Split(clusterRoleStr, ",")
-			for _, roleName := range clusterRoles {
-				roleName = strings.TrimSpace(roleName)
-				if roleName == "" {
-					continue
-				}
-				clusterRole, err := kubeClient.RbacV1().ClusterRoles().Get(ctx, roleName, metav1.GetOptions{})
+			// The agent without state bootstraps from the snapshot, so there is nothing to backfill.
+			if state != "" {
+				// Get all matching UIDs and add them to the node manifest
+				var uids []suid.UID
+				err := ins.DataSet().RangeCustom(ctx, func(uid suid.UID) error {
+					uids = append(uids, uid)
+					return nil
+				})
 				if err != nil {
 					ctr.InternalError(w, err)
 					return
 				}
-				for _, rule := range clusterRole.Rules {
-					for _, group := range rule.APIGroups {
-						for _, resource := range rule.Resources {
-							keys = append(keys, nodeset.Key{
-								Group:    group,
-								Resource: resource,
-							})
-						}
-					}
+				if err := syncer.Add(ctx, uids...); err != nil {
+					ctr.InternalError(w, err)
+					return
 				}
 			}
+		}
 
-			// Resolve the Role associated with the node
-			// namespace1: role1,rol2,rol3; namespace2: role1,role2
-			roleStr, roleOK := node.Annotations[constants.AnnotationRelateRole]
-			parts := strings.Split(roleStr, ";")
-			for _, part := range parts {
-				part = strings.TrimSpace(part)
-				if part == "" {
-					continue
-				}
-				arr := strings.Split(part, ":")
-				if len(arr) != 2 {
-					logr.Warnf("node(%s) relate role parse failed: format error, ignore.")
-					continue
-				}
+		m, err := syncer.Manifest(ctx, []byte(state), 100)
+		if err == dsync.ErrUnknownState {
+			// The agent needs to bootstrap from the snapshot.
+			ctr.ErrorCode(w, err, http.StatusConflict)
+			return
+		}
+		if err != nil && err != dsync.ErrEmptyManifest {
+			ctr.InternalError(w, err)
+			return
+		}
 
-				namespace := strings.TrimSpace(arr[0])
-				roleName := strings.TrimSpace(arr[1])
-				if roleName == "" {
-					continue
-				}
+		// Proxy Server forwards requests according to the specified instance.
+		// So the agent must carry back this request header.
+		w.Header().Set(fmt.Sprintf("%s-mgt-server-instance", constants.ProjectName), cfg.Instance.Name)
+		if m == nil {
+			ctr.OK(w, m)
+			return
+		}
 
-				role, err := kubeClient.RbacV1().Roles(namespace).Get(ctx, roleName, metav1.GetOptions{})
-				if err != nil {
-					ctr.InternalError(w, err)
-					return
-				}
-				for _, rule := range role.Rules {
-					for _, group := range rule.APIGroups {
-						for _, resource := range rule.Resources {
-							keys = append(keys, nodeset.Key{
-								Group:    group,
-								Resource: resource,
-							})
-						}
-					}
-				}
+		// The agent without version support only accepts the legacy manifest format.
+		version := suid.ManifestVersionLegacy
+		if v, err := strconv.Atoi(r.Header.Get("manifest-version")); err == nil && v > 0 {
+			version = suid.LatestManifestVersion
+			if v < int(version) {
+				version = suid.ManifestVersion(v)
 			}
+		}
+		text, err := m.MarshalTextVersion(version)
+		if err != nil {
+			ctr.InternalError(w, err)
+			return
+		}
+		w.Header().Set("manifest-version", strconv.Itoa(int(version)))
+		ctr.OK(w, string(text))
+	}
+}
 
-			if !clusterRoleOK && !roleOK {
-				keys = []nodeset.Key{nodeset.Any}
+// registerNode resolves the resources the node is allowed to watch through its roles,
+// and binds the node to the subscriptions of the resources.
+func registerNode(
+	ctx context.Context,
+	kubeClient kubernetes.Interface,
+	ins dsync.Interface,
+	set nodeset.Interface,
+	nodeName string,
+) error {
+	node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get node(%s) failed: %v", nodeName, err)
+	}
+
+	var keys []nodeset.Key
+	// Resolve the ClusterRole associated with the node
+	clusterRoleStr, clusterRoleOK := node.Annotations[constants.AnnotationRelateClusterRole]
+	clusterRoles := strings.Split(clusterRoleStr, ",")
+	for _, roleName := range clusterRoles {
+		roleName = strings.TrimSpace(roleName)
+		if roleName == "" {
+			continue
+		}
+		clusterRole, err := kubeClient.RbacV1().ClusterRoles().Get(ctx, roleName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for _, rule := range clusterRole.Rules {
+			for _, group := range rule.APIGroups {
+				for _, resource := range rule.Resources {
+					keys = append(keys, nodeset.Key{
+						Group:    group,
+						Resource: resource,
+					})
+				}
 			}
-			set.Set(nodeName, keys)
-
-			// Get all matching UIDs and add them to the node manifest
-			var uids []suid.UID
-			err = ins.DataSet().RangeCustom(ctx, func(uid suid.UID) error {
-				uids = append(uids, uid)
-				return nil
-			})
-			if err != nil {
-				ctr.InternalError(w, err)
-				return
+		}
+	}
+
+	// Resolve the Role associated with the node
+	// namespace1: role1,rol2,rol3; namespace2: role1,role2
+	roleStr, roleOK := node.Annotations[constants.AnnotationRelateRole]
+	parts := strings.Split(roleStr, ";")
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		arr := strings.Split(part, ":")
+		if len(arr) != 2 {
+			logr.Warnf("node(%s) relate role parse failed: format error, ignore.")
+			continue
+		}
+
+		namespace := strings.TrimSpace(arr[0])
+		roleName := strings.TrimSpace(arr[1])
+		if roleName == "" {
+			continue
+		}
+
+		role, err := kubeClient.RbacV1().Roles(namespace).Get(ctx, roleName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		for _, rule := range role.Rules {
+			for _, group := range rule.APIGroups {
+				for _, resource := range rule.Resources {
+					keys = append(keys, nodeset.Key{
+						Group:    group,
+						Resource: resource,
+					})
+				}
 			}
-			if err := syncer.Add(ctx, uids...); err != nil {
+		}
+	}
+
+	if !clusterRoleOK && !roleOK {
+		keys = []nodeset.Key{nodeset.Any}
+	}
+	set.Set(nodeName, keys)
+	for _, key := range keys {
+		if err := ins.Subscription(key.String()).Bind(ctx, nodeName); err != nil {
+			return fmt.Errorf("bind node(%s) to subscription(%s) failed: %v", nodeName, key, err)
+		}
+	}
+	return nil
+}
+
+func snapshot(
+	cfg *Config,
+	kubeClient kubernetes.Interface,
+	ins dsync.Interface,
+	set nodeset.Interface,
+) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		nodeName := r.Header.Get("node")
+		if nodeName == "" {
+			ctr.BadRequest(w, errors.New("node name not found"))
+			return
+		}
+
+		// The node must be registered before the snapshot is taken,
+		// so that the UIDs added after the snapshot state are kept in the node subscriptions.
+		if !set.Has(nodeName) {
+			if err := registerNode(ctx, kubeClient, ins, set, nodeName); err != nil {
 				ctr.InternalError(w, err)
 				return
 			}
 		}
 
-		m, err := syncer.Manifest(ctx, []byte(state), 100)
-		if err != nil && err != dsync.ErrEmptyManifest {
+		w.Header().Set(fmt.Sprintf("%s-mgt-server-instance", constants.ProjectName), cfg.Instance.Name)
+		sw := &snapshotWriter{w: w}
+		s, err := ins.Syncer(nodeName).StreamSnapshot(ctx, sw.item, dsync.WithDataEncoding(dataEncoding(r), compress.DefaultThreshold))
+		if err != nil && sw.items == 0 {
 			ctr.InternalError(w, err)
 			return
 		}
+		if err == nil {
+			err = sw.close(s)
+		}
+		if err != nil {
+			// The truncated snapshot fails to decode in the agent, which requests it again.
+			logr.WithError(err).WithField("node", nodeName).Error("Stream snapshot failed")
+			return
+		}
+		logr.WithFields(map[string]interface{}{
+			"node":  nodeName,
+			"state": s.State.String(),
+			"epoch": s.Epoch,
+			"items": sw.items,
+		}).Info("Snapshot taken")
+	}
+}
 
-		// Proxy Server forwards requests according to the specified instance.
-		// So the agent must carry back this request header.
-		w.Header().Set(fmt.Sprintf("%s-mgt-server-instance", constants.ProjectName), cfg.Instance.Name)
-		ctr.OK(w, m)
+// snapshotWriter writes the snapshot as JSON with the items streamed one by one,
+// the state and the epoch are written after the items, they are only returned at the end of the stream.
+type snapshotWriter struct {
+	w     http.ResponseWriter
+	items int
+}
+
+func (sw *snapshotWriter) item(item dsync.Item) error {
+	b, err := json.Marshal(item)
+	if err != nil {
+		return err
 	}
+	prefix := ","
+	if sw.items == 0 {
+		prefix = `{"Items":[`
+		sw.w.Header().Set("Content-Type", "application/json")
+		sw.w.WriteHeader(http.StatusOK)
+	}
+	sw.items++
+	if _, err := io.WriteString(sw.w, prefix); err != nil {
+		return err
+	}
+	_, err = sw.w.Write(b)
+	return err
+}
+
+func (sw *snapshotWriter) close(s *dsync.Snapshot) error {
+	state, err := json.Marshal(s.State)
+	if err != nil {
+		return err
+	}
+	epoch, err := json.Marshal(s.Epoch)
+	if err != nil {
+		return err
+	}
+	if sw.items == 0 {
+		sw.w.Header().Set("Content-Type", "application/json")
+		sw.w.WriteHeader(http.StatusOK)
+		_, err = fmt.Fprintf(sw.w, `{"Items":[],"State":%s,"Epoch":%s}`, state, epoch)
+		return err
+	}
+	_, err = fmt.Fprintf(sw.w, `],"State":%s,"Epoch":%s}`, state, epoch)
+	return err
+}
+
+// dataEncoding selects the first encoding in the data-encoding header supported by the server,
+// the agent without compression support receives the uncompressed items.
+func dataEncoding(r *http.Request) compress.Encoding {
+	for _, v := range strings.Split(r.Header.Get("data-encoding"), ",") {
+		encoding := compress.Encoding(strings.TrimSpace(v))
+		if encoding != compress.Identity && compress.Supported(encoding) {
+			return encoding
+		}
+	}
+	return compress.Identity
 }
 
 func data(ins dsync.Interface) http.HandlerFunc {
@@ -161,6 +329,7 @@ func data(ins dsync.Interface) http.HandlerFunc {
 			sse.NewErrMessage("", "node name not found").Send(w)
 			return
 		}
+		encoding := dataEncoding(r)
 		logr.Debugf("events: stream started, node: %s", nodeName)
 
 		manifestStr := r.Header.Get("manifest")
@@ -182,7 +351,7 @@ func data(ins dsync.Interface) http.HandlerFunc {
 		current := suid.NewManifest()
 		var ms []suid.AssembleManifest
 		for iter := m.Iter(); iter.Next(); num++ {
-			current.Append(iter.KSUID)
+			current.AppendUID(m.GetUID(iter.KSUID))
 			// TODO number limit to be configurable
 			if num > 10 {
 				num = 0
@@ -195,7 +364,7 @@ func data(ins dsync.Interface) http.HandlerFunc {
 		}
 
 		for _, v := range ms {
-			items, err := ins.Syncer(nodeName).Data(r.Context(), &v)
+			items, err := ins.Syncer(nodeName).Data(r.Context(), &v, dsync.WithDataEncoding(encoding, compress.DefaultThreshold))
 			if err != nil {
 				errStr := fmt.Sprintf("get sync data failed, node: %s, error: %s", nodeName, err)
 				logr.Error(errStr)
@@ -212,3 +381,52 @@ func data(ins dsync.Interface) http.HandlerFunc {
 		logr.Debugf("events: stream closed, node: %s", nodeName)
 	}
 }
+
+func watchManifest(ins dsync.Interface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nodeName := r.Header.Get("node")
+		if nodeName == "" {
+			sse.NewErrMessage("", "node name not found").Send(w)
+			return
+		}
+		logr.Debugf("watch: stream started, node: %s", nodeName)
+
+		ctx := r.Context()
+		ch := ins.Syncer(nodeName).Watch(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				logr.Debugf("watch: stream closed, node: %s", nodeName)
+				return
+			case uid, ok := <-ch:
+				if !ok {
+					return
+				}
+				sse.NewMessage("", "", uid.String()).Send(w)
+			}
+		}
+	}
+}
+
+// syncers returns the statistics of all node syncers, which can be used to find the lagging nodes.
+func syncers(ins dsync.Interface) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		names, err := ins.Syncers(ctx)
+		if err != nil {
+			ctr.InternalError(w, err)
+			return
+		}
+
+		result := make(map[string]*dsync.SyncerStats, len(names))
+		for _, name := range names {
+			stats, err := ins.Syncer(name).Stats(ctx)
+			if err != nil {
+				ctr.InternalError(w, fmt.Errorf("get syncer(%s) stats failed: %v", name, err))
+				return
+			}
+			result[name] = stats
+		}
+		ctr.OK(w, result)
+	}
+}
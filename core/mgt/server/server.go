@@ -16,6 +16,7 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -26,10 +27,10 @@ import (
 	"github.com/99nil/diplomat/pkg/k8s/watchsched"
 	"github.com/99nil/diplomat/pkg/logr"
 	"github.com/99nil/diplomat/pkg/nodeset"
+	"github.com/99nil/diplomat/pkg/storage"
 	"github.com/99nil/diplomat/pkg/types"
 	"github.com/99nil/diplomat/pkg/util"
 	"github.com/99nil/dsync"
-	badgerstorage "github.com/99nil/dsync/storage/badger"
 	"github.com/99nil/dsync/suid"
 	"github.com/99nil/gopkg/server"
 
@@ -46,16 +47,43 @@ import (
 )
 
 func Run(cfg *Config, kubeClient kubernetes.Interface, dynamicClient dynamic.Interface) error {
-	storageClient, err := badgerstorage.New(cfg.Storage.Badger)
+	storageClient, err := storage.New(&cfg.Storage)
 	if err != nil {
 		return err
 	}
 
-	ins, err := dsync.New(
-		dsync.WithStorageOption(storageClient))
+	signingKey, err := cfg.Signing.Key()
 	if err != nil {
 		return err
 	}
+	opts := []dsync.Option{
+		dsync.WithStorageOption(storageClient),
+		dsync.WithCompactOption(types.MetaNameKey),
+	}
+	if signingKey != nil {
+		opts = append(opts, dsync.WithSignerOption(signingKey))
+	}
+	ins, err := dsync.New(opts...)
+	if err != nil {
+		return err
+	}
+	// The keys written by the versions before the badger layout is versioned are moved to the current layout.
+	migrated, err := storage.MigrateLayout(context.Background(), storageClient, ins)
+	if err != nil {
+		return fmt.Errorf("migrate storage layout failed: %v", err)
+	}
+	if migrated > 0 {
+		logr.Infof("Migrated %d keys in storage to the current layout", migrated)
+	}
+	// The values written with the rotated keys are encrypted with the primary key,
+	// and so are the ones written before the encryption is enabled if storage.encryption.allowPlaintext is set.
+	reencrypted, err := storage.Reencrypt(context.Background(), storageClient, ins)
+	if err != nil {
+		return fmt.Errorf("reencrypt storage failed: %v", err)
+	}
+	if reencrypted > 0 {
+		logr.Infof("Reencrypted %d values in storage", reencrypted)
+	}
 	set := nodeset.New()
 
 	s := server.New(&cfg.Server)
@@ -90,7 +118,10 @@ func NewRouter(cfg *Config, kubeClient kubernetes.Interface, ins dsync.Interface
 
 	mux.Route("/api/v1", func(r chi.Router) {
 		r.Get("/manifest", manifest(cfg, kubeClient, ins, set))
+		r.Get("/snapshot", snapshot(cfg, kubeClient, ins, set))
 		r.Get("/data", sse.Wrap(data(ins)))
+		r.Get("/watch", sse.Wrap(watchManifest(ins)))
+		r.Get("/syncers", syncers(ins))
 	})
 	return mux
 }
@@ -125,6 +156,14 @@ func eventOperate(
 	}
 
 	gvk := object.GroupVersionKind()
+	if eventType == watch.Deleted && gvk.Group == "" && gvk.Kind == "Node" {
+		// The manifest of the deleted node will never be consumed.
+		nodeName := object.GetName()
+		set.Del(nodeName)
+		if err := ins.RemoveSyncer(ctx, nodeName); err != nil {
+			logr.WithError(err).WithField("node", nodeName).Error("Remove node syncer failed")
+		}
+	}
 	namespace := object.GetNamespace()
 	metaKey := types.NewMeta(gvk.Group, gvk.Version, gvk.Kind, namespace, object.GetName(), object.GetResourceVersion())
 
@@ -138,29 +177,35 @@ func eventOperate(
 		logr.WithError(err).Error("Marshal JSON from event failed")
 		return
 	}
-	if err := ins.DataSet().Add(ctx, dsync.Item{
+	// The nodes subscribing to the same key share one subscription log,
+	// so the cost of adding does not grow with the number of nodes.
+	plural, _ := meta.UnsafeGuessKindToResource(gvk)
+	keys := []nodeset.Key{
+		{
+			Group:     metaKey.Group,
+			Resource:  plural.Resource,
+			Namespace: namespace,
+		},
+		nodeset.Any,
+	}
+	var subscriptions []string
+	for _, key := range keys {
+		if set.Get(key).Len() > 0 {
+			subscriptions = append(subscriptions, key.String())
+		}
+	}
+	// The item is added and appended to the subscriptions together,
+	// so that a node never moves past an item appended later.
+	if err := ins.Publish(ctx, subscriptions, dsync.Item{
 		UID:   uid,
 		Value: jsonBytes,
+		// The deleted object is kept as the tombstone of its name until all nodes have synchronized it.
+		Tombstone: eventType == watch.Deleted,
 	}); err != nil {
-		logr.WithError(err).WithField("uid", uid.CustomUID()).Errorf("Add uid to dateset failed")
-		return
-	}
-
-	plural, _ := meta.UnsafeGuessKindToResource(gvk)
-	nodes := set.Get(nodeset.Key{
-		Group:     metaKey.Group,
-		Resource:  plural.Resource,
-		Namespace: namespace,
-	})
-	rootNodes := set.Get(nodeset.Any)
-	allNodes := nodes.Union(rootNodes)
-	for k := range allNodes {
-		if err := ins.Syncer(k).Add(ctx, uid); err != nil {
-			logr.WithError(err).WithFields(map[string]interface{}{
-				"uid":  uid.CustomUID(),
-				"node": k,
-			}).Error("Add uid to node manifest failed")
-		}
+		logr.WithError(err).WithFields(map[string]interface{}{
+			"uid":           uid.CustomUID(),
+			"subscriptions": subscriptions,
+		}).Error("Publish uid failed")
 	}
 }
 
@@ -201,5 +246,29 @@ func DatasetGC(ctx context.Context, ins dsync.Interface) error {
 		if err != nil {
 			logr.WithError(err).Error("DataSet GC, Range failed")
 		}
+
+		corrupted, err := ins.DataSet().Verify(ctx)
+		if err != nil {
+			logr.WithError(err).Error("DataSet GC, verify failed")
+		}
+		for _, uid := range corrupted {
+			logr.WithField("uid", uid.String()).Error("DataSet GC, data item is corrupted")
+		}
+
+		result, err := ins.GC(ctx, dsync.GCOptions{
+			TmpExpiration:       time.Hour,
+			OrphanExpiration:    time.Hour,
+			TombstoneExpiration: time.Hour,
+		})
+		if err != nil {
+			logr.WithError(err).Error("DataSet GC, dsync GC failed")
+			continue
+		}
+		logr.WithFields(map[string]interface{}{
+			"tmp":       len(result.Tmp),
+			"relate":    len(result.Relate),
+			"dataset":   len(result.Dataset),
+			"tombstone": len(result.Tombstone),
+		}).Info("DataSet GC finished")
 	}
 }
@@ -25,6 +25,7 @@ type Interface interface {
 	Has(name string) bool
 	Get(key Key) sets.String
 	Set(name string, keys []Key)
+	Del(name string)
 }
 
 func New() Interface {
@@ -76,3 +77,16 @@ func (s *set) Set(name string, keys []Key) {
 		s.data[keyPath].Add(name)
 	}
 }
+
+func (s *set) Del(name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.all.Remove(name)
+	for keyPath, names := range s.data {
+		names.Remove(name)
+		if names.Len() == 0 {
+			delete(s.data, keyPath)
+		}
+	}
+}
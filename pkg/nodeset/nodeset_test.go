@@ -250,3 +250,67 @@ func Test_set_Set(t *testing.T) {
 		})
 	}
 }
+
+func Test_set_Del(t *testing.T) {
+	defaultKey := Key{
+		Group:     "v1",
+		Resource:  "pods",
+		Namespace: "default",
+	}
+
+	type fields struct {
+		data map[string]sets.String
+		all  sets.String
+	}
+	type args struct {
+		name string
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		args   args
+		want   *set
+	}{
+		{
+			name: "default",
+			fields: fields{
+				data: map[string]sets.String{
+					defaultKey.String(): {
+						"test": struct{}{},
+						"mock": struct{}{},
+					},
+					Any.String(): {
+						"test": struct{}{},
+					},
+				},
+				all: sets.String{
+					"test": struct{}{},
+					"mock": struct{}{},
+				},
+			},
+			args: args{name: "test"},
+			want: &set{
+				data: map[string]sets.String{
+					defaultKey.String(): {
+						"mock": struct{}{},
+					},
+				},
+				all: sets.String{
+					"mock": struct{}{},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &set{
+				data: tt.fields.data,
+				all:  tt.fields.all,
+			}
+			s.Del(tt.args.name)
+			if !reflect.DeepEqual(s, tt.want) {
+				t.Errorf("Del() = %v, want %v", s, tt.want)
+			}
+		})
+	}
+}
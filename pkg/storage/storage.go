@@ -0,0 +1,160 @@
+// Copyright © 2022 99nil.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/99nil/dsync"
+	dsyncstorage "github.com/99nil/dsync/storage"
+	badgerstorage "github.com/99nil/dsync/storage/badger"
+	boltstorage "github.com/99nil/dsync/storage/bolt"
+	compressstorage "github.com/99nil/dsync/storage/compress"
+	encryptstorage "github.com/99nil/dsync/storage/encrypt"
+	memorystorage "github.com/99nil/dsync/storage/memory"
+)
+
+// Config defines the dsync storage backends, only one of them can be selected.
+// Encryption encrypts and Compression compresses the values at rest in any of the backends.
+type Config struct {
+	Badger      *badgerstorage.Config   `json:"badger,omitempty"`
+	Bolt        *boltstorage.Config     `json:"bolt,omitempty"`
+	Memory      *memorystorage.Config   `json:"memory,omitempty"`
+	Encryption  *encryptstorage.Config  `json:"encryption,omitempty"`
+	Compression *compressstorage.Config `json:"compression,omitempty"`
+}
+
+func (c *Config) selected() int {
+	var count int
+	if c.Badger != nil {
+		count++
+	}
+	if c.Bolt != nil {
+		count++
+	}
+	if c.Memory != nil {
+		count++
+	}
+	return count
+}
+
+// Complete uses badger with the default path when no backend is selected.
+func (c *Config) Complete(defaultPath string) {
+	if c.selected() == 0 {
+		c.Badger = &badgerstorage.Config{Path: defaultPath}
+	}
+}
+
+func (c *Config) Validate() error {
+	if c.selected() > 1 {
+		return errors.New("only one storage backend can be selected")
+	}
+	if c.Encryption != nil && c.Encryption.KeyFile == "" && c.Encryption.KeyEnv == "" {
+		return errors.New("storage.encryption requires keyFile or keyEnv")
+	}
+	return nil
+}
+
+// New returns the storage client of the selected backend,
+// wrapped to encrypt and compress the values if they are configured.
+// The values are compressed before they are encrypted, the ciphertext can not be compressed.
+func New(cfg *Config) (dsyncstorage.Interface, error) {
+	client, err := newBackend(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Encryption != nil {
+		if client, err = encryptstorage.New(client, cfg.Encryption); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Compression != nil {
+		if client, err = compressstorage.New(client, cfg.Compression); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+func newBackend(cfg *Config) (dsyncstorage.Interface, error) {
+	switch {
+	case cfg.Memory != nil:
+		return memorystorage.New(cfg.Memory)
+	case cfg.Bolt != nil:
+		return boltstorage.New(cfg.Bolt)
+	case cfg.Badger != nil:
+		return badgerstorage.New(cfg.Badger)
+	}
+	return nil, errors.New("storage backend not found")
+}
+
+// MigrateLayout moves the keys of the instance written in the legacy layout of the badger backend,
+// it does nothing for the other backends or the migrated store.
+// The spaces of the subscriptions are only found after the spaces listing them are migrated,
+// so the spaces are listed again until nothing is left to move.
+func MigrateLayout(ctx context.Context, client dsyncstorage.Interface, ins dsync.Interface) (int, error) {
+	for {
+		wrapper, isWrapper := client.(interface{ Unwrap() dsyncstorage.Interface })
+		if !isWrapper {
+			break
+		}
+		client = wrapper.Unwrap()
+	}
+	backend, ok := client.(*badgerstorage.Client)
+	if !ok {
+		return 0, nil
+	}
+
+	var total int
+	for {
+		spaces, err := ins.Spaces(ctx)
+		if err != nil {
+			return total, err
+		}
+		moved, err := backend.MigrateLayout(ctx, spaces...)
+		total += moved
+		if err != nil || moved == 0 {
+			return total, err
+		}
+	}
+}
+
+// Reencrypt rewrites the values of the instance that are not encrypted with the primary key,
+// so that the rotated keys can be removed. It does nothing if the storage is not encrypted.
+// The values written before the encryption is enabled are only encrypted during the migration,
+// i.e. when storage.encryption.allowPlaintext is set.
+func Reencrypt(ctx context.Context, client dsyncstorage.Interface, ins dsync.Interface) (int, error) {
+	encrypted, ok := client.(*encryptstorage.Client)
+	// The encryption may be decorated by the compression.
+	for !ok {
+		wrapper, isWrapper := client.(interface{ Unwrap() dsyncstorage.Interface })
+		if !isWrapper {
+			return 0, nil
+		}
+		client = wrapper.Unwrap()
+		encrypted, ok = client.(*encryptstorage.Client)
+	}
+	spaces, err := ins.Spaces(ctx)
+	if err != nil {
+		return 0, err
+	}
+	count, err := encrypted.Reencrypt(ctx, spaces...)
+	if errors.Is(err, encryptstorage.ErrNotEncrypted) {
+		err = fmt.Errorf("%w, set storage.encryption.allowPlaintext to encrypt the existing data", err)
+	}
+	return count, err
+}
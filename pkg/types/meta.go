@@ -18,6 +18,7 @@ import (
 	"errors"
 	"strings"
 
+	"github.com/99nil/dsync/suid"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilstrings "k8s.io/utils/strings"
 )
@@ -75,3 +76,13 @@ func ParseMetaStr(s string) (*MetaKey, error) {
 		ResourceVersion:  resourceVersion,
 	}, nil
 }
+
+// MetaNameKey returns the name of the object in the custom UID regardless of the resourceVersion,
+// it is used as the dsync KeyFunc to group the versions of the same object.
+func MetaNameKey(uid suid.UID) string {
+	metaKey, err := ParseMetaStr(uid.CustomUID())
+	if err != nil {
+		return ""
+	}
+	return metaKey.NameString()
+}
@@ -18,6 +18,8 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"reflect"
 	"testing"
+
+	"github.com/99nil/dsync/suid"
 )
 
 func TestNew(t *testing.T) {
@@ -280,3 +282,34 @@ func Test_MetaKey_QualifiedName(t *testing.T) {
 		})
 	}
 }
+
+func TestMetaNameKey(t *testing.T) {
+	tests := []struct {
+		name string
+		uid  suid.UID
+		want string
+	}{
+		{
+			name: "meta",
+			uid:  suid.NewByCustom("apps/v1,deployment,default/test,10"),
+			want: "apps/v1,deployment,default/test",
+		},
+		{
+			name: "invalid",
+			uid:  suid.NewByCustom("apps/v1"),
+			want: "",
+		},
+		{
+			name: "plain",
+			uid:  suid.New(),
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MetaNameKey(tt.uid); got != tt.want {
+				t.Errorf("MetaNameKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
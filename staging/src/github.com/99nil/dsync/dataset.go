@@ -15,9 +15,14 @@
 package dsync
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/99nil/dsync/storage"
 	"github.com/99nil/dsync/suid"
@@ -31,20 +36,42 @@ var (
 type dataSet struct {
 	mux      sync.Mutex
 	manifest *suid.AssembleManifest
+
+	stateMux sync.RWMutex
 	state    suid.UID
 
+	storage          storage.Interface
+	generator        suid.Generator
+	indexer          *indexer
+	history          *history
+	tombstone        *tombstones
+	retry            RetryPolicy
+	delivery         DeliveryMode
 	defaultOperation OperateInterface
 	dataSetOperation OperateInterface
 	tmpOperation     OperateInterface
 	customOperation  OperateInterface
+	digestOperation  OperateInterface
+
+	deadLetterOperation OperateInterface
+	deliveredOperation  OperateInterface
 }
 
-func newDataSet(insName string, storage storage.Interface) *dataSet {
-	ds := new(dataSet)
+func newDataSet(insName string, storage storage.Interface, generator suid.Generator, indexers Indexers) *dataSet {
+	ds := &dataSet{
+		storage:   storage,
+		generator: generator,
+		indexer:   newIndexer(insName, storage, nil, indexers),
+		history:   newHistory(insName, storage, nil, 0),
+		tombstone: newTombstones(insName, storage, nil),
+	}
 	ds.defaultOperation = newSpaceOperation(buildName(spaceStatePrefix, insName), storage)
 	ds.dataSetOperation = newSpaceOperation(buildName(spaceDatasetPrefix, insName), storage)
 	ds.tmpOperation = newSpaceOperation(buildName(spaceTmpPrefix, insName), storage)
 	ds.customOperation = newSpaceOperation(buildName(spaceRelatePrefix, insName), storage)
+	ds.digestOperation = newSpaceOperation(buildName(spaceDigestPrefix, insName), storage)
+	ds.deadLetterOperation = newSpaceOperation(buildName(spaceDeadLetterPrefix, insName), storage)
+	ds.deliveredOperation = newSpaceOperation(buildName(spaceDeliveredPrefix, insName), storage)
 	return ds
 }
 
@@ -72,20 +99,52 @@ func (ds *dataSet) SetState(ctx context.Context, uid suid.UID) error {
 	if err := ds.defaultOperation.Add(ctx, keyState, []byte(uid.String())); err != nil {
 		return err
 	}
+	ds.stateMux.Lock()
 	ds.state = uid
+	ds.stateMux.Unlock()
 	return nil
 }
 
+// advanceState updates the cached state after the transaction committed,
+// the cache only moves forward when concurrent transactions finish out of order.
+func (ds *dataSet) advanceState(uid suid.UID) {
+	if uid == nil {
+		return
+	}
+	ds.stateMux.Lock()
+	defer ds.stateMux.Unlock()
+	if suid.CompareKSUID(ds.state.KSUID(), uid.KSUID()) < 0 {
+		ds.state = uid
+	}
+}
+
+// reset drops the cached state and manifest after the storage is cleared.
+func (ds *dataSet) reset() {
+	ds.stateMux.Lock()
+	ds.state = nil
+	ds.stateMux.Unlock()
+	ds.mux.Lock()
+	ds.manifest = nil
+	ds.mux.Unlock()
+}
+
 func (ds *dataSet) State(ctx context.Context) suid.UID {
-	if !ds.state.IsNil() {
-		return ds.state
+	ds.stateMux.RLock()
+	state := ds.state
+	ds.stateMux.RUnlock()
+	if !state.IsNil() {
+		return state
 	}
 
 	value, err := ds.defaultOperation.Get(ctx, keyState)
-	if err != nil {
-		return ds.state
+	if err != nil || value == nil {
+		return state
+	}
+	ds.stateMux.Lock()
+	defer ds.stateMux.Unlock()
+	if ds.state.IsNil() {
+		ds.state = value
 	}
-	ds.state = value
 	return ds.state
 }
 
@@ -96,48 +155,102 @@ func (ds *dataSet) Get(ctx context.Context, uid suid.UID) (*Item, error) {
 	}
 	uid = uids[0]
 
-	value, err := ds.dataSetOperation.Get(ctx, uid.KSUID().String())
+	id := uid.KSUID().String()
+	value, err := ds.dataSetOperation.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := ds.digestOperation.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	tombstone, err := ds.tombstone.is(ctx, ds.tombstone.tombstoneOperation, uid)
 	if err != nil {
 		return nil, err
 	}
 	return &Item{
-		UID:   uid,
-		Value: value,
+		UID:       uid,
+		Value:     value,
+		Digest:    digest,
+		Tombstone: tombstone,
 	}, nil
 }
 
-func (ds *dataSet) Add(ctx context.Context, items ...Item) error {
-	if len(items) == 0 {
-		return nil
+// add writes the item into the dataset in the transaction,
+// and returns the UID assigned to the item, and the UID again when it becomes the latest state.
+func (ds *dataSet) add(ctx context.Context, txn storage.Txn, item Item) (suid.UID, suid.UID, error) {
+	stateOperation := ds.defaultOperation.WithTxn(txn)
+	state, err := stateOperation.Get(ctx, keyState)
+	if err != nil {
+		return nil, nil, err
+	}
+	current := suid.UID(state).KSUID()
+	// The state is the greatest KSUID in the dataset, even if it was generated before restarting,
+	// the newly generated KSUID will be greater than it.
+	ds.generator.Observe(current)
+
+	itemCurrent := item.UID.KSUID()
+	isCustom := item.UID.IsCustom()
+	if isCustom && itemCurrent.IsNil() {
+		itemCurrent = ds.generator.Next()
+	} else {
+		ds.generator.Observe(itemCurrent)
 	}
+	uid := suid.NewWithCustom(itemCurrent, item.UID.CustomUID())
+	if err := item.Verify(); err != nil {
+		return nil, nil, err
+	}
+	digest := Digest(item.Value)
 
-	state := ds.State(ctx)
-	current := state.KSUID()
-	for _, item := range items {
-		itemCurrent := item.UID.KSUID()
-		isCustom := item.UID.IsCustom()
-		if isCustom && itemCurrent.IsNil() {
-			itemCurrent = suid.NewKSUID()
-		}
-		// When adding data in batches, the order may not be guaranteed,
-		// so perform the addition first, and then determine the latest state.
-		if err := ds.dataSetOperation.Add(ctx, itemCurrent.String(), item.Value); err != nil {
-			return err
+	if err := ds.dataSetOperation.WithTxn(txn).Add(ctx, itemCurrent.String(), item.Value); err != nil {
+		return nil, nil, err
+	}
+	if err := ds.digestOperation.WithTxn(txn).Add(ctx, itemCurrent.String(), digest); err != nil {
+		return nil, nil, err
+	}
+	if isCustom {
+		if err := ds.customOperation.WithTxn(txn).Add(ctx, item.UID.CustomUID(), []byte(itemCurrent.String())); err != nil {
+			return nil, nil, err
 		}
-		if isCustom {
-			// Add data first, if the association relationship fails,
-			// the orphaned data will be recovered by the GC soon
-			if err := ds.customOperation.Add(ctx, item.UID.CustomUID(), []byte(itemCurrent.String())); err != nil {
+	}
+	if err := ds.indexer.update(ctx, txn, Item{UID: uid, Value: item.Value, Digest: digest, Tombstone: item.Tombstone}); err != nil {
+		return nil, nil, err
+	}
+	if err := ds.tombstone.update(ctx, txn, Item{UID: uid, Tombstone: item.Tombstone}, false); err != nil {
+		return nil, nil, err
+	}
+	if err := ds.history.record(ctx, txn, Item{UID: uid, Value: item.Value, Digest: digest, Tombstone: item.Tombstone}); err != nil {
+		return nil, nil, err
+	}
+
+	// When adding data in batches, the order may not be guaranteed,
+	// so perform the addition first, and then determine the latest state.
+	if suid.CompareKSUID(current, itemCurrent) > -1 {
+		return uid, nil, nil
+	}
+	if err := stateOperation.Add(ctx, keyState, uid); err != nil {
+		return nil, nil, err
+	}
+	return uid, uid, nil
+}
+
+func (ds *dataSet) Add(ctx context.Context, items ...Item) error {
+	for _, item := range items {
+		// The data, the association relationship and the state of an item are committed together,
+		// so that there is no orphaned data or a state pointing at missing data.
+		var state suid.UID
+		err := ds.storage.Update(ctx, func(txn storage.Txn) error {
+			if err := ds.ensureEpoch(ctx, txn); err != nil {
 				return err
 			}
-		}
-
-		if suid.CompareKSUID(current, itemCurrent) > -1 {
-			continue
-		}
-		if err := ds.SetState(ctx, item.UID); err != nil {
+			var err error
+			_, state, err = ds.add(ctx, txn, item)
+			return err
+		})
+		if err != nil {
 			return err
 		}
+		ds.advanceState(state)
 	}
 	return nil
 }
@@ -152,12 +265,24 @@ func (ds *dataSet) Del(ctx context.Context, uids ...suid.UID) error {
 	}
 
 	for _, uid := range uids {
-		if uid.IsCustom() {
-			if err := ds.customOperation.Del(ctx, uid.CustomUID()); err != nil {
+		err := ds.storage.Update(ctx, func(txn storage.Txn) error {
+			if uid.IsCustom() {
+				if err := ds.customOperation.WithTxn(txn).Del(ctx, uid.CustomUID()); err != nil {
+					return err
+				}
+			}
+			if err := ds.indexer.remove(ctx, txn, uid); err != nil {
 				return err
 			}
-		}
-		if err := ds.dataSetOperation.Del(ctx, uid.KSUID().String()); err != nil {
+			if err := ds.tombstone.remove(ctx, txn, uid); err != nil {
+				return err
+			}
+			if err := ds.digestOperation.WithTxn(txn).Del(ctx, uid.KSUID().String()); err != nil {
+				return err
+			}
+			return ds.dataSetOperation.WithTxn(txn).Del(ctx, uid.KSUID().String())
+		})
+		if err != nil {
 			return err
 		}
 	}
@@ -166,26 +291,147 @@ func (ds *dataSet) Del(ctx context.Context, uids ...suid.UID) error {
 
 func (ds *dataSet) Range(ctx context.Context, fn func(item *Item) error) error {
 	return ds.dataSetOperation.Range(ctx, func(key, value []byte) error {
-		ksuid, err := suid.ParseKSUIDFromBytes(value)
+		ksuid, err := suid.ParseKSUID(string(key))
+		if err != nil {
+			return err
+		}
+		digest, err := ds.digestOperation.Get(ctx, ksuid.String())
 		if err != nil {
 			return err
 		}
 		uid := suid.NewWithCustom(ksuid, "")
-		return fn(&Item{UID: uid, Value: value})
+		return fn(&Item{UID: uid, Value: value, Digest: digest})
 	})
 }
 
 func (ds *dataSet) RangeCustom(ctx context.Context, fn func(uid suid.UID) error) error {
 	return ds.customOperation.Range(ctx, func(key, value []byte) error {
-		ksuid, err := suid.ParseKSUIDFromBytes(value)
+		ksuid, err := suid.ParseKSUID(string(value))
 		if err != nil {
 			return err
 		}
-		uid := suid.NewWithCustom(ksuid, string(value))
+		uid := suid.NewWithCustom(ksuid, string(key))
 		return fn(uid)
 	})
 }
 
+func (ds *dataSet) RangePrefix(ctx context.Context, prefix string, fn func(item *Item) error) error {
+	return ds.rangePrefix(ctx, prefix, "", fn)
+}
+
+func (ds *dataSet) ListPrefix(ctx context.Context, prefix, start string, limit int) ([]Item, string, error) {
+	var (
+		items []Item
+		next  string
+	)
+	err := ds.rangePrefix(ctx, prefix, start, func(item *Item) error {
+		if limit > 0 && len(items) == limit {
+			next = item.UID.CustomUID()
+			return errStopRange
+		}
+		items = append(items, *item)
+		return nil
+	})
+	if err != nil && err != errStopRange {
+		return nil, "", err
+	}
+	return items, next, nil
+}
+
+func (ds *dataSet) ByIndex(ctx context.Context, name, value string) ([]Item, error) {
+	uids, err := ds.indexer.uids(ctx, name, value)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]Item, 0, len(uids))
+	for _, uid := range uids {
+		data, err := ds.dataSetOperation.Get(ctx, uid.KSUID().String())
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, Item{UID: uid, Value: data})
+	}
+	return items, nil
+}
+
+func (ds *dataSet) History(ctx context.Context, key string) ([]Item, error) {
+	return ds.history.list(ctx, ds.history.historyOperation, key)
+}
+
+func (ds *dataSet) Revert(ctx context.Context, key string, uid suid.UID, callback ItemCallbackFunc) error {
+	// Reverting is serialized with synchronization, so that it is not overwritten halfway.
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+
+	var item *Item
+	err := ds.storage.Update(ctx, func(txn storage.Txn) error {
+		var err error
+		item, err = ds.history.get(ctx, ds.history.historyOperation.WithTxn(txn), key, uid)
+		if err != nil {
+			return err
+		}
+		if err := item.Verify(); err != nil {
+			return err
+		}
+
+		// The state is not changed, the newer version synchronized later still takes effect.
+		id := item.UID.KSUID().String()
+		if err := ds.dataSetOperation.WithTxn(txn).Add(ctx, id, item.Value); err != nil {
+			return err
+		}
+		if len(item.Digest) > 0 {
+			if err := ds.digestOperation.WithTxn(txn).Add(ctx, id, item.Digest); err != nil {
+				return err
+			}
+		}
+		if err := ds.customOperation.WithTxn(txn).Add(ctx, item.UID.CustomUID(), []byte(id)); err != nil {
+			return err
+		}
+		if err := ds.tombstone.update(ctx, txn, *item, true); err != nil {
+			return err
+		}
+		return ds.indexer.update(ctx, txn, *item)
+	})
+	if err != nil {
+		return err
+	}
+	if callback == nil {
+		return nil
+	}
+	return callback(ctx, *item)
+}
+
+// errStopRange stops the iteration without error
+var errStopRange = errors.New("stop range")
+
+func (ds *dataSet) rangePrefix(ctx context.Context, prefix, start string, fn func(item *Item) error) error {
+	return ds.customOperation.RangePrefix(ctx, prefix, start, func(key, value []byte) error {
+		ksuid, err := suid.ParseKSUID(string(value))
+		if err != nil {
+			return err
+		}
+		data, err := ds.dataSetOperation.Get(ctx, ksuid.String())
+		if err != nil {
+			return err
+		}
+		digest, err := ds.digestOperation.Get(ctx, ksuid.String())
+		if err != nil {
+			return err
+		}
+		uid := suid.NewWithCustom(ksuid, string(key))
+		tombstone, err := ds.tombstone.is(ctx, ds.tombstone.tombstoneOperation, uid)
+		if err != nil {
+			return err
+		}
+		return fn(&Item{
+			UID:       uid,
+			Value:     data,
+			Digest:    digest,
+			Tombstone: tombstone,
+		})
+	})
+}
+
 func (ds *dataSet) SyncManifest(ctx context.Context, manifest *suid.AssembleManifest) {
 	if manifest == nil {
 		return
@@ -195,16 +441,10 @@ func (ds *dataSet) SyncManifest(ctx context.Context, manifest *suid.AssembleMani
 
 	state := ds.State(ctx)
 	if !state.IsNil() {
-		var (
-			set    []suid.UID
-			exists bool
-		)
+		var set []suid.UID
 		current := state.KSUID()
-		for iter := manifest.Iter(); iter.Next(); {
-			if iter.KSUID == current {
-				exists = true
-			}
-			if exists {
+		if manifest.Contains(current) {
+			for iter := manifest.IterFrom(current); iter.Next(); {
 				set = append(set, manifest.GetUID(iter.KSUID))
 			}
 		}
@@ -214,6 +454,20 @@ func (ds *dataSet) SyncManifest(ctx context.Context, manifest *suid.AssembleMani
 	ds.manifest = manifest
 }
 
+// deleteSynced deletes the value of the synchronized item in the transaction,
+// the value of the indexed item is kept, so that ByIndex still returns it.
+func (ds *dataSet) deleteSynced(ctx context.Context, txn storage.Txn, uid suid.UID) error {
+	indexed, err := ds.indexer.isIndexed(ctx, txn, uid)
+	if err != nil || indexed {
+		return err
+	}
+	id := uid.KSUID().String()
+	if err := ds.digestOperation.WithTxn(txn).Del(ctx, id); err != nil {
+		return err
+	}
+	return ds.dataSetOperation.WithTxn(txn).Del(ctx, id)
+}
+
 func (ds *dataSet) Sync(ctx context.Context, items []Item, callback ItemCallbackFunc) error {
 	return ds.sync(ctx, items, callback, false)
 }
@@ -222,22 +476,65 @@ func (ds *dataSet) SyncAndDelete(ctx context.Context, items []Item, callback Ite
 	return ds.sync(ctx, items, callback, true)
 }
 
+// tmpMagic prefixes the values in the tmp space that carry the time they were written,
+// the values written without it are aged by the timestamp of the KSUID.
+var tmpMagic = []byte("\xffdsync-tmp")
+
+func encodeTmp(value []byte, written time.Time) []byte {
+	b := make([]byte, len(tmpMagic)+8, len(tmpMagic)+8+len(value))
+	copy(b, tmpMagic)
+	binary.BigEndian.PutUint64(b[len(tmpMagic):], uint64(written.UnixNano()))
+	return append(b, value...)
+}
+
+// decodeTmp returns the time the value in the tmp space was written and the value itself.
+func decodeTmp(id suid.KSUID, b []byte) (time.Time, []byte) {
+	if !bytes.HasPrefix(b, tmpMagic) || len(b) < len(tmpMagic)+8 {
+		return id.Time(), b
+	}
+	written := time.Unix(0, int64(binary.BigEndian.Uint64(b[len(tmpMagic):])))
+	value := b[len(tmpMagic)+8:]
+	if len(value) == 0 {
+		value = nil
+	}
+	return written, value
+}
+
 func (ds *dataSet) sync(ctx context.Context, items []Item, callback ItemCallbackFunc, needDelete bool) error {
 	if len(items) == 0 {
 		return nil
 	}
+	// The items are verified before any of them is stored, so that a corrupted batch leaves nothing behind.
+	if err := DecompressItems(items); err != nil {
+		return err
+	}
+	if err := VerifyItems(items); err != nil {
+		return err
+	}
+	// In order to ensure the consistency of the manifest, it needs to be locked before this,
+	// the GC does not sweep the tmp space while it is locked.
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+
 	state := ds.State(ctx)
 	current := state.KSUID()
 
 	var count int
 	// Store items in tmp space first,
 	// and use items in subsequent synchronization to prevent the sequence of data from affecting synchronization.
+	now := time.Now()
 	for _, item := range items {
 		isExpire := suid.CompareKSUID(current, item.UID.KSUID())
 		if isExpire > -1 {
 			continue
 		}
-		if err := ds.tmpOperation.Add(ctx, item.UID.KSUID().String(), item.Value); err != nil {
+		if item.Tombstone {
+			// The tmp space only keeps the value, the tombstone is marked aside.
+			if err := ds.tombstone.pendingOperation.Add(ctx, item.UID.KSUID().String(), item.UID); err != nil {
+				return err
+			}
+		}
+		if err := ds.tmpOperation.Add(ctx, item.UID.KSUID().String(), encodeTmp(item.Value, now)); err != nil {
 			return err
 		}
 		count++
@@ -246,11 +543,6 @@ func (ds *dataSet) sync(ctx context.Context, items []Item, callback ItemCallback
 		return nil
 	}
 
-	// In order to ensure the consistency of the manifest,
-	// it needs to be locked before this.
-	ds.mux.Lock()
-	defer ds.mux.Unlock()
-
 	var match bool
 	for iter := ds.manifest.Iter(); iter.Next(); {
 		uid := iter.KSUID
@@ -277,29 +569,345 @@ func (ds *dataSet) sync(ctx context.Context, items []Item, callback ItemCallback
 		if value == nil {
 			return ErrDataNotMatch
 		}
+		_, value = decodeTmp(uid, value)
 
+		tombstone, err := ds.tombstone.pendingOperation.Get(ctx, uidStr)
+		if err != nil {
+			return err
+		}
 		item := Item{
-			UID:   ds.manifest.GetUID(uid),
-			Value: value,
+			UID:       ds.manifest.GetUID(uid),
+			Value:     value,
+			Tombstone: tombstone != nil,
+		}
+		// The state is checkpointed after the item is delivered,
+		// if the delivery fails, the item is delivered again in the next synchronization.
+		if ds.delivery == DeliveryCheckpoint {
+			if err := ds.deliver(ctx, item, callback); err != nil {
+				return err
+			}
 		}
-		if err := ds.Add(ctx, item); err != nil {
+
+		// Adding the item and removing it from the tmp space are committed together,
+		// the item is either fully synchronized or not at all.
+		var newState suid.UID
+		err = ds.storage.Update(ctx, func(txn storage.Txn) error {
+			uid, state, err := ds.add(ctx, txn, item)
+			if err != nil {
+				return err
+			}
+			newState = state
+			if err := ds.tmpOperation.WithTxn(txn).Del(ctx, uidStr); err != nil {
+				return err
+			}
+			if err := ds.tombstone.pendingOperation.WithTxn(txn).Del(ctx, uidStr); err != nil {
+				return err
+			}
+			if err := ds.deliveredOperation.WithTxn(txn).Del(ctx, uidStr); err != nil {
+				return err
+			}
+			if needDelete {
+				return ds.deleteSynced(ctx, txn, uid)
+			}
+			return nil
+		})
+		if err != nil {
 			return err
 		}
-		if callback != nil {
-			if err := callback(ctx, item); err != nil {
+		ds.advanceState(newState)
+
+		if ds.delivery == DeliveryAfterCommit {
+			if err := ds.call(ctx, item, callback); err != nil {
 				return err
 			}
 		}
+	}
+	return nil
+}
+
+func (ds *dataSet) InstallSnapshot(ctx context.Context, snapshot *Snapshot, callback ItemCallbackFunc) error {
+	return ds.installSnapshot(ctx, snapshot, callback, false)
+}
+
+func (ds *dataSet) InstallSnapshotAndDelete(ctx context.Context, snapshot *Snapshot, callback ItemCallbackFunc) error {
+	return ds.installSnapshot(ctx, snapshot, callback, true)
+}
+
+// snapshotBatchSize is the number of keys written or deleted in each transaction of the snapshot installation,
+// so that a large snapshot never exceeds the transaction limit of the storage.
+const snapshotBatchSize = 100
+
+// installing is the progress of the snapshot being installed, it is kept until the installation completes.
+// The installation interrupted halfway is resumed after the last installed item if the same snapshot is installed again.
+type installing struct {
+	State     suid.UID
+	Epoch     string
+	Installed string `json:",omitempty"`
+}
+
+func (ds *dataSet) installSnapshot(ctx context.Context, snapshot *Snapshot, callback ItemCallbackFunc, needDelete bool) error {
+	if snapshot == nil {
+		return nil
+	}
+	if err := DecompressItems(snapshot.Items); err != nil {
+		return err
+	}
+	if err := VerifyItems(snapshot.Items); err != nil {
+		return err
+	}
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
 
-		// Try to delete the synchronized data in the tmp space.
-		// If the deletion fails, no verification is required,
-		// and it can be reclaimed by the GC later.
-		_ = ds.tmpOperation.Del(ctx, uidStr)
-		if needDelete {
-			if err := ds.dataSetOperation.Del(ctx, uidStr); err != nil {
+	items := append([]Item(nil), snapshot.Items...)
+	sort.Slice(items, func(i, j int) bool {
+		return suid.CompareKSUID(items[i].UID.KSUID(), items[j].UID.KSUID()) < 0
+	})
+	progress, resumed, err := ds.installing(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+	deleted, err := ds.deletedItems(ctx, items)
+	if err != nil {
+		return err
+	}
+	delivered := append(deleted, items...)
+
+	// The snapshot is installed after all items are delivered,
+	// if any delivery fails, the items not delivered yet are delivered in the next bootstrap.
+	// The resumed installation has delivered them before it started.
+	if ds.delivery == DeliveryCheckpoint && !resumed {
+		for _, item := range delivered {
+			if err := ds.deliver(ctx, item, callback); err != nil {
 				return err
 			}
 		}
 	}
+
+	if !resumed {
+		if err := ds.beginInstall(ctx, progress); err != nil {
+			return err
+		}
+	}
+	if progress.Installed != "" {
+		installed, err := suid.ParseKSUID(progress.Installed)
+		if err != nil {
+			return err
+		}
+		n := sort.Search(len(items), func(i int) bool {
+			return suid.CompareKSUID(items[i].UID.KSUID(), installed) > 0
+		})
+		items = items[n:]
+	}
+	for len(items) > 0 {
+		n := snapshotBatchSize
+		if n > len(items) {
+			n = len(items)
+		}
+		batch := items[:n]
+		progress.Installed = batch[n-1].UID.KSUID().String()
+		err := ds.storage.Update(ctx, func(txn storage.Txn) error {
+			for _, item := range batch {
+				if err := ds.installItem(ctx, txn, item, needDelete); err != nil {
+					return err
+				}
+			}
+			return ds.defaultOperation.WithTxn(txn).AddData(ctx, keyInstalling, progress)
+		})
+		if err != nil {
+			return err
+		}
+		items = items[n:]
+	}
+
+	err = ds.storage.Update(ctx, func(txn storage.Txn) error {
+		stateOperation := ds.defaultOperation.WithTxn(txn)
+		if err := setEpoch(ctx, stateOperation, snapshot.Epoch); err != nil {
+			return err
+		}
+		if err := stateOperation.Del(ctx, keyInstalling); err != nil {
+			return err
+		}
+		if snapshot.State.IsNil() {
+			return stateOperation.Del(ctx, keyState)
+		}
+		return stateOperation.Add(ctx, keyState, snapshot.State)
+	})
+	if err != nil {
+		return err
+	}
+
+	ds.stateMux.Lock()
+	ds.state = snapshot.State
+	ds.stateMux.Unlock()
+	ds.generator.Observe(snapshot.State.KSUID())
+	// The manifest before the snapshot is obsolete.
+	ds.manifest = nil
+
+	if ds.delivery == DeliveryCheckpoint {
+		// The records of the deliveries are only needed until the snapshot is installed.
+		return ds.clearOperation(ctx, ds.deliveredOperation)
+	}
+	for _, item := range delivered {
+		if err := ds.call(ctx, item, callback); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installing returns the progress of the installation of the snapshot,
+// and whether it resumes the interrupted installation of the same snapshot.
+func (ds *dataSet) installing(ctx context.Context, snapshot *Snapshot) (*installing, bool, error) {
+	progress := &installing{State: snapshot.State, Epoch: snapshot.Epoch}
+	value, err := ds.defaultOperation.Get(ctx, keyInstalling)
+	if err != nil || len(value) == 0 {
+		return progress, false, err
+	}
+	var current installing
+	if err := json.Unmarshal(value, &current); err != nil {
+		return nil, false, err
+	}
+	if current.State.String() != snapshot.State.String() || current.Epoch != snapshot.Epoch {
+		return progress, false, nil
+	}
+	return &current, true, nil
+}
+
+// beginInstall records the installation and removes the state, then clears the data in batches.
+// The dataset without state is bootstrapped again, so the interrupted installation is never taken as synchronized.
+func (ds *dataSet) beginInstall(ctx context.Context, progress *installing) error {
+	err := ds.storage.Update(ctx, func(txn storage.Txn) error {
+		stateOperation := ds.defaultOperation.WithTxn(txn)
+		if err := stateOperation.AddData(ctx, keyInstalling, progress); err != nil {
+			return err
+		}
+		return stateOperation.Del(ctx, keyState)
+	})
+	if err != nil {
+		return err
+	}
+	ds.stateMux.Lock()
+	ds.state = nil
+	ds.stateMux.Unlock()
+
+	spaces := []OperateInterface{
+		ds.dataSetOperation,
+		ds.customOperation,
+		ds.digestOperation,
+		ds.tmpOperation,
+		ds.indexer.indexOperation,
+		ds.indexer.indexedOperation,
+		ds.tombstone.tombstoneOperation,
+		ds.tombstone.pendingOperation,
+	}
+	for _, op := range spaces {
+		if err := ds.clearOperation(ctx, op); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// installItem writes the snapshot item in the transaction.
+func (ds *dataSet) installItem(ctx context.Context, txn storage.Txn, item Item, needDelete bool) error {
+	id := item.UID.KSUID().String()
+	if err := ds.indexer.update(ctx, txn, item); err != nil {
+		return err
+	}
+	// The value of the indexed item is kept, so that ByIndex still returns it.
+	indexed, err := ds.indexer.isIndexed(ctx, txn, item.UID)
+	if err != nil {
+		return err
+	}
+	if !needDelete || indexed {
+		if err := ds.dataSetOperation.WithTxn(txn).Add(ctx, id, item.Value); err != nil {
+			return err
+		}
+		if err := ds.digestOperation.WithTxn(txn).Add(ctx, id, Digest(item.Value)); err != nil {
+			return err
+		}
+	}
+	if custom := item.UID.CustomUID(); custom != "" {
+		if err := ds.customOperation.WithTxn(txn).Add(ctx, custom, []byte(id)); err != nil {
+			return err
+		}
+	}
+	if err := ds.tombstone.update(ctx, txn, item, false); err != nil {
+		return err
+	}
+	return ds.history.record(ctx, txn, item)
+}
+
+// deletedItems returns the tombstones of the latest local items whose logical keys are missing from the snapshot items,
+// they have been deleted while the dataset was behind. The tombstones have no value.
+func (ds *dataSet) deletedItems(ctx context.Context, items []Item) ([]Item, error) {
+	keys := make(map[string]struct{}, len(items))
+	for _, item := range items {
+		keys[logicalKey(ds.tombstone.keyFunc, item.UID)] = struct{}{}
+	}
+	latest := make(map[string]suid.UID)
+	err := ds.customOperation.Range(ctx, func(key, value []byte) error {
+		id, err := suid.ParseKSUID(string(value))
+		if err != nil {
+			return err
+		}
+		uid := suid.NewWithCustom(id, string(key))
+		k := logicalKey(ds.tombstone.keyFunc, uid)
+		if _, ok := keys[k]; ok {
+			return nil
+		}
+		if current, ok := latest[k]; !ok || suid.CompareKSUID(current.KSUID(), id) < 0 {
+			latest[k] = uid
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := make([]Item, 0, len(latest))
+	for _, uid := range latest {
+		// The key deleted before has been delivered as the tombstone.
+		tombstone, err := ds.tombstone.is(ctx, ds.tombstone.tombstoneOperation, uid)
+		if err != nil {
+			return nil, err
+		}
+		if !tombstone {
+			deleted = append(deleted, Item{UID: uid, Tombstone: true})
+		}
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		return suid.CompareKSUID(deleted[i].UID.KSUID(), deleted[j].UID.KSUID()) < 0
+	})
+	return deleted, nil
+}
+
+// clearOperation deletes all keys in the space of the operation in batches of snapshotBatchSize.
+func (ds *dataSet) clearOperation(ctx context.Context, op OperateInterface) error {
+	for {
+		var keys []string
+		err := ds.storage.Update(ctx, func(txn storage.Txn) error {
+			keys = keys[:0]
+			txnOperation := op.WithTxn(txn)
+			err := txnOperation.Range(ctx, func(key, _ []byte) error {
+				keys = append(keys, string(key))
+				if len(keys) == snapshotBatchSize {
+					return errStopRange
+				}
+				return nil
+			})
+			if err != nil && err != errStopRange {
+				return err
+			}
+			for _, key := range keys {
+				if err := txnOperation.Del(ctx, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || len(keys) < snapshotBatchSize {
+			return err
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/storage/memory"
+	"github.com/99nil/dsync/suid"
+)
+
+var errInjected = errors.New("injected failure")
+
+// faultyStorage fails the writes to the space in transactions
+type faultyStorage struct {
+	storage.Interface
+	space string
+}
+
+func (s *faultyStorage) Update(ctx context.Context, fn func(txn storage.Txn) error) error {
+	return s.Interface.Update(ctx, func(txn storage.Txn) error {
+		return fn(&faultyTxn{Txn: txn, space: s.space})
+	})
+}
+
+type faultyTxn struct {
+	storage.Txn
+	space string
+}
+
+func (t *faultyTxn) Add(ctx context.Context, space, key string, value []byte) error {
+	if space == t.space {
+		return errInjected
+	}
+	return t.Txn.Add(ctx, space, key, value)
+}
+
+func newTestStorage(t testing.TB) storage.Interface {
+	client, err := memory.New(&memory.Config{})
+	if err != nil {
+		t.Fatalf("memory.New() error = %v", err)
+	}
+	return client
+}
+
+func countSpace(t *testing.T, s storage.Interface, space string) int {
+	var count int
+	err := s.Range(context.Background(), space, func(_, _ []byte) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Range(%s) error = %v", space, err)
+	}
+	return count
+}
+
+func TestDataSet_AddAtomic(t *testing.T) {
+	ctx := context.Background()
+	base := newTestStorage(t)
+	ds := newDataSet("", &faultyStorage{Interface: base, space: buildName(spaceRelatePrefix)}, suid.NewMonotonicGenerator(), nil)
+
+	err := ds.Add(ctx, Item{UID: suid.NewByCustom("custom"), Value: []byte("value")})
+	if err != errInjected {
+		t.Fatalf("Add() error = %v, want %v", err, errInjected)
+	}
+	if n := countSpace(t, base, buildName(spaceDatasetPrefix)); n != 0 {
+		t.Errorf("dataset has %d orphaned values, want 0", n)
+	}
+	if state := ds.State(ctx); !state.IsNil() {
+		t.Errorf("State() = %s, want nil", state)
+	}
+}
+
+func TestDataSet_AddState(t *testing.T) {
+	ctx := context.Background()
+	ds := newDataSet("", newTestStorage(t), suid.NewMonotonicGenerator(), nil)
+
+	older := suid.New()
+	newer := suid.NewWithCustom(older.KSUID().Next(), "custom")
+	if err := ds.Add(ctx, Item{UID: newer, Value: []byte("newer")}, Item{UID: older, Value: []byte("older")}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if state := ds.State(ctx); state.String() != newer.String() {
+		t.Errorf("State() = %s, want %s", state, newer)
+	}
+
+	item, err := ds.Get(ctx, suid.NewByCustom("custom"))
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(item.Value) != "newer" || item.UID.String() != newer.String() {
+		t.Errorf("Get() = %s/%q, want %s/%q", item.UID, item.Value, newer, "newer")
+	}
+}
+
+func TestDataSet_AddMonotonic(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+
+	// The previous process ran with a clock ahead of the current one.
+	generator := suid.NewMonotonicGenerator()
+	generator.Observe(newFutureKSUID(t))
+	previous := newDataSet("", s, generator, nil)
+	for i := 0; i < 3; i++ {
+		if err := previous.Add(ctx, Item{UID: suid.NewByCustom("custom"), Value: []byte("previous")}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	last := previous.State(ctx)
+
+	ds := newDataSet("", s, suid.NewMonotonicGenerator(), nil)
+	if err := ds.Add(ctx, Item{UID: suid.NewByCustom("custom"), Value: []byte("current")}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	state := ds.State(ctx)
+	if suid.CompareKSUID(last.KSUID(), state.KSUID()) >= 0 {
+		t.Fatalf("State() = %s, not greater than the previous %s", state, last)
+	}
+	item, err := ds.Get(ctx, suid.NewByCustom("custom"))
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if string(item.Value) != "current" {
+		t.Errorf("Get() = %q, the newer item was dropped", item.Value)
+	}
+}
+
+func TestDataSet_RangePrefix(t *testing.T) {
+	ctx := context.Background()
+	ds := newDataSet("", newTestStorage(t), suid.NewMonotonicGenerator(), nil)
+
+	customs := []string{
+		"apps/v1,Deployment,kube-system/coredns",
+		"apps/v1,Deployment,default/b",
+		"apps/v1,Deployment,default/a",
+		"apps/v1,DaemonSet,default/a",
+		"v1,Pod,default/a",
+	}
+	for _, custom := range customs {
+		if err := ds.Add(ctx, Item{UID: suid.NewByCustom(custom), Value: []byte(custom)}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+
+	var got []string
+	err := ds.RangePrefix(ctx, "apps/v1,Deployment,default/", func(item *Item) error {
+		if string(item.Value) != item.UID.CustomUID() {
+			t.Errorf("RangePrefix() item %s has value %q", item.UID, item.Value)
+		}
+		got = append(got, item.UID.CustomUID())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RangePrefix() error = %v", err)
+	}
+	if want := []string{"apps/v1,Deployment,default/a", "apps/v1,Deployment,default/b"}; !equalStrings(got, want) {
+		t.Errorf("RangePrefix() = %v, want %v", got, want)
+	}
+
+	// List the Deployments page by page.
+	got = got[:0]
+	var start string
+	for page := 0; ; page++ {
+		items, next, err := ds.ListPrefix(ctx, "apps/v1,Deployment,", start, 2)
+		if err != nil {
+			t.Fatalf("ListPrefix() error = %v", err)
+		}
+		if len(items) > 2 {
+			t.Fatalf("ListPrefix() returned %d items, want at most 2", len(items))
+		}
+		for _, item := range items {
+			got = append(got, item.UID.CustomUID())
+		}
+		if next == "" {
+			if page != 1 {
+				t.Errorf("ListPrefix() ended at page %d, want 1", page)
+			}
+			break
+		}
+		start = next
+	}
+	want := []string{
+		"apps/v1,Deployment,default/a",
+		"apps/v1,Deployment,default/b",
+		"apps/v1,Deployment,kube-system/coredns",
+	}
+	if !equalStrings(got, want) {
+		t.Errorf("ListPrefix() = %v, want %v", got, want)
+	}
+}
+
+func TestDataSet_Range(t *testing.T) {
+	ctx := context.Background()
+	ds := newDataSet("", newTestStorage(t), suid.NewMonotonicGenerator(), nil)
+
+	uid := suid.New()
+	if err := ds.Add(ctx, Item{UID: uid, Value: []byte("value")}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	var got []Item
+	err := ds.Range(ctx, func(item *Item) error {
+		got = append(got, *item)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Range() error = %v", err)
+	}
+	if len(got) != 1 || got[0].UID.String() != uid.String() || string(got[0].Value) != "value" {
+		t.Errorf("Range() = %v, want %s/%q", got, uid, "value")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
+)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// RetryPolicy defines how the failed callbacks of the synchronized items are retried.
+// The item is parked in the dead-letter space after MaxAttempts attempts,
+// so that the synchronization continues with the next items.
+// A MaxAttempts less than 1 disables the policy, and the failed callback stops the synchronization.
+type RetryPolicy struct {
+	MaxAttempts int
+
+	// Backoff is the wait before the second attempt, it doubles after each attempt up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func (p RetryPolicy) enabled() bool {
+	return p.MaxAttempts > 0
+}
+
+// backoff returns the wait before the next attempt after the given number of attempts
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < attempts && wait > 0; i++ {
+		wait *= 2
+		if p.MaxBackoff > 0 && wait >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+// DeadLetter defines the item whose callback kept failing
+type DeadLetter struct {
+	Item     Item
+	Attempts int
+	Error    string
+	Time     time.Time
+}
+
+// call calls the callback with the item according to the retry policy.
+// When all attempts fail, the item is parked in the dead-letter space and nil is returned.
+func (ds *dataSet) call(ctx context.Context, item Item, callback ItemCallbackFunc) error {
+	if callback == nil {
+		return nil
+	}
+	if !ds.retry.enabled() {
+		return callback(ctx, item)
+	}
+
+	var err error
+	for attempts := 1; ; attempts++ {
+		if err = callback(ctx, item); err == nil {
+			return nil
+		}
+		if attempts >= ds.retry.MaxAttempts {
+			return ds.park(ctx, DeadLetter{Item: item, Attempts: attempts, Error: err.Error(), Time: time.Now()})
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(ds.retry.backoff(attempts)):
+		}
+	}
+}
+
+func (ds *dataSet) park(ctx context.Context, letter DeadLetter) error {
+	return ds.deadLetterOperation.AddData(ctx, letter.Item.UID.KSUID().String(), letter)
+}
+
+func (ds *dataSet) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	var letters []DeadLetter
+	err := ds.deadLetterOperation.Range(ctx, func(_, value []byte) error {
+		var letter DeadLetter
+		if err := json.Unmarshal(value, &letter); err != nil {
+			return err
+		}
+		letters = append(letters, letter)
+		return nil
+	})
+	return letters, err
+}
+
+func (ds *dataSet) getDeadLetter(ctx context.Context, op OperateInterface, uid suid.UID) (*DeadLetter, error) {
+	value, err := op.Get(ctx, uid.KSUID().String())
+	if err != nil {
+		return nil, err
+	}
+	if len(value) == 0 {
+		return nil, ErrDeadLetterNotFound
+	}
+	var letter DeadLetter
+	if err := json.Unmarshal(value, &letter); err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+func (ds *dataSet) RetryDeadLetter(ctx context.Context, uid suid.UID, callback ItemCallbackFunc) error {
+	letter, err := ds.getDeadLetter(ctx, ds.deadLetterOperation, uid)
+	if err != nil {
+		return err
+	}
+	if callback != nil {
+		if err := callback(ctx, letter.Item); err != nil {
+			letter.Attempts++
+			letter.Error = err.Error()
+			letter.Time = time.Now()
+			if parkErr := ds.park(ctx, *letter); parkErr != nil {
+				return parkErr
+			}
+			return err
+		}
+	}
+	return ds.deadLetterOperation.Del(ctx, uid.KSUID().String())
+}
+
+func (ds *dataSet) DiscardDeadLetter(ctx context.Context, uid suid.UID) error {
+	return ds.storage.Update(ctx, func(txn storage.Txn) error {
+		op := ds.deadLetterOperation.WithTxn(txn)
+		if _, err := ds.getDeadLetter(ctx, op, uid); err != nil {
+			return err
+		}
+		return op.Del(ctx, uid.KSUID().String())
+	})
+}
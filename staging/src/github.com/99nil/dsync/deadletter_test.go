@@ -0,0 +1,106 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/99nil/dsync/suid"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	p := RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := p.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestDataSet_DeadLetter(t *testing.T) {
+	ctx := context.Background()
+	server := newTestInstance(t)
+	items := syncerData(t, server, "a", "poison", "c")
+	manifest, err := server.Syncer("node").Manifest(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+
+	errPoison := errors.New("poison")
+	attempts := make(map[string]int)
+	callback := func(_ context.Context, item Item) error {
+		attempts[string(item.Value)]++
+		if string(item.Value) == "poison" {
+			return errPoison
+		}
+		return nil
+	}
+
+	// Without the retry policy, the failed callback stops the synchronization.
+	agent := newTestInstance(t)
+	agent.DataSet().SyncManifest(ctx, manifest)
+	if err := agent.DataSet().Sync(ctx, items, callback); err != errPoison {
+		t.Fatalf("Sync() error = %v, want %v", err, errPoison)
+	}
+	if attempts["c"] != 0 {
+		t.Errorf("callback of the item after the failed one is called %d times, want 0", attempts["c"])
+	}
+
+	attempts = make(map[string]int)
+	agent = newTestInstance(t, WithRetryOption(RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}))
+	agent.DataSet().SyncManifest(ctx, manifest)
+	if err := agent.DataSet().Sync(ctx, items, callback); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if attempts["a"] != 1 || attempts["poison"] != 3 || attempts["c"] != 1 {
+		t.Errorf("callback attempts = %v, want a:1 poison:3 c:1", attempts)
+	}
+	if state := agent.DataSet().State(ctx); state.String() != items[2].UID.String() {
+		t.Errorf("State() = %s, want %s", state, items[2].UID)
+	}
+
+	letters, err := agent.DataSet().DeadLetters(ctx)
+	if err != nil {
+		t.Fatalf("DeadLetters() error = %v", err)
+	}
+	if len(letters) != 1 || letters[0].Item.UID.String() != items[1].UID.String() ||
+		letters[0].Attempts != 3 || letters[0].Error != errPoison.Error() {
+		t.Fatalf("DeadLetters() = %+v, want the poison item after 3 attempts", letters)
+	}
+
+	uid := letters[0].Item.UID
+	if err := agent.DataSet().RetryDeadLetter(ctx, uid, callback); err != errPoison {
+		t.Errorf("RetryDeadLetter() error = %v, want %v", err, errPoison)
+	}
+	if letters, _ = agent.DataSet().DeadLetters(ctx); len(letters) != 1 || letters[0].Attempts != 4 {
+		t.Errorf("DeadLetters() = %+v, want 4 attempts", letters)
+	}
+	if err := agent.DataSet().RetryDeadLetter(ctx, uid, func(context.Context, Item) error { return nil }); err != nil {
+		t.Errorf("RetryDeadLetter() error = %v", err)
+	}
+	if letters, _ = agent.DataSet().DeadLetters(ctx); len(letters) != 0 {
+		t.Errorf("DeadLetters() = %+v after retrying, want empty", letters)
+	}
+	if err := agent.DataSet().DiscardDeadLetter(ctx, uid); err != ErrDeadLetterNotFound {
+		t.Errorf("DiscardDeadLetter() error = %v, want %v", err, ErrDeadLetterNotFound)
+	}
+	if err := agent.DataSet().RetryDeadLetter(ctx, suid.New(), callback); err != ErrDeadLetterNotFound {
+		t.Errorf("RetryDeadLetter() error = %v, want %v", err, ErrDeadLetterNotFound)
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+
+	"github.com/99nil/dsync/storage"
+)
+
+// deliver calls back the item in DeliveryCheckpoint mode unless its delivery has been recorded.
+// The delivery is recorded right after the callback succeeds, and the record is removed
+// in the transaction that commits the item, so the item is not delivered again when the commit is retried.
+func (ds *dataSet) deliver(ctx context.Context, item Item, callback ItemCallbackFunc) error {
+	id := item.UID.KSUID().String()
+	delivered, err := ds.deliveredOperation.Get(ctx, id)
+	if err != nil || delivered != nil {
+		return err
+	}
+	if err := ds.call(ctx, item, callback); err != nil {
+		return err
+	}
+	return ds.storage.Update(ctx, func(txn storage.Txn) error {
+		return ds.deliveredOperation.WithTxn(txn).Add(ctx, id, []byte(item.UID.String()))
+	})
+}
@@ -0,0 +1,206 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
+)
+
+var errCrash = errors.New("process crashed")
+
+// crashStorage fails the n-th transaction as if the process exited during it
+type crashStorage struct {
+	storage.Interface
+	updates int
+	crashAt int
+}
+
+func (s *crashStorage) Update(ctx context.Context, fn func(txn storage.Txn) error) error {
+	s.updates++
+	if s.updates == s.crashAt {
+		return errCrash
+	}
+	return s.Interface.Update(ctx, fn)
+}
+
+// testConsumer applies the items, and counts the successful deliveries of each UID
+type testConsumer struct {
+	applied    map[string]string
+	delivered  map[string]int
+	deliveries int
+	// crashAt fails the n-th delivery as if the process exited in the callback
+	crashAt int
+}
+
+func newTestConsumer(crashAt int) *testConsumer {
+	return &testConsumer{applied: make(map[string]string), delivered: make(map[string]int), crashAt: crashAt}
+}
+
+func (c *testConsumer) callback(_ context.Context, item Item) error {
+	c.deliveries++
+	if c.deliveries == c.crashAt {
+		return errCrash
+	}
+	c.delivered[item.UID.String()]++
+	c.applied[item.UID.String()] = string(item.Value)
+	return nil
+}
+
+// syncWithCrash synchronizes the items with a crash injected, restarts on the same storage,
+// and synchronizes the same items again.
+func syncWithCrash(
+	t *testing.T,
+	mode DeliveryMode,
+	manifest *suid.AssembleManifest,
+	items []Item,
+	crashStorageAt, crashCallbackAt int,
+) *testConsumer {
+	t.Helper()
+	ctx := context.Background()
+	base := newTestStorage(t)
+	consumer := newTestConsumer(crashCallbackAt)
+
+	crashed, err := New(WithStorageOption(&crashStorage{Interface: base, crashAt: crashStorageAt}), WithDeliveryOption(mode))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	crashed.DataSet().SyncManifest(ctx, manifest)
+	if err := crashed.DataSet().SyncAndDelete(ctx, copyItems(items), consumer.callback); err != errCrash {
+		t.Fatalf("Sync() error = %v, want %v", err, errCrash)
+	}
+
+	restarted, err := New(WithStorageOption(base), WithDeliveryOption(mode))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	state := restarted.DataSet().State(ctx)
+	// The server only sends the items after the state the agent reports.
+	var pending []Item
+	for _, item := range items {
+		if suid.CompareKSUID(item.UID.KSUID(), state.KSUID()) > 0 {
+			pending = append(pending, item)
+		}
+	}
+	restarted.DataSet().SyncManifest(ctx, manifest)
+	if err := restarted.DataSet().SyncAndDelete(ctx, copyItems(pending), consumer.callback); err != nil {
+		t.Fatalf("Sync() after restart error = %v", err)
+	}
+	if got := restarted.DataSet().State(ctx); got.String() != items[len(items)-1].UID.String() {
+		t.Errorf("State() after restart = %s, want %s", got, items[len(items)-1].UID)
+	}
+	return consumer
+}
+
+func copyItems(items []Item) []Item {
+	return append([]Item(nil), items...)
+}
+
+func TestDataSet_DeliveryCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	server := newTestInstance(t)
+	items := syncerData(t, server, "a", "b", "c", "d")
+	manifest, err := server.Syncer("node").Manifest(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+
+	// check asserts that every item is applied, and delivered once except the duplicated one.
+	check := func(t *testing.T, consumer *testConsumer, duplicated int) {
+		t.Helper()
+		for i, item := range items {
+			if got, ok := consumer.applied[item.UID.String()]; !ok || got != string(item.Value) {
+				t.Errorf("item %s is lost", item.Value)
+			}
+			want := 1
+			if i == duplicated {
+				want = 2
+			}
+			if got := consumer.delivered[item.UID.String()]; got != want {
+				t.Errorf("item %s is delivered %d times, want %d", item.Value, got, want)
+			}
+		}
+	}
+
+	// Each item is synchronized in two transactions, the record of its delivery and its commit.
+	// The process exits when the n-th item is committed, its delivery is recorded and not repeated.
+	for n := 1; n <= len(items); n++ {
+		t.Run(fmt.Sprintf("crash at commit %d", n), func(t *testing.T) {
+			consumer := syncWithCrash(t, DeliveryCheckpoint, manifest, items, 2*n, 0)
+			check(t, consumer, -1)
+		})
+	}
+
+	// The process exits in the callback of the n-th item, nothing after it is delivered.
+	for n := 1; n <= len(items); n++ {
+		t.Run(fmt.Sprintf("crash at callback %d", n), func(t *testing.T) {
+			consumer := syncWithCrash(t, DeliveryCheckpoint, manifest, items, 0, n)
+			check(t, consumer, -1)
+		})
+	}
+
+	// The process exits after the callback of the n-th item returns but before its delivery is recorded,
+	// it is the only point where the item is delivered twice, the consumer deduplicates it by the UID.
+	for n := 1; n <= len(items); n++ {
+		t.Run(fmt.Sprintf("crash at record %d", n), func(t *testing.T) {
+			consumer := syncWithCrash(t, DeliveryCheckpoint, manifest, items, 2*n-1, 0)
+			check(t, consumer, n-1)
+		})
+	}
+
+	// The item committed before the callback crashed is lost in the default mode.
+	t.Run("after commit loses the item", func(t *testing.T) {
+		consumer := syncWithCrash(t, DeliveryAfterCommit, manifest, items, 0, 2)
+		if _, ok := consumer.applied[items[1].UID.String()]; ok {
+			t.Errorf("item %s is delivered again, want lost in DeliveryAfterCommit", items[1].Value)
+		}
+	})
+}
+
+func TestDataSet_DeliveryCheckpointSnapshot(t *testing.T) {
+	ctx := context.Background()
+	server := newTestInstance(t)
+	items := syncerData(t, server, "a", "b")
+	snapshot, err := server.Syncer("node").Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+
+	agent := newTestInstance(t, WithDeliveryOption(DeliveryCheckpoint))
+	consumer := newTestConsumer(2)
+	if err := agent.DataSet().InstallSnapshot(ctx, snapshot, consumer.callback); err != errCrash {
+		t.Fatalf("InstallSnapshot() error = %v, want %v", err, errCrash)
+	}
+	if state := agent.DataSet().State(ctx); !state.IsNil() {
+		t.Fatalf("State() = %s, want nil before all items are delivered", state)
+	}
+	if err := agent.DataSet().InstallSnapshot(ctx, snapshot, consumer.callback); err != nil {
+		t.Fatalf("InstallSnapshot() error = %v", err)
+	}
+	// The item delivered before the crash is not delivered again.
+	for _, item := range items {
+		if got := consumer.delivered[item.UID.String()]; got != 1 {
+			t.Errorf("item %s is delivered %d times, want 1", item.Value, got)
+		}
+	}
+	if state := agent.DataSet().State(ctx); state.String() != snapshot.State.String() {
+		t.Errorf("State() = %s, want %s", state, snapshot.State)
+	}
+}
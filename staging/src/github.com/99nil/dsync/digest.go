@@ -0,0 +1,96 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/99nil/dsync/suid"
+)
+
+// ChecksumError indicates that the value of the item does not match its digest
+type ChecksumError struct {
+	UID      suid.UID
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: expected %x, actual %x", e.UID, e.Expected, e.Actual)
+}
+
+// Digest returns the SHA-256 digest of the value
+func Digest(value []byte) []byte {
+	sum := sha256.Sum256(value)
+	return sum[:]
+}
+
+// Verify checks the value of the item against its digest,
+// the item without digest comes from the legacy dataset and is not verified.
+func (i Item) Verify() error {
+	if len(i.Digest) == 0 {
+		return nil
+	}
+	if actual := Digest(i.Value); !bytes.Equal(actual, i.Digest) {
+		return &ChecksumError{UID: i.UID, Expected: i.Digest, Actual: actual}
+	}
+	return nil
+}
+
+// VerifyItems checks the items in order and returns the first mismatch.
+func VerifyItems(items []Item) error {
+	for _, item := range items {
+		if err := item.Verify(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *dataSet) Verify(ctx context.Context) ([]suid.UID, error) {
+	customs := make(map[suid.KSUID]string)
+	err := ds.customOperation.Range(ctx, func(key, value []byte) error {
+		id, err := suid.ParseKSUID(string(value))
+		if err != nil {
+			return err
+		}
+		customs[id] = string(key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var corrupted []suid.UID
+	err = ds.dataSetOperation.Range(ctx, func(key, value []byte) error {
+		id, err := suid.ParseKSUID(string(key))
+		if err != nil {
+			return err
+		}
+		digest, err := ds.digestOperation.Get(ctx, id.String())
+		if err != nil {
+			return err
+		}
+		item := Item{UID: suid.NewWithCustom(id, customs[id]), Value: value, Digest: digest}
+		if item.Verify() != nil {
+			corrupted = append(corrupted, item.UID)
+		}
+		return nil
+	})
+	return corrupted, err
+}
@@ -0,0 +1,99 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/99nil/dsync/suid"
+)
+
+func TestDataSet_Digest(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+	server := newTestInstance(t)
+	agent, err := New(WithStorageOption(s))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	uids := []suid.UID{suid.New(), suid.New()}
+	for i, uid := range uids {
+		if err := server.DataSet().Add(ctx, Item{UID: uid, Value: []byte{byte(i)}}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if err := server.Syncer("node").Add(ctx, uids...); err != nil {
+		t.Fatalf("Syncer.Add() error = %v", err)
+	}
+	manifest, err := server.Syncer("node").Manifest(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	items, err := server.Syncer("node").Data(ctx, manifest)
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	for _, item := range items {
+		if !bytes.Equal(item.Digest, Digest(item.Value)) {
+			t.Fatalf("Data() item %s has digest %x, want %x", item.UID, item.Digest, Digest(item.Value))
+		}
+	}
+
+	// The corrupted item fails the whole batch.
+	corrupted := append([]Item(nil), items...)
+	corrupted[1].Value = []byte("corrupted")
+	agent.DataSet().SyncManifest(ctx, manifest)
+	err = agent.DataSet().Sync(ctx, corrupted, func(ctx context.Context, item Item) error {
+		t.Errorf("callback received %s from the corrupted batch", item.UID)
+		return nil
+	})
+	var checksumErr *ChecksumError
+	if !errors.As(err, &checksumErr) || checksumErr.UID.String() != uids[1].String() {
+		t.Fatalf("Sync() error = %v, want *ChecksumError of %s", err, uids[1])
+	}
+	if state := agent.DataSet().State(ctx); !state.IsNil() {
+		t.Errorf("State() = %s after the corrupted batch, want nil", state)
+	}
+
+	if err := agent.DataSet().Sync(ctx, items, nil); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if got, err := agent.DataSet().Verify(ctx); err != nil || len(got) != 0 {
+		t.Fatalf("Verify() = %v, %v, want nothing corrupted", got, err)
+	}
+
+	// Corrupt the value in the local storage.
+	if err := s.Add(ctx, buildName(spaceDatasetPrefix), uids[0].KSUID().String(), []byte("corrupted")); err != nil {
+		t.Fatalf("storage.Add() error = %v", err)
+	}
+	got, err := agent.DataSet().Verify(ctx)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if len(got) != 1 || got[0].String() != uids[0].String() {
+		t.Errorf("Verify() = %v, want [%s]", got, uids[0])
+	}
+	item, err := agent.DataSet().Get(ctx, uids[0])
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if err := item.Verify(); !errors.As(err, &checksumErr) {
+		t.Errorf("Item.Verify() error = %v, want *ChecksumError", err)
+	}
+}
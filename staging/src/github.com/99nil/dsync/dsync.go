@@ -17,7 +17,9 @@ package dsync
 import (
 	"context"
 	"strings"
+	"time"
 
+	"github.com/99nil/dsync/storage/compress"
 	"github.com/99nil/dsync/suid"
 )
 
@@ -25,18 +27,61 @@ const prefix = "dsync"
 
 const keyState = "dsync_state"
 
+const keyEpoch = "dsync_epoch"
+
+// keyInstalling is the key of the progress of the snapshot being installed
+const keyInstalling = "dsync_installing"
+
 var (
 	spaceStatePrefix   = buildName(prefix, "state")
 	spaceDatasetPrefix = buildName(prefix, "dataset")
 	spaceSyncerPrefix  = buildName(prefix, "syncer")
 	spaceRelatePrefix  = buildName(prefix, "relate")
 	spaceTmpPrefix     = buildName(prefix, "tmp")
+
+	spaceSubscriptionPrefix = buildName(prefix, "subscription")
+	spaceLogPrefix          = buildName(prefix, "log")
+	spaceMemberPrefix       = buildName(prefix, "member")
+	spaceBindingPrefix      = buildName(prefix, "binding")
+	spaceCursorPrefix       = buildName(prefix, "cursor")
+
+	spaceIndexPrefix   = buildName(prefix, "index")
+	spaceIndexedPrefix = buildName(prefix, "indexed")
+	spaceHistoryPrefix = buildName(prefix, "history")
+	spaceDigestPrefix  = buildName(prefix, "digest")
+
+	spaceDeadLetterPrefix = buildName(prefix, "deadletter")
+	spaceDeliveredPrefix  = buildName(prefix, "delivered")
+
+	spaceTombstonePrefix    = buildName(prefix, "tombstone")
+	spaceTmpTombstonePrefix = buildName(spaceTmpPrefix, "tombstone")
 )
 
 // Item defines the data item
 type Item struct {
 	UID   suid.UID
 	Value []byte
+	// Digest is the SHA-256 digest of the Value computed when the item is added,
+	// it is carried with the item to detect the corruption in storage or on the wire.
+	Digest []byte
+	// Signature is the ed25519 signature of the UID, the Encoding, the Value on the wire and the Tombstone,
+	// it is set when the item is served by the instance created with a signer.
+	Signature []byte
+	// Encoding is the compression of the Value on the wire,
+	// the items are decompressed before they are synchronized.
+	Encoding compress.Encoding `json:",omitempty"`
+	// Tombstone marks the item as the delete marker of its logical key,
+	// the key is deleted until a newer item of it is added.
+	Tombstone bool `json:",omitempty"`
+}
+
+// Snapshot defines a consistent point-in-time set of the latest items,
+// the incremental synchronization resumes from the State after it is installed.
+type Snapshot struct {
+	State suid.UID
+	Items []Item
+	// Epoch is the epoch of the dataset the snapshot is taken from
+	Epoch string `json:",omitempty"`
 }
 
 // Interface defines dsync core
@@ -47,8 +92,33 @@ type Interface interface {
 	// Syncer returns a synchronizer with a specified name
 	Syncer(name string) Synchronizer
 
-	// Clear clears all data
+	// Syncers returns the names of all synchronizers that have a sync set
+	Syncers(ctx context.Context) ([]string, error)
+
+	// RemoveSyncer removes the sync set and the subscriptions of the synchronizer with a specified name
+	RemoveSyncer(ctx context.Context, name string) error
+
+	// Subscription returns a subscription with a specified name
+	Subscription(name string) Subscription
+
+	// Publish adds the items to the dataset and appends their UIDs to the logs of the subscriptions.
+	// The KSUID of each item is assigned in the same transaction as the appends and the publications are serialized,
+	// so a bound synchronizer never moves past a KSUID that is appended later.
+	Publish(ctx context.Context, subscriptions []string, items ...Item) error
+
+	// Subscriptions returns the names of all subscriptions that have been bound
+	Subscriptions(ctx context.Context) ([]string, error)
+
+	// Spaces returns the names of all storage spaces used by the instance,
+	// including the log and member spaces of the existing subscriptions.
+	Spaces(ctx context.Context) ([]string, error)
+
+	// Clear clears all data in the spaces returned by Spaces, including the state and the epoch
 	Clear(ctx context.Context) error
+
+	// GC removes the expired data in the tmp space, the association relationships pointing at missing data,
+	// and the data no longer referenced by any association relationship or syncer.
+	GC(ctx context.Context, opts GCOptions) (*GCResult, error)
 }
 
 // Synchronizer defines the synchronizer operations
@@ -59,11 +129,65 @@ type Synchronizer interface {
 	// Del deletes UIDs from sync set
 	Del(ctx context.Context, uids ...suid.UID) error
 
-	// Manifest gets a manifest that needs to be synchronized according to the UID
+	// Manifest gets a manifest that needs to be synchronized according to the UID,
+	// if the instance is created with a KeyFunc, only the newest UID of each key is kept.
 	Manifest(ctx context.Context, uid suid.UID, limit int) (*suid.AssembleManifest, error)
 
 	// Data gets the data items to be synchronized according to the manifest
-	Data(ctx context.Context, manifest *suid.AssembleManifest) ([]Item, error)
+	Data(ctx context.Context, manifest *suid.AssembleManifest, opts ...DataOption) ([]Item, error)
+
+	// Watch returns a channel that receives the UIDs added to the sync set,
+	// the channel is closed when ctx is done.
+	// UIDs may be dropped when the receiver falls behind,
+	// so it only indicates a change, the manifest is still the source of truth.
+	Watch(ctx context.Context) <-chan suid.UID
+
+	// Stats gets the statistics of the sync set
+	Stats(ctx context.Context) (*SyncerStats, error)
+
+	// Snapshot gets the latest items in the dataset and the state they correspond to,
+	// the UIDs before the state are removed from the sync set.
+	Snapshot(ctx context.Context, opts ...DataOption) (*Snapshot, error)
+
+	// StreamSnapshot is Snapshot passing the items to fn one by one instead of holding them in memory,
+	// the returned snapshot has no items. If fn returns error, the stream stops.
+	StreamSnapshot(ctx context.Context, fn func(item Item) error, opts ...DataOption) (*Snapshot, error)
+}
+
+// Subscription defines an ordered log of UIDs shared by the synchronizers bound to it.
+// Adding UIDs to a subscription costs the same no matter how many synchronizers are bound,
+// each synchronizer only keeps a cursor of the synchronized position.
+type Subscription interface {
+	// Add appends UIDs to the log, the UIDs must be appended in ascending order of KSUID,
+	// otherwise a bound synchronizer that has moved past a KSUID never synchronizes it.
+	// Use Interface.Publish to add new items and append them together.
+	Add(ctx context.Context, uids ...suid.UID) error
+
+	// Bind binds the synchronizer with a specified name,
+	// the UIDs appended afterwards are synchronized together with its own sync set.
+	Bind(ctx context.Context, syncer string) error
+
+	// Unbind unbinds the synchronizer with a specified name,
+	// the subscription is removed with its log when the last synchronizer is unbound.
+	Unbind(ctx context.Context, syncer string) error
+
+	// Members returns the names of the bound synchronizers
+	Members(ctx context.Context) ([]string, error)
+
+	// Trim removes the UIDs that have been synchronized by all bound synchronizers
+	Trim(ctx context.Context) ([]suid.KSUID, error)
+}
+
+// SyncerStats defines the statistics of the sync set
+type SyncerStats struct {
+	// Pending is the number of UIDs waiting to be synchronized
+	Pending int
+
+	// Oldest is the timestamp of the oldest pending KSUID, zero when nothing is pending
+	Oldest time.Time
+
+	// Size is the byte size of the stored manifest
+	Size int
 }
 
 // DataSet defines the data set operations
@@ -74,6 +198,14 @@ type DataSet interface {
 	// State gets the latest state of the dataset
 	State(ctx context.Context) suid.UID
 
+	// Epoch gets the epoch of the dataset, or empty if it is unknown.
+	// The epoch is generated when the first item is added, and taken from the snapshot when it is installed,
+	// so a dataset that has been wiped can be told from the one it was synchronized with.
+	Epoch(ctx context.Context) string
+
+	// SetEpoch sets the epoch of the dataset, an empty epoch removes it
+	SetEpoch(ctx context.Context, epoch string) error
+
 	// Get gets data according to UID
 	Get(ctx context.Context, uid suid.UID) (*Item, error)
 
@@ -84,6 +216,7 @@ type DataSet interface {
 	Del(ctx context.Context, uids ...suid.UID) error
 
 	// Range calls fn sequentially for item present in the dataset.
+	// The UID of the item does not contain the custom UID.
 	// If fn returns error, range stops the iteration.
 	Range(ctx context.Context, fn func(item *Item) error) error
 
@@ -91,18 +224,110 @@ type DataSet interface {
 	// If fn returns error, range stops the iteration.
 	RangeCustom(ctx context.Context, fn func(uid suid.UID) error) error
 
+	// RangePrefix calls fn sequentially in ascending order of custom UID for the item whose custom UID has the prefix,
+	// only the items with the prefix are read from the storage.
+	// The value of the item is nil if it has been deleted after synchronization.
+	// If fn returns error, range stops the iteration.
+	RangePrefix(ctx context.Context, prefix string, fn func(item *Item) error) error
+
+	// ByIndex returns the items whose indexed values of the named index contain the value,
+	// the indexes are maintained when the items are added, synchronized or deleted.
+	// Only the latest version of each logical key is indexed, and the deleted keys are not returned.
+	// The value of the indexed item is kept by SyncAndDelete and InstallSnapshotAndDelete,
+	// so that the consumers of the index can read it, the items left unindexed are deleted as usual.
+	ByIndex(ctx context.Context, name, value string) ([]Item, error)
+
+	// Verify rescans the dataset and returns the UIDs of the items whose value does not match the digest.
+	Verify(ctx context.Context) ([]suid.UID, error)
+
+	// Tombstone returns the delete marker of the logical key, or nil if the key is not deleted,
+	// so that a deleted key can be told from the one that never existed.
+	// The key is extracted from the custom UID by the KeyFunc if the instance is created with it,
+	// otherwise it is the custom UID.
+	Tombstone(ctx context.Context, key string) (*Item, error)
+
+	// History returns the recorded versions of the key from the oldest to the latest.
+	// The key is extracted from the custom UID by the KeyFunc if the instance is created with it,
+	// otherwise it is the custom UID. The history is only recorded when it is enabled.
+	History(ctx context.Context, key string) ([]Item, error)
+
+	// Revert writes the recorded version of the key back to the dataset without changing the state,
+	// and calls the callback with it. A nil uid means the version before the latest.
+	Revert(ctx context.Context, key string, uid suid.UID, callback ItemCallbackFunc) error
+
+	// ListPrefix returns at most limit items whose custom UID has the prefix, starting from the custom UID start,
+	// and the custom UID to start the next page, which is empty when there are no more items.
+	// A limit less than 1 means no limit.
+	ListPrefix(ctx context.Context, prefix, start string, limit int) ([]Item, string, error)
+
 	// SyncManifest syncs the manifest that needs to be executed
 	SyncManifest(ctx context.Context, manifest *suid.AssembleManifest)
 
-	// Sync syncs the data according to manifest and items
+	// Sync syncs the data according to manifest and items.
+	// The compressed items are decompressed in place and verified against their digests first,
+	// the whole batch fails with *ChecksumError on mismatch.
 	Sync(ctx context.Context, items []Item, callback ItemCallbackFunc) error
 
 	// SyncAndDelete syncs and deletes the data according to manifest and items
 	SyncAndDelete(ctx context.Context, items []Item, callback ItemCallbackFunc) error
+
+	// DeadLetters returns the items parked after their callbacks kept failing, in the order of KSUID.
+	// The items are only parked if the instance is created with a retry policy.
+	DeadLetters(ctx context.Context) ([]DeadLetter, error)
+
+	// RetryDeadLetter calls the callback with the parked item once, and removes it on success.
+	// It returns the error of the callback after recording the failed attempt.
+	RetryDeadLetter(ctx context.Context, uid suid.UID, callback ItemCallbackFunc) error
+
+	// DiscardDeadLetter removes the parked item without calling back.
+	DiscardDeadLetter(ctx context.Context, uid suid.UID) error
+
+	// InstallSnapshot replaces all data with the snapshot, and sets the state to the snapshot state.
+	// The snapshot is installed in batches of transactions, the state is removed until the last one commits,
+	// and the installation interrupted halfway is resumed when the same snapshot is installed again.
+	// The callback is called for each item, and for the tombstone without value of each latest local item
+	// whose logical key is missing from the snapshot, it has been deleted while the dataset was behind.
+	InstallSnapshot(ctx context.Context, snapshot *Snapshot, callback ItemCallbackFunc) error
+
+	// InstallSnapshotAndDelete installs the snapshot like InstallSnapshot,
+	// but only keeps the association relationships of the items like SyncAndDelete.
+	InstallSnapshotAndDelete(ctx context.Context, snapshot *Snapshot, callback ItemCallbackFunc) error
 }
 
+// ItemCallbackFunc is called with each synchronized item,
+// the UID of the item is the idempotency key when it may be delivered again.
 type ItemCallbackFunc func(context.Context, Item) error
 
+// DeliveryMode defines when the synchronized items are delivered to the callback
+type DeliveryMode int
+
+const (
+	// DeliveryAfterCommit calls back after the item is committed and the state advances,
+	// the item is never delivered again if the process exits before the callback finishes.
+	DeliveryAfterCommit DeliveryMode = iota
+
+	// DeliveryCheckpoint commits the item and advances the state only after the callback succeeds,
+	// so no item is lost. The delivery is recorded by the UID right after the callback succeeds,
+	// and the recorded item is committed without calling back again if the process exits before the commit.
+	// The item is only delivered twice if the process exits after the callback returns but before the record is stored,
+	// the consumer that can not tolerate it deduplicates the item by its UID.
+	DeliveryCheckpoint
+)
+
+// KeyFunc extracts the logical key from the UID,
+// the UIDs with the same non-empty key are different versions of the same data.
+type KeyFunc func(uid suid.UID) string
+
+// logicalKey returns the key extracted by the KeyFunc, or the custom UID if there is none.
+func logicalKey(keyFunc KeyFunc, uid suid.UID) string {
+	if keyFunc != nil {
+		if key := keyFunc(uid); key != "" {
+			return key
+		}
+	}
+	return uid.CustomUID()
+}
+
 func buildName(ss ...string) string {
 	nameSet := make([]string, 0, len(ss))
 	for _, s := range ss {
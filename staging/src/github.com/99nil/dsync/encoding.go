@@ -0,0 +1,85 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"github.com/99nil/dsync/storage/compress"
+)
+
+// DataOption defines the options of the items served by the synchronizer
+type DataOption func(o *dataOptions)
+
+type dataOptions struct {
+	encoding  compress.Encoding
+	threshold int
+}
+
+// WithDataEncoding compresses the values of the served items with the encoding before they are signed,
+// the value smaller than the threshold is kept as is.
+func WithDataEncoding(encoding compress.Encoding, threshold int) DataOption {
+	return func(o *dataOptions) {
+		o.encoding = encoding
+		o.threshold = threshold
+	}
+}
+
+func newDataOptions(opts []DataOption) *dataOptions {
+	o := &dataOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// Compress compresses the value of the item with the encoding,
+// the value smaller than the threshold or not reduced is kept as is.
+// The digest covers the uncompressed value and the signature the compressed one,
+// so the signed item must not be compressed again.
+func (i *Item) Compress(encoding compress.Encoding, threshold int) error {
+	if encoding == compress.Identity || i.Encoding != compress.Identity || len(i.Value) < threshold {
+		return nil
+	}
+	value, err := compress.Compress(encoding, i.Value)
+	if err != nil {
+		return err
+	}
+	if len(value) < len(i.Value) {
+		i.Value, i.Encoding = value, encoding
+	}
+	return nil
+}
+
+// Decompress restores the uncompressed value of the item.
+func (i *Item) Decompress() error {
+	if i.Encoding == compress.Identity {
+		return nil
+	}
+	value, err := compress.Decompress(i.Encoding, i.Value)
+	if err != nil {
+		return err
+	}
+	i.Value, i.Encoding = value, compress.Identity
+	return nil
+}
+
+// DecompressItems decompresses the items in place.
+func DecompressItems(items []Item) error {
+	for i := range items {
+		if err := items[i].Decompress(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/99nil/dsync/storage/compress"
+)
+
+func TestItem_Compress(t *testing.T) {
+	pub, priv := newTestKey(t)
+	server := newTestInstance(t, WithSignerOption(priv))
+	agent := newTestInstance(t)
+
+	large := strings.Repeat("value,", 200)
+	syncerData(t, server, large, "small")
+	ctx := context.Background()
+	manifest, err := server.Syncer("node").Manifest(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	items, err := server.Syncer("node").Data(ctx, manifest, WithDataEncoding(compress.Zstd, compress.DefaultThreshold))
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	if items[0].Encoding != compress.Zstd || len(items[0].Value) >= len(large) {
+		t.Errorf("large item is %s in %d bytes, want compressed", items[0].Encoding, len(items[0].Value))
+	}
+	if items[1].Encoding != compress.Identity {
+		t.Errorf("small item is %s, want uncompressed", items[1].Encoding)
+	}
+	if err := VerifySignatures(items, pub); err != nil {
+		t.Fatalf("VerifySignatures() error = %v", err)
+	}
+
+	// The compressed value is signed, it is rejected before it is decompressed.
+	var sigErr *SignatureError
+	tampered := append([]Item(nil), items...)
+	tampered[0].Value = []byte("not a zstd frame")
+	if err := VerifySignatures(tampered, pub); !errors.As(err, &sigErr) || sigErr.UID.String() != items[0].UID.String() {
+		t.Errorf("VerifySignatures(tampered) error = %v, want invalid signature of %s", err, items[0].UID)
+	}
+
+	// The items are decompressed before they are synchronized.
+	agent.DataSet().SyncManifest(ctx, manifest)
+	var values []string
+	err = agent.DataSet().Sync(ctx, items, func(_ context.Context, item Item) error {
+		values = append(values, string(item.Value))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if want := []string{large, "small"}; !equalStrings(values, want) {
+		t.Errorf("Sync() called back %d values, want the uncompressed ones", len(values))
+	}
+	item, err := agent.DataSet().Get(ctx, items[0].UID)
+	if err != nil || !bytes.Equal(item.Value, []byte(large)) {
+		t.Errorf("Get() = %v, %v, want the uncompressed value", item, err)
+	}
+}
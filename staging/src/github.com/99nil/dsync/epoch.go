@@ -0,0 +1,65 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"errors"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
+)
+
+var ErrEpochMismatch = errors.New("epoch mismatch")
+
+// CheckEpoch returns ErrEpochMismatch if the epoch synchronized from is known and differs from the current one,
+// which means the source dataset has been wiped or replaced since, e.g. restored from another backup.
+// The unknown epoch synchronized from, e.g. before the epoch is introduced, always matches.
+func CheckEpoch(synced, current string) error {
+	if synced == "" || synced == current {
+		return nil
+	}
+	return ErrEpochMismatch
+}
+
+func (ds *dataSet) Epoch(ctx context.Context) string {
+	value, err := ds.defaultOperation.Get(ctx, keyEpoch)
+	if err != nil {
+		return ""
+	}
+	return string(value)
+}
+
+func (ds *dataSet) SetEpoch(ctx context.Context, epoch string) error {
+	return setEpoch(ctx, ds.defaultOperation, epoch)
+}
+
+// ensureEpoch generates the epoch of the dataset when the first item is added to it,
+// a wiped dataset starts a new epoch.
+func (ds *dataSet) ensureEpoch(ctx context.Context, txn storage.Txn) error {
+	op := ds.defaultOperation.WithTxn(txn)
+	value, err := op.Get(ctx, keyEpoch)
+	if err != nil || len(value) > 0 {
+		return err
+	}
+	return op.Add(ctx, keyEpoch, []byte(suid.NewKSUID().String()))
+}
+
+func setEpoch(ctx context.Context, op OperateInterface, epoch string) error {
+	if epoch == "" {
+		return op.Del(ctx, keyEpoch)
+	}
+	return op.Add(ctx, keyEpoch, []byte(epoch))
+}
@@ -0,0 +1,106 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/99nil/dsync/suid"
+)
+
+func TestCheckEpoch(t *testing.T) {
+	tests := []struct {
+		name    string
+		synced  string
+		current string
+		want    error
+	}{
+		{name: "same", synced: "a", current: "a"},
+		{name: "unknown synced", synced: "", current: "a"},
+		{name: "reset", synced: "a", current: "b", want: ErrEpochMismatch},
+		{name: "wiped", synced: "a", current: "", want: ErrEpochMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckEpoch(tt.synced, tt.current); got != tt.want {
+				t.Errorf("CheckEpoch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDataSet_Epoch(t *testing.T) {
+	ctx := context.Background()
+	server := newTestInstance(t)
+	agent := newTestInstance(t)
+
+	if got := server.DataSet().Epoch(ctx); got != "" {
+		t.Errorf("Epoch() = %q before adding, want empty", got)
+	}
+	syncerData(t, server, "a")
+	epoch := server.DataSet().Epoch(ctx)
+	if epoch == "" {
+		t.Fatal("Epoch() is empty after adding")
+	}
+	syncerData(t, server, "b")
+	if got := server.DataSet().Epoch(ctx); got != epoch {
+		t.Errorf("Epoch() = %q after adding again, want %q", got, epoch)
+	}
+
+	snapshot, err := server.Syncer("other").Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	if snapshot.Epoch != epoch {
+		t.Errorf("Snapshot() Epoch = %q, want %q", snapshot.Epoch, epoch)
+	}
+	if err := agent.DataSet().InstallSnapshot(ctx, snapshot, nil); err != nil {
+		t.Fatalf("InstallSnapshot() error = %v", err)
+	}
+	if got := agent.DataSet().Epoch(ctx); got != epoch {
+		t.Errorf("agent Epoch() = %q after installing snapshot, want %q", got, epoch)
+	}
+
+	// The synchronized items do not change the epoch they are synchronized from.
+	items := syncerData(t, server, "c")
+	manifest, err := server.Syncer("node").Manifest(ctx, agent.DataSet().State(ctx), 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	agent.DataSet().SyncManifest(ctx, manifest)
+	if err := agent.DataSet().Sync(ctx, items[len(items)-1:], nil); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if got := agent.DataSet().Epoch(ctx); got != epoch {
+		t.Errorf("agent Epoch() = %q after sync, want %q", got, epoch)
+	}
+
+	// The wiped dataset starts a new epoch, which the agent state does not belong to.
+	wiped := newTestInstance(t)
+	if err := wiped.DataSet().Add(ctx, Item{UID: suid.New(), Value: []byte("a")}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := CheckEpoch(agent.DataSet().Epoch(ctx), wiped.DataSet().Epoch(ctx)); err != ErrEpochMismatch {
+		t.Errorf("CheckEpoch() = %v after wiped, want %v", err, ErrEpochMismatch)
+	}
+
+	if err := agent.DataSet().SetEpoch(ctx, ""); err != nil {
+		t.Fatalf("SetEpoch() error = %v", err)
+	}
+	if got := agent.DataSet().Epoch(ctx); got != "" {
+		t.Errorf("Epoch() = %q after removed, want empty", got)
+	}
+}
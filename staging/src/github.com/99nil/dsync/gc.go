@@ -0,0 +1,445 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"time"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
+)
+
+// GCOptions defines the options of garbage collection
+type GCOptions struct {
+	// TmpExpiration is the minimum age of the data in the tmp space to be removed.
+	// The age is calculated from the time the data was written, 0 means removing all.
+	// The tmp space is never swept during synchronization.
+	TmpExpiration time.Duration
+
+	// OrphanExpiration is the minimum age of the unreferenced data in the dataset to be removed.
+	// The age is calculated from the timestamp of the KSUID, 0 means DefaultOrphanExpiration,
+	// so that the data being added is never taken as an orphan.
+	OrphanExpiration time.Duration
+
+	// KeepOrphans skips removing the data in the dataset that is referenced
+	// neither by the association relationship nor by any syncer.
+	KeepOrphans bool
+
+	// KeepRelates skips removing the association relationships pointing at missing data,
+	// it is required when the data is deleted after synchronization, e.g. by SyncAndDelete.
+	KeepRelates bool
+
+	// TombstoneExpiration is the minimum age of the tombstones to be purged.
+	// The tombstones still pending in any syncer or subscription log are never purged,
+	// the age is calculated from the timestamp of the KSUID, 0 means purging all the others.
+	TombstoneExpiration time.Duration
+
+	// KeepTombstones skips purging the tombstones.
+	KeepTombstones bool
+}
+
+// GCResult records the data removed by garbage collection
+type GCResult struct {
+	// Tmp is the KSUIDs removed from the tmp space
+	Tmp []suid.KSUID
+
+	// Relate is the custom UIDs whose association relationship pointed at missing data
+	Relate []string
+
+	// Dataset is the KSUIDs of the orphaned data removed from the dataset
+	Dataset []suid.KSUID
+
+	// Log is the KSUIDs trimmed from the subscription logs
+	Log []suid.KSUID
+
+	// Tombstone is the keys whose tombstone was purged
+	Tombstone []string
+}
+
+// DefaultOrphanExpiration is the minimum age of the orphans to be removed if it is not specified
+const DefaultOrphanExpiration = time.Hour
+
+// orphanBatchSize is the number of orphans removed in one transaction
+const orphanBatchSize = 100
+
+func isExpired(id suid.KSUID, expiration time.Duration, now time.Time) bool {
+	return now.Sub(id.Time()) >= expiration
+}
+
+type gc struct {
+	ins              *instance
+	storage          storage.Interface
+	stateOperation   OperateInterface
+	dataSetOperation OperateInterface
+	customOperation  OperateInterface
+	tmpOperation     OperateInterface
+	digestOperation  OperateInterface
+	tombstone        *tombstones
+}
+
+func newGC(ins *instance) *gc {
+	insName, storage := ins.name, ins.storage
+	return &gc{
+		ins:              ins,
+		storage:          storage,
+		stateOperation:   newSpaceOperation(buildName(spaceStatePrefix, insName), storage),
+		dataSetOperation: newSpaceOperation(buildName(spaceDatasetPrefix, insName), storage),
+		customOperation:  newSpaceOperation(buildName(spaceRelatePrefix, insName), storage),
+		tmpOperation:     newSpaceOperation(buildName(spaceTmpPrefix, insName), storage),
+		digestOperation:  newSpaceOperation(buildName(spaceDigestPrefix, insName), storage),
+		tombstone:        newTombstones(insName, storage, ins.keyFunc),
+	}
+}
+
+func (g *gc) run(ctx context.Context, opts GCOptions) (*GCResult, error) {
+	result := new(GCResult)
+	now := time.Now()
+
+	if err := g.sweepTmp(ctx, opts, now, result); err != nil {
+		return result, err
+	}
+	if !opts.KeepRelates {
+		if err := g.sweepRelate(ctx, result); err != nil {
+			return result, err
+		}
+	}
+	if err := g.trimLogs(ctx, result); err != nil {
+		return result, err
+	}
+	if !opts.KeepTombstones {
+		if err := g.sweepTombstones(ctx, opts, now, result); err != nil {
+			return result, err
+		}
+	}
+	if opts.KeepOrphans {
+		return result, nil
+	}
+	return result, g.sweepOrphans(ctx, opts, now, result)
+}
+
+// sweepTmp removes the expired data left in the tmp space by the aborted synchronization.
+// It is serialized with synchronization, which reads back the data it has just written.
+func (g *gc) sweepTmp(ctx context.Context, opts GCOptions, now time.Time, result *GCResult) error {
+	g.ins.dataSet.mux.Lock()
+	defer g.ins.dataSet.mux.Unlock()
+
+	var expired []suid.KSUID
+	err := g.tmpOperation.Range(ctx, func(key, value []byte) error {
+		id, err := suid.ParseKSUID(string(key))
+		if err != nil {
+			// Not written by dsync, leave it alone.
+			return nil
+		}
+		if written, _ := decodeTmp(id, value); now.Sub(written) >= opts.TmpExpiration {
+			expired = append(expired, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range expired {
+		err := g.storage.Update(ctx, func(txn storage.Txn) error {
+			if err := g.tombstone.pendingOperation.WithTxn(txn).Del(ctx, id.String()); err != nil {
+				return err
+			}
+			return g.tmpOperation.WithTxn(txn).Del(ctx, id.String())
+		})
+		if err != nil {
+			return err
+		}
+		result.Tmp = append(result.Tmp, id)
+	}
+	return nil
+}
+
+// sweepRelate removes the association relationships pointing at missing data.
+func (g *gc) sweepRelate(ctx context.Context, result *GCResult) error {
+	relates := make(map[string]string)
+	err := g.customOperation.Range(ctx, func(key, value []byte) error {
+		relates[string(key)] = string(value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for custom, id := range relates {
+		var removed bool
+		err := g.storage.Update(ctx, func(txn storage.Txn) error {
+			removed = false
+			customOperation := g.customOperation.WithTxn(txn)
+			// Check again in the transaction, the relationship may have been updated.
+			current, err := customOperation.Get(ctx, custom)
+			if err != nil {
+				return err
+			}
+			if string(current) != id {
+				return nil
+			}
+			value, err := g.dataSetOperation.WithTxn(txn).Get(ctx, id)
+			if err != nil || value != nil {
+				return err
+			}
+			removed = true
+			ksuid, err := suid.ParseKSUID(id)
+			if err != nil {
+				return err
+			}
+			if err := g.ins.indexer().remove(ctx, txn, suid.NewWithCustom(ksuid, custom)); err != nil {
+				return err
+			}
+			return customOperation.Del(ctx, custom)
+		})
+		if err != nil {
+			return err
+		}
+		if removed {
+			result.Relate = append(result.Relate, custom)
+		}
+	}
+	return nil
+}
+
+// trimLogs removes the UIDs synchronized by all members from the subscription logs.
+func (g *gc) trimLogs(ctx context.Context, result *GCResult) error {
+	subscriptions, err := g.ins.Subscriptions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range subscriptions {
+		trimmed, err := g.ins.Subscription(name).Trim(ctx)
+		if err != nil {
+			return err
+		}
+		result.Log = append(result.Log, trimmed...)
+	}
+	return nil
+}
+
+// references collects the KSUIDs referenced by the state, the association relationships,
+// all syncers and all subscription logs.
+func (g *gc) references(ctx context.Context, txn storage.Txn) (map[suid.KSUID]struct{}, error) {
+	refs, err := g.pending(ctx, txn)
+	if err != nil {
+		return nil, err
+	}
+	state, err := g.stateOperation.WithTxn(txn).Get(ctx, keyState)
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		refs[suid.UID(state).KSUID()] = struct{}{}
+	}
+
+	err = g.customOperation.WithTxn(txn).Range(ctx, func(_, value []byte) error {
+		id, err := suid.ParseKSUID(string(value))
+		if err != nil {
+			return nil
+		}
+		refs[id] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// pending collects the KSUIDs waiting to be synchronized by any syncer or in any subscription log.
+func (g *gc) pending(ctx context.Context, txn storage.Txn) (map[suid.KSUID]struct{}, error) {
+	refs := make(map[suid.KSUID]struct{})
+	syncers, err := g.ins.syncerOperation.Names(ctx, txn)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range syncers {
+		err := g.ins.syncerOperation.Range(ctx, txn, name, suid.Nil, func(uid suid.UID) error {
+			refs[uid.KSUID()] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var subscriptions []string
+	err = txn.Range(ctx, buildName(spaceSubscriptionPrefix, g.ins.name), func(key, _ []byte) error {
+		subscriptions = append(subscriptions, string(key))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range subscriptions {
+		logOperation := newSpaceOperation(buildName(spaceLogPrefix, g.ins.name, name), txn)
+		err := logOperation.Range(ctx, func(key, _ []byte) error {
+			id, err := suid.ParseKSUID(string(key))
+			if err != nil {
+				return nil
+			}
+			refs[id] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// sweepTombstones purges the expired tombstones that every syncer has passed,
+// together with the delete markers in the dataset and the association relationships pointing at them.
+func (g *gc) sweepTombstones(ctx context.Context, opts GCOptions, now time.Time, result *GCResult) error {
+	pending, err := g.pending(ctx, g.storage)
+	if err != nil {
+		return err
+	}
+
+	tombstones := make(map[string]suid.UID)
+	err = g.tombstone.tombstoneOperation.Range(ctx, func(key, value []byte) error {
+		uid := suid.UID(value)
+		if _, ok := pending[uid.KSUID()]; ok {
+			return nil
+		}
+		if isExpired(uid.KSUID(), opts.TombstoneExpiration, now) {
+			tombstones[string(key)] = uid
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, uid := range tombstones {
+		var removed bool
+		err := g.storage.Update(ctx, func(txn storage.Txn) error {
+			removed = false
+			tombstoneOperation := g.tombstone.tombstoneOperation.WithTxn(txn)
+			// Check again in the transaction, the key may have been recreated or deleted again.
+			current, err := g.tombstone.get(ctx, tombstoneOperation, key)
+			if err != nil {
+				return err
+			}
+			if current == nil || current.KSUID() != uid.KSUID() {
+				return nil
+			}
+			removed = true
+			id := uid.KSUID().String()
+			custom := uid.CustomUID()
+			customOperation := g.customOperation.WithTxn(txn)
+			relate, err := customOperation.Get(ctx, custom)
+			if err != nil {
+				return err
+			}
+			if string(relate) == id {
+				if err := g.ins.indexer().remove(ctx, txn, uid); err != nil {
+					return err
+				}
+				if err := customOperation.Del(ctx, custom); err != nil {
+					return err
+				}
+			}
+			if err := g.digestOperation.WithTxn(txn).Del(ctx, id); err != nil {
+				return err
+			}
+			if err := g.dataSetOperation.WithTxn(txn).Del(ctx, id); err != nil {
+				return err
+			}
+			return tombstoneOperation.Del(ctx, key)
+		})
+		if err != nil {
+			return err
+		}
+		if removed {
+			result.Tombstone = append(result.Tombstone, key)
+		}
+	}
+	return nil
+}
+
+// sweepOrphans removes the expired data in the dataset that is no longer referenced.
+// The references are collected once after the expired data, and the sweep is serialized with
+// synchronization, snapshot installation and reverting, which store the data again with its existing KSUID.
+func (g *gc) sweepOrphans(ctx context.Context, opts GCOptions, now time.Time, result *GCResult) error {
+	expiration := opts.OrphanExpiration
+	if expiration <= 0 {
+		expiration = DefaultOrphanExpiration
+	}
+	g.ins.dataSet.mux.Lock()
+	defer g.ins.dataSet.mux.Unlock()
+
+	var expired []suid.KSUID
+	err := g.dataSetOperation.Range(ctx, func(key, _ []byte) error {
+		id, err := suid.ParseKSUID(string(key))
+		if err != nil {
+			return nil
+		}
+		if isExpired(id, expiration, now) {
+			expired = append(expired, id)
+		}
+		return nil
+	})
+	if err != nil || len(expired) == 0 {
+		return err
+	}
+
+	// The references are read in one transaction, so that they are consistent with each other.
+	var refs map[suid.KSUID]struct{}
+	err = g.storage.Update(ctx, func(txn storage.Txn) error {
+		var err error
+		refs, err = g.references(ctx, txn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	var orphans []suid.KSUID
+	for _, id := range expired {
+		if _, ok := refs[id]; !ok {
+			orphans = append(orphans, id)
+		}
+	}
+
+	for len(orphans) > 0 {
+		batch := orphans
+		if len(batch) > orphanBatchSize {
+			batch = batch[:orphanBatchSize]
+		}
+		orphans = orphans[len(batch):]
+
+		var removed []suid.KSUID
+		err := g.storage.Update(ctx, func(txn storage.Txn) error {
+			removed = removed[:0]
+			for _, id := range batch {
+				if err := g.digestOperation.WithTxn(txn).Del(ctx, id.String()); err != nil {
+					return err
+				}
+				if err := g.dataSetOperation.WithTxn(txn).Del(ctx, id.String()); err != nil {
+					return err
+				}
+				removed = append(removed, id)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		result.Dataset = append(result.Dataset, removed...)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
+
+	"github.com/segmentio/ksuid"
+)
+
+func newKSUIDWithTime(t *testing.T, tm time.Time) suid.KSUID {
+	id, err := ksuid.NewRandomWithTime(tm)
+	if err != nil {
+		t.Fatalf("NewRandomWithTime() error = %v", err)
+	}
+	return id
+}
+
+func newOldKSUID(t *testing.T) suid.KSUID {
+	return newKSUIDWithTime(t, time.Now().Add(-2*time.Hour))
+}
+
+func newFutureKSUID(t *testing.T) suid.KSUID {
+	return newKSUIDWithTime(t, time.Now().Add(time.Hour))
+}
+
+func TestInstance_GC(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+	ins, err := New(WithStorageOption(s))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	var (
+		tmpOld     = newOldKSUID(t)
+		tmpNew     = suid.NewKSUID()
+		dangling   = newOldKSUID(t)
+		orphan     = newOldKSUID(t)
+		orphanNew  = suid.NewKSUID()
+		synced     = newOldKSUID(t)
+		relatedUID = suid.NewWithCustom(newOldKSUID(t), "related")
+	)
+	_ = s.Add(ctx, buildName(spaceTmpPrefix), tmpOld.String(), []byte("tmp"))
+	_ = s.Add(ctx, buildName(spaceTmpPrefix), tmpNew.String(), []byte("tmp"))
+	_ = s.Add(ctx, buildName(spaceRelatePrefix), "dangling", []byte(dangling.String()))
+	_ = s.Add(ctx, buildName(spaceDatasetPrefix), orphan.String(), []byte("orphan"))
+	_ = s.Add(ctx, buildName(spaceDatasetPrefix), orphanNew.String(), []byte("orphan"))
+	_ = s.Add(ctx, buildName(spaceDatasetPrefix), synced.String(), []byte("synced"))
+	if err := ins.DataSet().Add(ctx, Item{UID: relatedUID, Value: []byte("related")}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := ins.Syncer("node").Add(ctx, suid.NewWithCustom(synced, "")); err != nil {
+		t.Fatalf("Syncer.Add() error = %v", err)
+	}
+
+	result, err := ins.GC(ctx, GCOptions{TmpExpiration: time.Hour, OrphanExpiration: time.Hour})
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	if len(result.Tmp) != 1 || result.Tmp[0] != tmpOld {
+		t.Errorf("GC() removed tmp %v, want [%s]", result.Tmp, tmpOld)
+	}
+	if len(result.Relate) != 1 || result.Relate[0] != "dangling" {
+		t.Errorf("GC() removed relate %v, want [dangling]", result.Relate)
+	}
+	if len(result.Dataset) != 1 || result.Dataset[0] != orphan {
+		t.Errorf("GC() removed dataset %v, want [%s]", result.Dataset, orphan)
+	}
+
+	for _, id := range []suid.KSUID{orphanNew, synced, relatedUID.KSUID()} {
+		if value, _ := s.Get(ctx, buildName(spaceDatasetPrefix), id.String()); value == nil {
+			t.Errorf("data %s should be retained", id)
+		}
+	}
+}
+
+func TestInstance_GCTmpWriteTime(t *testing.T) {
+	ctx := context.Background()
+	server := newTestInstance(t)
+	agent := newTestInstance(t)
+
+	// The items were added long ago, but they are written to the tmp space just now.
+	items := []Item{
+		{UID: suid.NewWithCustom(newKSUIDWithTime(t, time.Now().Add(-3*time.Hour)), "a"), Value: []byte("a")},
+		{UID: suid.NewWithCustom(newOldKSUID(t), "b"), Value: []byte("b")},
+	}
+	for _, item := range items {
+		if err := server.DataSet().Add(ctx, item); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		if err := server.Syncer("node").Add(ctx, item.UID); err != nil {
+			t.Fatalf("Syncer.Add() error = %v", err)
+		}
+	}
+	manifest, err := server.Syncer("node").Manifest(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	data, err := server.Syncer("node").Data(ctx, manifest)
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	agent.DataSet().SyncManifest(ctx, manifest)
+	if err := agent.DataSet().Sync(ctx, data[1:], nil); err != ErrDataNotMatch {
+		t.Fatalf("Sync() error = %v, want %v", err, ErrDataNotMatch)
+	}
+
+	result, err := agent.GC(ctx, GCOptions{TmpExpiration: time.Hour, KeepOrphans: true})
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	if len(result.Tmp) != 0 {
+		t.Errorf("GC() removed tmp %v, want none", result.Tmp)
+	}
+	if err := agent.DataSet().Sync(ctx, data[:1], nil); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if got, want := agent.DataSet().State(ctx).CustomUID(), "b"; got != want {
+		t.Errorf("State() = %v, want %v", got, want)
+	}
+}
+
+func TestInstance_GCOrphanBatches(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+	ins, err := New(WithStorageOption(s))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	referenced := newOldKSUID(t)
+	if err := ins.Syncer("node").Add(ctx, suid.NewWithCustom(referenced, "")); err != nil {
+		t.Fatalf("Syncer.Add() error = %v", err)
+	}
+	_ = s.Add(ctx, buildName(spaceDatasetPrefix), referenced.String(), []byte("value"))
+	count := 2*orphanBatchSize + 1
+	for i := 0; i < count; i++ {
+		_ = s.Add(ctx, buildName(spaceDatasetPrefix), newOldKSUID(t).String(), []byte("value"))
+	}
+
+	result, err := ins.GC(ctx, GCOptions{})
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	if len(result.Dataset) != count {
+		t.Errorf("GC() removed %d orphans, want %d", len(result.Dataset), count)
+	}
+	if n := countSpace(t, s, buildName(spaceDatasetPrefix)); n != 1 {
+		t.Errorf("dataset has %d keys after GC(), want 1", n)
+	}
+}
+
+// racingStorage calls race once before the first transaction, like a concurrent writer.
+type racingStorage struct {
+	storage.Interface
+	race func()
+}
+
+func (s *racingStorage) Update(ctx context.Context, fn func(txn storage.Txn) error) error {
+	if race := s.race; race != nil {
+		s.race = nil
+		race()
+	}
+	return s.Interface.Update(ctx, fn)
+}
+
+func TestInstance_GCOrphanReferenced(t *testing.T) {
+	ctx := context.Background()
+	s := &racingStorage{Interface: newTestStorage(t)}
+	ins, err := New(WithStorageOption(s))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	var (
+		referenced = newOldKSUID(t)
+		orphan     = newOldKSUID(t)
+		recent     = newKSUIDWithTime(t, time.Now().Add(-time.Minute))
+	)
+	for _, id := range []suid.KSUID{referenced, orphan, recent} {
+		_ = s.Add(ctx, buildName(spaceDatasetPrefix), id.String(), []byte("value"))
+	}
+	// The data is referenced after the orphans are collected, but before they are removed.
+	s.race = func() {
+		_ = s.Interface.Add(ctx, buildName(spaceRelatePrefix), "custom", []byte(referenced.String()))
+	}
+
+	// The recent data is kept by the default expiration.
+	result, err := ins.GC(ctx, GCOptions{KeepRelates: true})
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	if len(result.Dataset) != 1 || result.Dataset[0] != orphan {
+		t.Errorf("GC() removed dataset %v, want [%s]", result.Dataset, orphan)
+	}
+	for _, id := range []suid.KSUID{referenced, recent} {
+		if value, _ := s.Get(ctx, buildName(spaceDatasetPrefix), id.String()); value == nil {
+			t.Errorf("data %s should be retained", id)
+		}
+	}
+}
+
+func TestInstance_Clear(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+	ins, err := New(
+		WithStorageOption(s),
+		WithIndexersOption(testIndexers),
+		WithCompactOption(testKeyFunc),
+		WithHistoryOption(3),
+	)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := ins.Subscription("sub").Bind(ctx, "a"); err != nil {
+		t.Fatalf("Bind() error = %v", err)
+	}
+	tombstone := newTestObjectItem(t, "pod/b,1", "node1", nil)
+	tombstone.Tombstone = true
+	if err := ins.Publish(ctx, []string{"sub"}, newTestObjectItem(t, "pod/a,1", "node1", nil), tombstone); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if err := ins.Syncer("b").Add(ctx, ins.DataSet().State(ctx)); err != nil {
+		t.Fatalf("Syncer.Add() error = %v", err)
+	}
+	if _, err := ins.Syncer("a").Manifest(ctx, ins.DataSet().State(ctx), 0); err != nil && err != ErrEmptyManifest {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+
+	spaces, err := ins.Spaces(ctx)
+	if err != nil {
+		t.Fatalf("Spaces() error = %v", err)
+	}
+	if err := ins.Clear(ctx); err != nil {
+		t.Fatalf("Clear() error = %v", err)
+	}
+	for _, space := range spaces {
+		if n := countSpace(t, s, space); n != 0 {
+			t.Errorf("space %s has %d keys after Clear(), want 0", space, n)
+		}
+	}
+	if state := ins.DataSet().State(ctx); !state.IsNil() {
+		t.Errorf("State() after Clear() = %s, want nil", state)
+	}
+}
@@ -4,7 +4,9 @@ go 1.17
 
 require (
 	github.com/dgraph-io/badger/v3 v3.2103.2
+	github.com/klauspost/compress v1.12.3
 	github.com/segmentio/ksuid v1.0.4
+	go.etcd.io/bbolt v1.3.6
 )
 
 require (
@@ -18,7 +20,6 @@ require (
 	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/golang/snappy v0.0.3 // indirect
 	github.com/google/flatbuffers v1.12.1 // indirect
-	github.com/klauspost/compress v1.12.3 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
 	go.opencensus.io v0.22.5 // indirect
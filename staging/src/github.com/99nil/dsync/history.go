@@ -0,0 +1,122 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
+)
+
+var ErrHistoryNotFound = errors.New("history not found")
+
+// historySep separates the key and the KSUID in the key of the history entry
+const historySep = "\x00"
+
+// history records the last versions of the items with custom UID,
+// the entries of the same key are ordered by KSUID in the history space.
+type history struct {
+	limit            int
+	keyFunc          KeyFunc
+	historyOperation OperateInterface
+}
+
+func newHistory(insName string, storage storage.Interface, keyFunc KeyFunc, limit int) *history {
+	return &history{
+		limit:            limit,
+		keyFunc:          keyFunc,
+		historyOperation: newSpaceOperation(buildName(spaceHistoryPrefix, insName), storage),
+	}
+}
+
+func (h *history) key(uid suid.UID) string {
+	return logicalKey(h.keyFunc, uid)
+}
+
+func historyPrefix(key string) string {
+	return key + historySep
+}
+
+// record adds the item to the history in the transaction, and removes the versions beyond the limit.
+func (h *history) record(ctx context.Context, txn storage.Txn, item Item) error {
+	if h.limit < 1 || !item.UID.IsCustom() {
+		return nil
+	}
+	key := h.key(item.UID)
+	op := h.historyOperation.WithTxn(txn)
+	if err := op.AddData(ctx, historyPrefix(key)+item.UID.KSUID().String(), item); err != nil {
+		return err
+	}
+
+	var keys []string
+	err := op.RangePrefix(ctx, historyPrefix(key), "", func(k, _ []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for len(keys) > h.limit {
+		if err := op.Del(ctx, keys[0]); err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
+
+// list returns the versions of the key from the oldest to the latest.
+func (h *history) list(ctx context.Context, op OperateInterface, key string) ([]Item, error) {
+	var items []Item
+	err := op.RangePrefix(ctx, historyPrefix(key), "", func(_, value []byte) error {
+		var item Item
+		if err := json.Unmarshal(value, &item); err != nil {
+			return err
+		}
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+// get returns the version of the key, a nil uid means the version before the latest.
+func (h *history) get(ctx context.Context, op OperateInterface, key string, uid suid.UID) (*Item, error) {
+	if uid.IsNil() {
+		items, err := h.list(ctx, op, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(items) < 2 {
+			return nil, ErrHistoryNotFound
+		}
+		return &items[len(items)-2], nil
+	}
+
+	value, err := op.Get(ctx, historyPrefix(key)+uid.KSUID().String())
+	if err != nil {
+		return nil, err
+	}
+	if len(value) == 0 {
+		return nil, ErrHistoryNotFound
+	}
+	var item Item
+	if err := json.Unmarshal(value, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
@@ -0,0 +1,123 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/99nil/dsync/suid"
+)
+
+func historyValues(t *testing.T, ds DataSet, key string) []string {
+	t.Helper()
+	items, err := ds.History(context.Background(), key)
+	if err != nil {
+		t.Fatalf("History(%s) error = %v", key, err)
+	}
+	var values []string
+	for _, item := range items {
+		values = append(values, string(item.Value))
+	}
+	return values
+}
+
+func TestDataSet_History(t *testing.T) {
+	ctx := context.Background()
+	ins := newTestInstance(t, WithCompactOption(testKeyFunc), WithHistoryOption(2))
+	ds := ins.DataSet()
+
+	for _, custom := range []string{"a,1", "b,1", "a,2", "a,3", "c"} {
+		if err := ds.Add(ctx, Item{UID: suid.NewByCustom(custom), Value: []byte(custom)}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if got, want := historyValues(t, ds, "a"), []string{"a,2", "a,3"}; !equalStrings(got, want) {
+		t.Errorf("History(a) = %v, want %v", got, want)
+	}
+	if got, want := historyValues(t, ds, "b"), []string{"b,1"}; !equalStrings(got, want) {
+		t.Errorf("History(b) = %v, want %v", got, want)
+	}
+	// The custom UID is the key if the KeyFunc returns nothing.
+	if got, want := historyValues(t, ds, "c"), []string{"c"}; !equalStrings(got, want) {
+		t.Errorf("History(c) = %v, want %v", got, want)
+	}
+
+	disabled := newTestInstance(t).DataSet()
+	if err := disabled.Add(ctx, Item{UID: suid.NewByCustom("a"), Value: []byte("a")}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if got := historyValues(t, disabled, "a"); len(got) != 0 {
+		t.Errorf("History(a) = %v, want empty when disabled", got)
+	}
+}
+
+func TestDataSet_Revert(t *testing.T) {
+	ctx := context.Background()
+	ins := newTestInstance(t, WithHistoryOption(3))
+	ds := ins.DataSet()
+
+	for _, value := range []string{"v1", "v2", "v3"} {
+		if err := ds.Add(ctx, Item{UID: suid.NewByCustom("custom"), Value: []byte(value)}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	state := ds.State(ctx)
+	history, err := ds.History(ctx, "custom")
+	if err != nil || len(history) != 3 {
+		t.Fatalf("History() = %v, %v, want 3 versions", history, err)
+	}
+
+	var replayed []string
+	callback := func(_ context.Context, item Item) error {
+		replayed = append(replayed, string(item.Value))
+		return nil
+	}
+	get := func() string {
+		t.Helper()
+		item, err := ds.Get(ctx, suid.NewByCustom("custom"))
+		if err != nil {
+			t.Fatalf("Get() error = %v", err)
+		}
+		return string(item.Value)
+	}
+
+	// A nil uid reverts to the version before the latest.
+	if err := ds.Revert(ctx, "custom", nil, callback); err != nil {
+		t.Fatalf("Revert() error = %v", err)
+	}
+	if got := get(); got != "v2" {
+		t.Errorf("Get() = %q after Revert(nil), want %q", got, "v2")
+	}
+	if err := ds.Revert(ctx, "custom", history[0].UID, callback); err != nil {
+		t.Fatalf("Revert() error = %v", err)
+	}
+	if got := get(); got != "v1" {
+		t.Errorf("Get() = %q after Revert(v1), want %q", got, "v1")
+	}
+	if want := []string{"v2", "v1"}; !equalStrings(replayed, want) {
+		t.Errorf("callback received %v, want %v", replayed, want)
+	}
+	if got := ds.State(ctx); got.String() != state.String() {
+		t.Errorf("State() = %s after Revert, want %s", got, state)
+	}
+
+	if err := ds.Revert(ctx, "custom", suid.New(), callback); err != ErrHistoryNotFound {
+		t.Errorf("Revert(unknown) error = %v, want %v", err, ErrHistoryNotFound)
+	}
+	if err := ds.Revert(ctx, "missing", nil, callback); err != ErrHistoryNotFound {
+		t.Errorf("Revert(missing) error = %v, want %v", err, ErrHistoryNotFound)
+	}
+}
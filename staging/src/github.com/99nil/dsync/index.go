@@ -0,0 +1,180 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
+)
+
+// IndexFunc computes the indexed values of the item, like cache.IndexFunc in client-go
+type IndexFunc func(item Item) ([]string, error)
+
+// Indexers maps the name of the index to the IndexFunc
+type Indexers map[string]IndexFunc
+
+// IndexErrorFunc is called when an IndexFunc fails, the item is then left unindexed,
+// so that a malformed item never blocks adding or synchronizing the others.
+type IndexErrorFunc func(item Item, name string, err error)
+
+// indexSep separates the name, the indexed value and the reference in the key of the index entry
+const indexSep = "\x00"
+
+// indexer maintains the index entries in the index space, the key of an entry is
+// name, value and the reference of the item, and the value of an entry is the UID.
+// The indexed UID and values of each reference are recorded in the indexed space, so that the entries can be removed.
+type indexer struct {
+	keyFunc          KeyFunc
+	indexers         Indexers
+	onError          IndexErrorFunc
+	indexOperation   OperateInterface
+	indexedOperation OperateInterface
+}
+
+// indexed is the record of the index entries of a reference
+type indexed struct {
+	UID    string              `json:"uid"`
+	Values map[string][]string `json:"values"`
+}
+
+func newIndexer(insName string, storage storage.Interface, keyFunc KeyFunc, indexers Indexers) *indexer {
+	return &indexer{
+		keyFunc:          keyFunc,
+		indexers:         indexers,
+		indexOperation:   newSpaceOperation(buildName(spaceIndexPrefix, insName), storage),
+		indexedOperation: newSpaceOperation(buildName(spaceIndexedPrefix, insName), storage),
+	}
+}
+
+// ref returns the reference of the item in the index,
+// the versions of an item share its logical key, so that only the latest one is indexed.
+func (x *indexer) ref(uid suid.UID) string {
+	if key := logicalKey(x.keyFunc, uid); key != "" {
+		return key
+	}
+	return uid.KSUID().String()
+}
+
+func indexPrefix(name, value string) string {
+	return name + indexSep + value + indexSep
+}
+
+// update replaces the index entries of the logical key of the item in the transaction,
+// the tombstone only removes them. The item is left unindexed if any IndexFunc fails.
+func (x *indexer) update(ctx context.Context, txn storage.Txn, item Item) error {
+	if len(x.indexers) == 0 {
+		return nil
+	}
+	ref := x.ref(item.UID)
+	if err := x.removeRef(ctx, txn, ref, nil); err != nil {
+		return err
+	}
+	if item.Tombstone {
+		return nil
+	}
+
+	values := make(map[string][]string, len(x.indexers))
+	for name, fn := range x.indexers {
+		result, err := fn(item)
+		if err != nil {
+			if x.onError != nil {
+				x.onError(item, name, fmt.Errorf("index %s of %s failed: %v", name, item.UID, err))
+			}
+			return nil
+		}
+		if len(result) > 0 {
+			values[name] = result
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	indexOperation := x.indexOperation.WithTxn(txn)
+	for name, result := range values {
+		for _, value := range result {
+			if err := indexOperation.Add(ctx, indexPrefix(name, value)+ref, item.UID); err != nil {
+				return err
+			}
+		}
+	}
+	return x.indexedOperation.WithTxn(txn).AddData(ctx, ref, indexed{UID: item.UID.String(), Values: values})
+}
+
+// isIndexed returns whether the index entries of the logical key of the uid are those of the uid.
+func (x *indexer) isIndexed(ctx context.Context, txn storage.Txn, uid suid.UID) (bool, error) {
+	if len(x.indexers) == 0 {
+		return false, nil
+	}
+	value, err := x.indexedOperation.WithTxn(txn).Get(ctx, x.ref(uid))
+	if err != nil || len(value) == 0 {
+		return false, err
+	}
+	var record indexed
+	if err := json.Unmarshal(value, &record); err != nil {
+		return false, err
+	}
+	return suid.UID(record.UID).KSUID() == uid.KSUID(), nil
+}
+
+// remove removes the index entries of the logical key of the uid in the transaction,
+// if they are still those of the uid rather than of a newer version.
+func (x *indexer) remove(ctx context.Context, txn storage.Txn, uid suid.UID) error {
+	return x.removeRef(ctx, txn, x.ref(uid), uid)
+}
+
+// removeRef removes the index entries of the reference in the transaction,
+// only if they are those of the uid when it is not nil.
+func (x *indexer) removeRef(ctx context.Context, txn storage.Txn, ref string, uid suid.UID) error {
+	indexedOperation := x.indexedOperation.WithTxn(txn)
+	value, err := indexedOperation.Get(ctx, ref)
+	if err != nil || len(value) == 0 {
+		return err
+	}
+	var record indexed
+	if err := json.Unmarshal(value, &record); err != nil {
+		return err
+	}
+	if uid != nil && suid.UID(record.UID).KSUID() != uid.KSUID() {
+		return nil
+	}
+
+	indexOperation := x.indexOperation.WithTxn(txn)
+	for name, values := range record.Values {
+		for _, v := range values {
+			if err := indexOperation.Del(ctx, indexPrefix(name, v)+ref); err != nil {
+				return err
+			}
+		}
+	}
+	return indexedOperation.Del(ctx, ref)
+}
+
+// uids returns the UIDs of the items whose indexed values of the index contain the value.
+func (x *indexer) uids(ctx context.Context, name, value string) ([]suid.UID, error) {
+	if _, ok := x.indexers[name]; !ok {
+		return nil, fmt.Errorf("index with name %s does not exist", name)
+	}
+	var uids []suid.UID
+	err := x.indexOperation.RangePrefix(ctx, indexPrefix(name, value), "", func(_, value []byte) error {
+		uids = append(uids, value)
+		return nil
+	})
+	return uids, err
+}
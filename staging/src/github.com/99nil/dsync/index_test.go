@@ -0,0 +1,289 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/99nil/dsync/suid"
+)
+
+type testObject struct {
+	Labels   map[string]string `json:"labels"`
+	NodeName string            `json:"nodeName"`
+}
+
+var testIndexers = Indexers{
+	"label": func(item Item) ([]string, error) {
+		var obj testObject
+		if err := json.Unmarshal(item.Value, &obj); err != nil {
+			return nil, err
+		}
+		var values []string
+		for k, v := range obj.Labels {
+			values = append(values, k+"="+v)
+		}
+		return values, nil
+	},
+	"nodeName": func(item Item) ([]string, error) {
+		var obj testObject
+		if err := json.Unmarshal(item.Value, &obj); err != nil {
+			return nil, err
+		}
+		if obj.NodeName == "" {
+			return nil, nil
+		}
+		return []string{obj.NodeName}, nil
+	},
+}
+
+func newTestObjectItem(t *testing.T, custom, nodeName string, labels map[string]string) Item {
+	t.Helper()
+	b, err := json.Marshal(testObject{Labels: labels, NodeName: nodeName})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	return Item{UID: suid.NewByCustom(custom), Value: b}
+}
+
+func byIndex(t *testing.T, ds DataSet, name, value string) []string {
+	t.Helper()
+	items, err := ds.ByIndex(context.Background(), name, value)
+	if err != nil {
+		t.Fatalf("ByIndex(%s, %s) error = %v", name, value, err)
+	}
+	var customs []string
+	for _, item := range items {
+		customs = append(customs, item.UID.CustomUID())
+	}
+	sort.Strings(customs)
+	return customs
+}
+
+func TestDataSet_ByIndex(t *testing.T) {
+	ctx := context.Background()
+	ins := newTestInstance(t, WithIndexersOption(testIndexers))
+	ds := ins.DataSet()
+
+	items := []Item{
+		newTestObjectItem(t, "pod/a", "node1", map[string]string{"app": "web"}),
+		newTestObjectItem(t, "pod/b", "node2", map[string]string{"app": "web", "tier": "front"}),
+		newTestObjectItem(t, "pod/c", "node1", map[string]string{"app": "db"}),
+	}
+	if err := ds.Add(ctx, items...); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{name: "label", value: "app=web", want: []string{"pod/a", "pod/b"}},
+		{name: "label", value: "tier=front", want: []string{"pod/b"}},
+		{name: "label", value: "app=we", want: nil},
+		{name: "nodeName", value: "node1", want: []string{"pod/a", "pod/c"}},
+	}
+	for _, tt := range tests {
+		if got := byIndex(t, ds, tt.name, tt.value); !equalStrings(got, tt.want) {
+			t.Errorf("ByIndex(%s, %s) = %v, want %v", tt.name, tt.value, got, tt.want)
+		}
+	}
+	if _, err := ds.ByIndex(ctx, "missing", "value"); err == nil {
+		t.Error("ByIndex() of missing index should fail")
+	}
+
+	// The new version replaces the index entries of the old one.
+	if err := ds.Add(ctx, newTestObjectItem(t, "pod/a", "node2", map[string]string{"app": "db"})); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if got, want := byIndex(t, ds, "label", "app=web"), []string{"pod/b"}; !equalStrings(got, want) {
+		t.Errorf("ByIndex() after update = %v, want %v", got, want)
+	}
+	if got, want := byIndex(t, ds, "nodeName", "node2"), []string{"pod/a", "pod/b"}; !equalStrings(got, want) {
+		t.Errorf("ByIndex() after update = %v, want %v", got, want)
+	}
+	items, err := ds.ByIndex(ctx, "label", "app=db")
+	if err != nil {
+		t.Fatalf("ByIndex() error = %v", err)
+	}
+	for _, item := range items {
+		var obj testObject
+		if err := json.Unmarshal(item.Value, &obj); err != nil {
+			t.Fatalf("Unmarshal() error = %v", err)
+		}
+		if item.UID.CustomUID() == "pod/a" && obj.NodeName != "node2" {
+			t.Errorf("ByIndex() returned the old version of pod/a")
+		}
+	}
+
+	if err := ds.Del(ctx, suid.NewByCustom("pod/b")); err != nil {
+		t.Fatalf("Del() error = %v", err)
+	}
+	if got, want := byIndex(t, ds, "nodeName", "node2"), []string{"pod/a"}; !equalStrings(got, want) {
+		t.Errorf("ByIndex() after Del() = %v, want %v", got, want)
+	}
+}
+
+func TestDataSet_ByIndexLogicalKey(t *testing.T) {
+	ctx := context.Background()
+	ins := newTestInstance(t, WithIndexersOption(testIndexers), WithCompactOption(testKeyFunc))
+	ds := ins.DataSet()
+
+	// The versions of an object share its logical key.
+	for _, item := range []Item{
+		newTestObjectItem(t, "pod/a,1", "node1", nil),
+		newTestObjectItem(t, "pod/a,2", "node2", nil),
+		newTestObjectItem(t, "pod/b,1", "node2", nil),
+	} {
+		if err := ds.Add(ctx, item); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	if got := byIndex(t, ds, "nodeName", "node1"); len(got) != 0 {
+		t.Errorf("ByIndex() returned the old version %v", got)
+	}
+	if got, want := byIndex(t, ds, "nodeName", "node2"), []string{"pod/a,2", "pod/b,1"}; !equalStrings(got, want) {
+		t.Errorf("ByIndex() = %v, want %v", got, want)
+	}
+
+	// Deleting the old version keeps the entries of the latest one.
+	if err := ds.Del(ctx, suid.NewByCustom("pod/a,1")); err != nil {
+		t.Fatalf("Del() error = %v", err)
+	}
+	if got, want := byIndex(t, ds, "nodeName", "node2"), []string{"pod/a,2", "pod/b,1"}; !equalStrings(got, want) {
+		t.Errorf("ByIndex() after Del() = %v, want %v", got, want)
+	}
+
+	// The deleted object is not returned.
+	tombstone := newTestObjectItem(t, "pod/a,3", "node2", nil)
+	tombstone.Tombstone = true
+	if err := ds.Add(ctx, tombstone); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if got, want := byIndex(t, ds, "nodeName", "node2"), []string{"pod/b,1"}; !equalStrings(got, want) {
+		t.Errorf("ByIndex() after tombstone = %v, want %v", got, want)
+	}
+}
+
+func TestDataSet_ByIndexSync(t *testing.T) {
+	ctx := context.Background()
+	server := newTestInstance(t)
+	agent := newTestInstance(t, WithIndexersOption(testIndexers))
+
+	for i := 0; i < 3; i++ {
+		item := newTestObjectItem(t, fmt.Sprintf("pod/%d", i), fmt.Sprintf("node%d", i%2), nil)
+		if err := server.DataSet().Add(ctx, item); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	snapshot, err := server.Syncer("node").Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	if err := agent.DataSet().InstallSnapshotAndDelete(ctx, snapshot, nil); err != nil {
+		t.Fatalf("InstallSnapshotAndDelete() error = %v", err)
+	}
+	if got, want := byIndex(t, agent.DataSet(), "nodeName", "node0"), []string{"pod/0", "pod/2"}; !equalStrings(got, want) {
+		t.Errorf("ByIndex() after snapshot = %v, want %v", got, want)
+	}
+
+	item := newTestObjectItem(t, "pod/3", "node0", nil)
+	if err := server.DataSet().Add(ctx, item); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := server.Syncer("node").Add(ctx, item.UID); err != nil {
+		t.Fatalf("Syncer.Add() error = %v", err)
+	}
+	manifest, err := server.Syncer("node").Manifest(ctx, agent.DataSet().State(ctx), 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	items, err := server.Syncer("node").Data(ctx, manifest)
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	agent.DataSet().SyncManifest(ctx, manifest)
+	if err := agent.DataSet().SyncAndDelete(ctx, items, nil); err != nil {
+		t.Fatalf("SyncAndDelete() error = %v", err)
+	}
+
+	// The values of the indexed items are kept after synchronization and GC.
+	if _, err := agent.GC(ctx, GCOptions{}); err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	if got, want := byIndex(t, agent.DataSet(), "nodeName", "node0"), []string{"pod/0", "pod/2", "pod/3"}; !equalStrings(got, want) {
+		t.Errorf("ByIndex() after GC = %v, want %v", got, want)
+	}
+	items, err = agent.DataSet().ByIndex(ctx, "nodeName", "node0")
+	if err != nil {
+		t.Fatalf("ByIndex() error = %v", err)
+	}
+	for _, item := range items {
+		if item.Value == nil {
+			t.Errorf("ByIndex() returned %s without value", item.UID)
+		}
+	}
+}
+
+func TestDataSet_ByIndexMalformed(t *testing.T) {
+	ctx := context.Background()
+	server := newTestInstance(t)
+	var failed []string
+	agent := newTestInstance(t, WithIndexersOption(testIndexers), WithIndexErrorOption(func(item Item, name string, err error) {
+		failed = append(failed, item.UID.CustomUID())
+	}))
+
+	// The malformed item sits between the good items.
+	items := []Item{
+		newTestObjectItem(t, "pod/0", "node0", nil),
+		{UID: suid.NewByCustom("pod/1"), Value: []byte("malformed")},
+		newTestObjectItem(t, "pod/2", "node0", nil),
+	}
+	for _, item := range items {
+		if err := server.DataSet().Add(ctx, item); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		if err := server.Syncer("node").Add(ctx, item.UID); err != nil {
+			t.Fatalf("Syncer.Add() error = %v", err)
+		}
+	}
+	manifest, err := server.Syncer("node").Manifest(ctx, agent.DataSet().State(ctx), 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	data, err := server.Syncer("node").Data(ctx, manifest)
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	agent.DataSet().SyncManifest(ctx, manifest)
+	if err := agent.DataSet().SyncAndDelete(ctx, data, nil); err != nil {
+		t.Fatalf("SyncAndDelete() error = %v", err)
+	}
+
+	if got, want := agent.DataSet().State(ctx).CustomUID(), "pod/2"; got != want {
+		t.Errorf("State() = %v, want %v", got, want)
+	}
+	if got, want := byIndex(t, agent.DataSet(), "nodeName", "node0"), []string{"pod/0", "pod/2"}; !equalStrings(got, want) {
+		t.Errorf("ByIndex() = %v, want %v", got, want)
+	}
+	if len(failed) == 0 || failed[0] != "pod/1" {
+		t.Errorf("index errors = %v, want pod/1", failed)
+	}
+}
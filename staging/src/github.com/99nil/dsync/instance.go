@@ -16,10 +16,14 @@ package dsync
 
 import (
 	"context"
+	"crypto/ed25519"
 	"errors"
 	"fmt"
+	"sync"
 
+	"github.com/99nil/dsync/operation"
 	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
 )
 
 func New(opts ...Option) (Interface, error) {
@@ -27,7 +31,18 @@ func New(opts ...Option) (Interface, error) {
 	if ins.storage == nil {
 		return nil, errors.New("dsync storage must exist")
 	}
-	ins.dataSet = newDataSet(ins.name, ins.storage)
+	syncerOperation, err := ins.syncerFactory(buildName(spaceSyncerPrefix, ins.name))
+	if err != nil {
+		return nil, err
+	}
+	ins.syncerOperation = syncerOperation
+	ds := newDataSet(ins.name, ins.storage, ins.generator, ins.indexers)
+	ds.history = newHistory(ins.name, ins.storage, ins.keyFunc, ins.historyLimit)
+	ds.tombstone = newTombstones(ins.name, ins.storage, ins.keyFunc)
+	ds.indexer = ins.indexer()
+	ds.retry = ins.retry
+	ds.delivery = ins.delivery
+	ins.dataSet = ds
 	return ins, nil
 }
 
@@ -45,14 +60,100 @@ func WithNameOption(name string) Option {
 	}
 }
 
+// WithGeneratorOption sets the generator of the KSUIDs assigned to the items added to the dataset
+func WithGeneratorOption(generator suid.Generator) Option {
+	return func(i *instance) {
+		i.generator = generator
+	}
+}
+
+// WithCompactOption sets the function to extract the logical key of the UIDs,
+// the superseded versions of the same key are compacted in the manifests of the syncers.
+func WithCompactOption(keyFunc KeyFunc) Option {
+	return func(i *instance) {
+		i.keyFunc = keyFunc
+	}
+}
+
+// WithIndexersOption sets the indexers of the dataset
+func WithIndexersOption(indexers Indexers) Option {
+	return func(i *instance) {
+		i.indexers = indexers
+	}
+}
+
+// WithIndexErrorOption sets the function called when an IndexFunc fails,
+// the item is left unindexed and the error is otherwise ignored.
+func WithIndexErrorOption(fn IndexErrorFunc) Option {
+	return func(i *instance) {
+		i.indexError = fn
+	}
+}
+
+// WithHistoryOption keeps the last limit versions of each key in the history of the dataset,
+// the key is extracted by the KeyFunc set with WithCompactOption, otherwise it is the custom UID.
+func WithHistoryOption(limit int) Option {
+	return func(i *instance) {
+		i.historyLimit = limit
+	}
+}
+
+// WithSignerOption signs the items served by the syncers with the ed25519 private key,
+// so that the receivers can verify that they come from this instance through any relay.
+func WithSignerOption(key ed25519.PrivateKey) Option {
+	return func(i *instance) {
+		i.signer = key
+	}
+}
+
+// WithRetryOption sets the retry policy of the failed callbacks during synchronization,
+// the items which keep failing are parked in the dead-letter space.
+func WithRetryOption(policy RetryPolicy) Option {
+	return func(i *instance) {
+		i.retry = policy
+	}
+}
+
+// WithSyncerOption sets the factory of the strategy storing the UIDs waiting to be synchronized by the syncers,
+// it defaults to operation.NewManifestSyncer. The strategy must not be changed for the existing data.
+func WithSyncerOption(factory operation.SyncerFactory) Option {
+	return func(i *instance) {
+		i.syncerFactory = factory
+	}
+}
+
+// WithDeliveryOption sets when the synchronized items are delivered to the callback
+func WithDeliveryOption(mode DeliveryMode) Option {
+	return func(i *instance) {
+		i.delivery = mode
+	}
+}
+
 type instance struct {
-	name    string
-	storage storage.Interface
-	dataSet DataSet
+	name            string
+	storage         storage.Interface
+	generator       suid.Generator
+	keyFunc         KeyFunc
+	indexers        Indexers
+	indexError      IndexErrorFunc
+	historyLimit    int
+	signer          ed25519.PrivateKey
+	retry           RetryPolicy
+	delivery        DeliveryMode
+	notifier        *notifier
+	syncerFactory   operation.SyncerFactory
+	syncerOperation operation.SyncerOperation
+	dataSet         *dataSet
+	// appendMux serializes the appends to the subscription logs
+	appendMux sync.Mutex
 }
 
 func newInstance(opts ...Option) *instance {
-	ins := &instance{}
+	ins := &instance{
+		generator:     suid.NewMonotonicGenerator(),
+		notifier:      newNotifier(),
+		syncerFactory: operation.NewManifestSyncer,
+	}
 	for _, opt := range opts {
 		opt(ins)
 	}
@@ -63,26 +164,128 @@ func (i *instance) DataSet() DataSet {
 	return i.dataSet
 }
 
+func (i *instance) indexer() *indexer {
+	x := newIndexer(i.name, i.storage, i.keyFunc, i.indexers)
+	x.onError = i.indexError
+	return x
+}
+
 func (i *instance) Syncer(name string) Synchronizer {
-	return newSyncer(i.name, name, i.storage)
+	return newSyncer(i.name, name, i.storage, i.notifier, i.keyFunc, i.signer, i.syncerOperation)
 }
 
-func (i *instance) Clear(ctx context.Context) error {
-	var str string
-	if err := i.storage.Clear(ctx, buildName(spaceDatasetPrefix, i.name)); err != nil {
-		str += fmt.Sprintf("clear dataset failed: %v\n", err)
+func (i *instance) Syncers(ctx context.Context) ([]string, error) {
+	return i.syncerOperation.Names(ctx, i.storage)
+}
+
+func (i *instance) RemoveSyncer(ctx context.Context, name string) error {
+	bindingOperation := newSpaceOperation(buildName(spaceBindingPrefix, i.name), i.storage)
+	return i.storage.Update(ctx, func(txn storage.Txn) error {
+		bindings, err := getBindings(ctx, bindingOperation.WithTxn(txn), name)
+		if err != nil {
+			return err
+		}
+		for _, subscription := range bindings {
+			if err := newSubscription(i.name, subscription, i.storage, i.notifier, &i.appendMux).unbind(ctx, txn, name); err != nil {
+				return err
+			}
+		}
+		if err := txn.Del(ctx, buildName(spaceCursorPrefix, i.name), name); err != nil {
+			return err
+		}
+		return i.syncerOperation.Remove(ctx, txn, name)
+	})
+}
+
+func (i *instance) Subscription(name string) Subscription {
+	return newSubscription(i.name, name, i.storage, i.notifier, &i.appendMux)
+}
+
+func (i *instance) Publish(ctx context.Context, subscriptions []string, items ...Item) error {
+	i.appendMux.Lock()
+	defer i.appendMux.Unlock()
+
+	for _, item := range items {
+		// The KSUID is assigned in the same transaction as the appends,
+		// so the logs are appended in ascending order of KSUID.
+		var uid, state suid.UID
+		err := i.storage.Update(ctx, func(txn storage.Txn) error {
+			if err := i.dataSet.ensureEpoch(ctx, txn); err != nil {
+				return err
+			}
+			var err error
+			if uid, state, err = i.dataSet.add(ctx, txn, item); err != nil {
+				return err
+			}
+			for _, name := range subscriptions {
+				if err := newSubscription(i.name, name, i.storage, i.notifier, &i.appendMux).append(ctx, txn, uid); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		i.dataSet.advanceState(state)
+
+		for _, name := range subscriptions {
+			if err := newSubscription(i.name, name, i.storage, i.notifier, &i.appendMux).notify(ctx, uid); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (i *instance) Subscriptions(ctx context.Context) ([]string, error) {
+	var names []string
+	err := i.storage.Range(ctx, buildName(spaceSubscriptionPrefix, i.name), func(key, _ []byte) error {
+		names = append(names, string(key))
+		return nil
+	})
+	return names, err
+}
+
+func (i *instance) Spaces(ctx context.Context) ([]string, error) {
+	subscriptions, err := i.Subscriptions(ctx)
+	if err != nil {
+		return nil, err
 	}
-	if err := i.storage.Clear(ctx, buildName(spaceSyncerPrefix, i.name)); err != nil {
-		str += fmt.Sprintf("clear syncer failed: %v\n", err)
+	prefixes := []string{
+		spaceStatePrefix, spaceDatasetPrefix, spaceSyncerPrefix, spaceRelatePrefix, spaceTmpPrefix,
+		spaceSubscriptionPrefix, spaceBindingPrefix, spaceCursorPrefix,
+		spaceIndexPrefix, spaceIndexedPrefix, spaceHistoryPrefix, spaceDigestPrefix, spaceDeadLetterPrefix, spaceDeliveredPrefix,
+		spaceTombstonePrefix, spaceTmpTombstonePrefix,
 	}
-	if err := i.storage.Clear(ctx, buildName(spaceRelatePrefix, i.name)); err != nil {
-		str += fmt.Sprintf("clear relate failed: %v\n", err)
+	spaces := make([]string, 0, len(prefixes)+2*len(subscriptions))
+	for _, space := range prefixes {
+		spaces = append(spaces, buildName(space, i.name))
 	}
-	if err := i.storage.Clear(ctx, buildName(spaceTmpPrefix, i.name)); err != nil {
-		str += fmt.Sprintf("clear tmp failed: %v\n", err)
+	for _, name := range subscriptions {
+		spaces = append(spaces, buildName(spaceLogPrefix, i.name, name), buildName(spaceMemberPrefix, i.name, name))
 	}
+	return spaces, nil
+}
+
+func (i *instance) Clear(ctx context.Context) error {
+	spaces, err := i.Spaces(ctx)
+	if err != nil {
+		return err
+	}
+	var str string
+	for _, space := range spaces {
+		if err := i.storage.Clear(ctx, space); err != nil {
+			str += fmt.Sprintf("clear %s failed: %v\n", space, err)
+		}
+	}
+	i.dataSet.reset()
 	if len(str) > 0 {
 		return errors.New(str)
 	}
 	return nil
 }
+
+func (i *instance) GC(ctx context.Context, opts GCOptions) (*GCResult, error) {
+	return newGC(i).run(ctx, opts)
+}
@@ -0,0 +1,83 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"sync"
+
+	"github.com/99nil/dsync/suid"
+)
+
+// watchBufferSize is the buffer size of each watch channel
+const watchBufferSize = 100
+
+// notifier dispatches the UIDs added to the syncers to their watchers
+type notifier struct {
+	mux      sync.Mutex
+	watchers map[string]map[chan suid.UID]struct{}
+}
+
+func newNotifier() *notifier {
+	return &notifier{watchers: make(map[string]map[chan suid.UID]struct{})}
+}
+
+func (n *notifier) watch(ctx context.Context, name string) <-chan suid.UID {
+	ch := make(chan suid.UID, watchBufferSize)
+
+	n.mux.Lock()
+	set, ok := n.watchers[name]
+	if !ok {
+		set = make(map[chan suid.UID]struct{})
+		n.watchers[name] = set
+	}
+	set[ch] = struct{}{}
+	n.mux.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		n.mux.Lock()
+		defer n.mux.Unlock()
+		delete(n.watchers[name], ch)
+		if len(n.watchers[name]) == 0 {
+			delete(n.watchers, name)
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+// watched returns whether there is any watcher
+func (n *notifier) watched() bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return len(n.watchers) > 0
+}
+
+// notify sends the UIDs to all watchers of the syncer without blocking,
+// the UIDs are dropped for the watcher whose buffer is full.
+func (n *notifier) notify(name string, uids ...suid.UID) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	for ch := range n.watchers[name] {
+		for _, uid := range uids {
+			select {
+			case ch <- uid:
+			default:
+			}
+		}
+	}
+}
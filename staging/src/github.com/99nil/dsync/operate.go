@@ -26,16 +26,20 @@ type OperateInterface interface {
 	Add(ctx context.Context, key string, value []byte) error
 	Del(ctx context.Context, key string) error
 	Range(ctx context.Context, fn func(key, value []byte) error) error
+	RangePrefix(ctx context.Context, prefix, start string, fn func(key, value []byte) error) error
 
 	AddData(ctx context.Context, key string, data interface{}) error
+
+	// WithTxn returns the operation of the same space in the transaction
+	WithTxn(txn storage.Txn) OperateInterface
 }
 
 type spaceOperation struct {
 	name    string
-	storage storage.Interface
+	storage storage.Txn
 }
 
-func newSpaceOperation(name string, storage storage.Interface) OperateInterface {
+func newSpaceOperation(name string, storage storage.Txn) OperateInterface {
 	return &spaceOperation{name: name, storage: storage}
 }
 
@@ -55,6 +59,10 @@ func (o *spaceOperation) Range(ctx context.Context, fn func(key, value []byte) e
 	return o.storage.Range(ctx, o.name, fn)
 }
 
+func (o *spaceOperation) RangePrefix(ctx context.Context, prefix, start string, fn func(key, value []byte) error) error {
+	return o.storage.RangePrefix(ctx, o.name, prefix, start, fn)
+}
+
 func (o *spaceOperation) AddData(ctx context.Context, key string, data interface{}) error {
 	b, err := json.Marshal(data)
 	if err != nil {
@@ -62,3 +70,7 @@ func (o *spaceOperation) AddData(ctx context.Context, key string, data interface
 	}
 	return o.storage.Add(ctx, o.name, key, b)
 }
+
+func (o *spaceOperation) WithTxn(txn storage.Txn) OperateInterface {
+	return newSpaceOperation(o.name, txn)
+}
@@ -0,0 +1,149 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operation
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
+)
+
+// logSeparator separates the syncer name and the KSUID in the key of the log entry,
+// the key without it marks the syncer.
+const logSeparator = "\x00"
+
+var errStopRange = errors.New("stop range")
+
+// logSyncer stores each pending UID of the syncer as an entry of its append-only log,
+// adding and removing UIDs only writes the changed entries no matter how many are pending.
+type logSyncer struct {
+	space string
+}
+
+// NewLogSyncer returns the strategy storing the pending set of each syncer as an append-only log in the space
+func NewLogSyncer(space string) (SyncerOperation, error) {
+	if space == "" {
+		return nil, ErrEmptySpace
+	}
+	return &logSyncer{space: space}, nil
+}
+
+func logPrefix(name string) string {
+	return name + logSeparator
+}
+
+func logKey(name string, id suid.KSUID) string {
+	return logPrefix(name) + id.String()
+}
+
+func (s *logSyncer) Add(ctx context.Context, txn storage.Txn, name string, uids ...suid.UID) error {
+	if err := txn.Add(ctx, s.space, name, nil); err != nil {
+		return err
+	}
+	for _, uid := range uids {
+		if err := txn.Add(ctx, s.space, logKey(name, uid.KSUID()), uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *logSyncer) Del(ctx context.Context, txn storage.Txn, name string, uids ...suid.UID) error {
+	for _, uid := range uids {
+		if err := txn.Del(ctx, s.space, logKey(name, uid.KSUID())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *logSyncer) Range(
+	ctx context.Context,
+	txn storage.Txn,
+	name string,
+	from suid.KSUID,
+	fn func(uid suid.UID) error,
+) error {
+	var start string
+	if from != suid.Nil {
+		start = logKey(name, from)
+	}
+	return txn.RangePrefix(ctx, s.space, logPrefix(name), start, func(_, value []byte) error {
+		uid := suid.UID(value)
+		if uid.KSUID() == from {
+			return nil
+		}
+		return fn(uid)
+	})
+}
+
+func (s *logSyncer) Trim(ctx context.Context, txn storage.Txn, name string, to suid.KSUID) error {
+	var keys []string
+	err := txn.RangePrefix(ctx, s.space, logPrefix(name), "", func(key, value []byte) error {
+		if suid.CompareKSUID(suid.UID(value).KSUID(), to) > 0 {
+			return errStopRange
+		}
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil && err != errStopRange {
+		return err
+	}
+	return s.del(ctx, txn, keys)
+}
+
+func (s *logSyncer) Remove(ctx context.Context, txn storage.Txn, name string) error {
+	var keys []string
+	err := txn.RangePrefix(ctx, s.space, logPrefix(name), "", func(key, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.del(ctx, txn, append(keys, name))
+}
+
+func (s *logSyncer) del(ctx context.Context, txn storage.Txn, keys []string) error {
+	for _, key := range keys {
+		if err := txn.Del(ctx, s.space, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *logSyncer) Names(ctx context.Context, txn storage.Txn) ([]string, error) {
+	var names []string
+	err := txn.Range(ctx, s.space, func(key, _ []byte) error {
+		if !strings.Contains(string(key), logSeparator) {
+			names = append(names, string(key))
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (s *logSyncer) Size(ctx context.Context, txn storage.Txn, name string) (int, error) {
+	var size int
+	err := txn.RangePrefix(ctx, s.space, logPrefix(name), "", func(key, value []byte) error {
+		size += len(key) + len(value)
+		return nil
+	})
+	return size, err
+}
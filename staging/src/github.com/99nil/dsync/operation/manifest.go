@@ -0,0 +1,142 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package operation
+
+import (
+	"context"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
+)
+
+// manifestSyncer stores the pending set of each syncer as one compressed manifest,
+// the storage is compact but the whole manifest is rewritten on every change.
+type manifestSyncer struct {
+	space string
+}
+
+// NewManifestSyncer returns the strategy storing the pending set of each syncer as one manifest in the space
+func NewManifestSyncer(space string) (SyncerOperation, error) {
+	if space == "" {
+		return nil, ErrEmptySpace
+	}
+	return &manifestSyncer{space: space}, nil
+}
+
+func (s *manifestSyncer) get(ctx context.Context, txn storage.Txn, name string) (*suid.AssembleManifest, error) {
+	value, err := txn.Get(ctx, s.space, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) == 0 {
+		return suid.NewManifest(), nil
+	}
+	return suid.NewManifestFromBytes(value)
+}
+
+func (s *manifestSyncer) set(ctx context.Context, txn storage.Txn, name string, manifest *suid.AssembleManifest) error {
+	var (
+		b   []byte
+		err error
+	)
+	if manifest.Len() > 0 {
+		b, err = manifest.Bytes()
+		if err != nil {
+			return err
+		}
+	}
+	return txn.Add(ctx, s.space, name, b)
+}
+
+func (s *manifestSyncer) Add(ctx context.Context, txn storage.Txn, name string, uids ...suid.UID) error {
+	manifest, err := s.get(ctx, txn, name)
+	if err != nil {
+		return err
+	}
+	manifest.AppendUID(uids...)
+	return s.set(ctx, txn, name, manifest)
+}
+
+func (s *manifestSyncer) Del(ctx context.Context, txn storage.Txn, name string, uids ...suid.UID) error {
+	manifest, err := s.get(ctx, txn, name)
+	if err != nil {
+		return err
+	}
+	ids := make([]suid.KSUID, 0, len(uids))
+	for _, uid := range uids {
+		ids = append(ids, uid.KSUID())
+	}
+	manifest.Delete(ids...)
+	return s.set(ctx, txn, name, manifest)
+}
+
+func (s *manifestSyncer) Range(
+	ctx context.Context,
+	txn storage.Txn,
+	name string,
+	from suid.KSUID,
+	fn func(uid suid.UID) error,
+) error {
+	manifest, err := s.get(ctx, txn, name)
+	if err != nil {
+		return err
+	}
+	for iter := manifest.IterFrom(from); iter.Next(); {
+		if iter.KSUID == from {
+			continue
+		}
+		if err := fn(manifest.GetUID(iter.KSUID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *manifestSyncer) Trim(ctx context.Context, txn storage.Txn, name string, to suid.KSUID) error {
+	manifest, err := s.get(ctx, txn, name)
+	if err != nil {
+		return err
+	}
+	var pending []suid.UID
+	for iter := manifest.IterFrom(to); iter.Next(); {
+		if iter.KSUID != to {
+			pending = append(pending, manifest.GetUID(iter.KSUID))
+		}
+	}
+	if len(pending) == manifest.Len() {
+		return nil
+	}
+	stored := suid.NewManifest()
+	stored.AppendUID(pending...)
+	return s.set(ctx, txn, name, stored)
+}
+
+func (s *manifestSyncer) Remove(ctx context.Context, txn storage.Txn, name string) error {
+	return txn.Del(ctx, s.space, name)
+}
+
+func (s *manifestSyncer) Names(ctx context.Context, txn storage.Txn) ([]string, error) {
+	var names []string
+	err := txn.Range(ctx, s.space, func(key, _ []byte) error {
+		names = append(names, string(key))
+		return nil
+	})
+	return names, err
+}
+
+func (s *manifestSyncer) Size(ctx context.Context, txn storage.Txn, name string) (int, error) {
+	value, err := txn.Get(ctx, s.space, name)
+	return len(value), err
+}
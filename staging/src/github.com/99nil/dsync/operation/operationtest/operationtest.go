@@ -0,0 +1,332 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package operationtest checks an operation.SyncerOperation against the contract the syncers rely on:
+// where Range resumes, what Trim removes, which syncers Names reports, and that strategies never share data.
+package operationtest
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/99nil/dsync/operation"
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/storage/memory"
+	"github.com/99nil/dsync/suid"
+)
+
+// Contract checks the strategies created by factory, every implementation is expected to satisfy it.
+func Contract(t *testing.T, factory operation.SyncerFactory) {
+	t.Run("range resumes after the cursor", func(t *testing.T) { checkRangeFromCursor(t, factory) })
+	t.Run("trim removes up to the boundary", func(t *testing.T) { checkTrimBoundaries(t, factory) })
+	t.Run("delete by KSUID", func(t *testing.T) { checkDel(t, factory) })
+	t.Run("names after remove", func(t *testing.T) { checkNamesAfterRemove(t, factory) })
+	t.Run("strategies sharing a factory", func(t *testing.T) { checkSharedFactory(t, factory) })
+	t.Run("writes follow the transaction", func(t *testing.T) { checkTransaction(t, factory) })
+	t.Run("empty space is rejected", func(t *testing.T) {
+		if _, err := factory(""); err != operation.ErrEmptySpace {
+			t.Errorf("factory(\"\") error = %v, want %v", err, operation.ErrEmptySpace)
+		}
+	})
+}
+
+func newStorage(t *testing.T) storage.Interface {
+	t.Helper()
+	s, err := memory.New(&memory.Config{})
+	if err != nil {
+		t.Fatalf("memory.New() error = %v", err)
+	}
+	return s
+}
+
+// syncers drives the strategy owning a space of the storage
+type syncers struct {
+	t  *testing.T
+	s  storage.Interface
+	op operation.SyncerOperation
+}
+
+func newSyncers(t *testing.T, factory operation.SyncerFactory, s storage.Interface, space string) *syncers {
+	t.Helper()
+	op, err := factory(space)
+	if err != nil {
+		t.Fatalf("factory(%s) error = %v", space, err)
+	}
+	return &syncers{t: t, s: s, op: op}
+}
+
+func (x *syncers) add(name string, uids ...suid.UID) {
+	x.t.Helper()
+	if err := x.op.Add(context.Background(), x.s, name, uids...); err != nil {
+		x.t.Fatalf("Add(%s) error = %v", name, err)
+	}
+}
+
+func (x *syncers) trim(name string, to suid.KSUID) {
+	x.t.Helper()
+	if err := x.op.Trim(context.Background(), x.s, name, to); err != nil {
+		x.t.Fatalf("Trim(%s) error = %v", name, err)
+	}
+}
+
+func (x *syncers) remove(name string) {
+	x.t.Helper()
+	if err := x.op.Remove(context.Background(), x.s, name); err != nil {
+		x.t.Fatalf("Remove(%s) error = %v", name, err)
+	}
+}
+
+// pending returns the pending UIDs of the syncer after from
+func (x *syncers) pending(name string, from suid.KSUID) []string {
+	x.t.Helper()
+	var got []string
+	err := x.op.Range(context.Background(), x.s, name, from, func(uid suid.UID) error {
+		got = append(got, uid.String())
+		return nil
+	})
+	if err != nil {
+		x.t.Fatalf("Range(%s) error = %v", name, err)
+	}
+	return got
+}
+
+func (x *syncers) names() []string {
+	x.t.Helper()
+	names, err := x.op.Names(context.Background(), x.s)
+	if err != nil {
+		x.t.Fatalf("Names() error = %v", err)
+	}
+	return names
+}
+
+// newUIDs returns n UIDs in ascending order, the odd ones carry a custom UID.
+func newUIDs(n int) []suid.UID {
+	generator := suid.NewMonotonicGenerator()
+	uids := make([]suid.UID, 0, n)
+	for i := 0; i < n; i++ {
+		custom := ""
+		if i%2 == 1 {
+			custom = "custom" + string(rune('a'+i))
+		}
+		uids = append(uids, suid.NewWithCustom(generator.Next(), custom))
+	}
+	return uids
+}
+
+func uidStrings(uids ...suid.UID) []string {
+	var result []string
+	for _, uid := range uids {
+		result = append(result, uid.String())
+	}
+	return result
+}
+
+// checkRangeFromCursor checks that Range yields the UIDs after the cursor in ascending order,
+// whether the cursor is pending or not, as the syncer resumes from the state the agent reports.
+func checkRangeFromCursor(t *testing.T, factory operation.SyncerFactory) {
+	x := newSyncers(t, factory, newStorage(t), "syncer")
+	uids := newUIDs(6)
+	x.add("node", uids[4], uids[0], uids[2])
+	x.add("node", uids[5], uids[1], uids[2])
+
+	pending := uidStrings(uids[0], uids[1], uids[2], uids[4], uids[5])
+	cursors := []struct {
+		name string
+		from suid.KSUID
+		want []string
+	}{
+		{name: "nil", from: suid.Nil, want: pending},
+		{name: "pending", from: uids[1].KSUID(), want: pending[2:]},
+		{name: "not pending", from: uids[3].KSUID(), want: pending[3:]},
+		{name: "last", from: uids[5].KSUID(), want: nil},
+	}
+	for _, c := range cursors {
+		if got := x.pending("node", c.from); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Range(from %s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+	if got := x.pending("missing", suid.Nil); len(got) != 0 {
+		t.Errorf("Range(missing) = %v, want none", got)
+	}
+
+	stop := errors.New("stop")
+	var calls int
+	err := x.op.Range(context.Background(), x.s, "node", uids[0].KSUID(), func(suid.UID) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("Range() = %v after %d calls, want %v after 1", err, calls, stop)
+	}
+}
+
+// checkTrimBoundaries checks that Trim removes the UIDs not after the boundary, and only of the syncer.
+func checkTrimBoundaries(t *testing.T, factory operation.SyncerFactory) {
+	x := newSyncers(t, factory, newStorage(t), "syncer")
+	uids := newUIDs(7)
+	x.add("node", uids[1], uids[2], uids[4], uids[5])
+	// The name is the prefix of another one.
+	x.add("node1", uids[1], uids[6])
+
+	// Before the first one, nothing is removed.
+	x.trim("node", uids[0].KSUID())
+	if got, want := x.pending("node", suid.Nil), uidStrings(uids[1], uids[2], uids[4], uids[5]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() after Trim(before first) = %v, want %v", got, want)
+	}
+	// The boundary itself is removed.
+	x.trim("node", uids[2].KSUID())
+	if got, want := x.pending("node", suid.Nil), uidStrings(uids[4], uids[5]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() after Trim(pending) = %v, want %v", got, want)
+	}
+	// The boundary does not need to be pending.
+	x.trim("node", uids[3].KSUID())
+	if got, want := x.pending("node", suid.Nil), uidStrings(uids[4], uids[5]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() after Trim(not pending) = %v, want %v", got, want)
+	}
+	x.trim("node", uids[6].KSUID())
+	if got := x.pending("node", suid.Nil); len(got) != 0 {
+		t.Errorf("Range() after Trim(after last) = %v, want none", got)
+	}
+	x.trim("missing", uids[6].KSUID())
+
+	if got, want := x.pending("node1", suid.Nil), uidStrings(uids[1], uids[6]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range(node1) = %v, want %v", got, want)
+	}
+}
+
+// checkDel checks that the UIDs are deleted by KSUID, and the size follows the pending set.
+func checkDel(t *testing.T, factory operation.SyncerFactory) {
+	ctx := context.Background()
+	x := newSyncers(t, factory, newStorage(t), "syncer")
+	size := func() int {
+		t.Helper()
+		n, err := x.op.Size(ctx, x.s, "node")
+		if err != nil {
+			t.Fatalf("Size() error = %v", err)
+		}
+		return n
+	}
+	if n := size(); n != 0 {
+		t.Errorf("Size() = %d before adding, want 0", n)
+	}
+
+	uids := newUIDs(3)
+	x.add("node", uids...)
+	full := size()
+	if err := x.op.Del(ctx, x.s, "node", suid.NewWithCustom(uids[1].KSUID(), "")); err != nil {
+		t.Fatalf("Del() error = %v", err)
+	}
+	if err := x.op.Del(ctx, x.s, "missing", uids[0]); err != nil {
+		t.Fatalf("Del(missing) error = %v", err)
+	}
+	if got, want := x.pending("node", suid.Nil), uidStrings(uids[0], uids[2]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() after Del() = %v, want %v", got, want)
+	}
+	if n := size(); n == 0 || n >= full {
+		t.Errorf("Size() = %d after Del(), want between 0 and %d", n, full)
+	}
+}
+
+// checkNamesAfterRemove checks that Names keeps the syncers whose pending set is empty,
+// and drops the removed ones until they are added to again.
+func checkNamesAfterRemove(t *testing.T, factory operation.SyncerFactory) {
+	x := newSyncers(t, factory, newStorage(t), "syncer")
+	uids := newUIDs(3)
+	x.add("c", uids[0])
+	x.add("a", uids[1])
+	x.add("b", uids[2])
+	x.trim("c", uids[2].KSUID())
+	if got, want := x.names(), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+
+	x.remove("a")
+	x.remove("c")
+	x.remove("missing")
+	if got, want := x.names(), []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() after Remove() = %v, want %v", got, want)
+	}
+	if got := x.pending("a", suid.Nil); len(got) != 0 {
+		t.Errorf("Range(a) after Remove() = %v, want none", got)
+	}
+
+	x.add("a", uids[2])
+	if got, want := x.names(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() after adding again = %v, want %v", got, want)
+	}
+	if got, want := x.pending("a", suid.Nil), uidStrings(uids[2]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range(a) after adding again = %v, want %v", got, want)
+	}
+}
+
+// checkSharedFactory checks that the strategies created by one factory for two instances
+// on the same storage never see the syncers of each other.
+func checkSharedFactory(t *testing.T, factory operation.SyncerFactory) {
+	s := newStorage(t)
+	a := newSyncers(t, factory, s, "syncer-a")
+	b := newSyncers(t, factory, s, "syncer-b")
+	uids := newUIDs(3)
+	a.add("node", uids[0], uids[1])
+	b.add("node", uids[2])
+
+	if got, want := a.pending("node", suid.Nil), uidStrings(uids[0], uids[1]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() of a = %v, want %v", got, want)
+	}
+	if got, want := b.pending("node", suid.Nil), uidStrings(uids[2]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() of b = %v, want %v", got, want)
+	}
+
+	a.trim("node", uids[2].KSUID())
+	b.add("other", uids[0])
+	a.remove("node")
+	if got := a.names(); len(got) != 0 {
+		t.Errorf("Names() of a = %v, want none", got)
+	}
+	if got, want := b.names(), []string{"node", "other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() of b = %v, want %v", got, want)
+	}
+	if got, want := b.pending("node", suid.Nil), uidStrings(uids[2]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() of b after a is trimmed = %v, want %v", got, want)
+	}
+}
+
+// checkTransaction checks that the changes made in a failed transaction are discarded.
+func checkTransaction(t *testing.T, factory operation.SyncerFactory) {
+	ctx := context.Background()
+	x := newSyncers(t, factory, newStorage(t), "syncer")
+	uids := newUIDs(2)
+	x.add("node", uids[0])
+
+	fail := errors.New("fail")
+	err := x.s.Update(ctx, func(txn storage.Txn) error {
+		if err := x.op.Add(ctx, txn, "node", uids[1]); err != nil {
+			return err
+		}
+		if err := x.op.Trim(ctx, txn, "node", uids[0].KSUID()); err != nil {
+			return err
+		}
+		if err := x.op.Remove(ctx, txn, "node"); err != nil {
+			return err
+		}
+		return fail
+	})
+	if err != fail {
+		t.Fatalf("Update() error = %v, want %v", err, fail)
+	}
+	if got, want := x.pending("node", suid.Nil), uidStrings(uids[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Range() after rollback = %v, want %v", got, want)
+	}
+}
@@ -12,22 +12,48 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package operation defines the strategies of storing the UIDs waiting to be synchronized by each syncer,
+// the synchronization of dsync itself is independent of how they are stored.
 package operation
 
 import (
 	"context"
+	"errors"
 
+	"github.com/99nil/dsync/storage"
 	"github.com/99nil/dsync/suid"
 )
 
-// dataset init时，在一个 init_dataset 空间中初始化数据，中间所有的add/del操作都保留
-// init 完成后，覆盖 dataset 空间
+var ErrEmptySpace = errors.New("syncer operation space must not be empty")
 
-// dataset add/del时，调用 syncer 的 add/del 操作
-// 新的syncer创建时，调用 syncer 的 init 操作
+// SyncerFactory creates the strategy owning the storage space,
+// each instance creates its own strategy, so the instances sharing a factory never share a space.
+type SyncerFactory func(space string) (SyncerOperation, error)
 
+// SyncerOperation defines the strategy of storing the pending UIDs of the syncers.
+// The methods are called within a transaction of the storage, or with the storage itself when only reading,
+// so the strategy must store everything in the space it is created with.
+// The strategy must not be changed for the existing data.
 type SyncerOperation interface {
-	Init() error
-	Add(ctx context.Context, uids ...suid.UID) error
-	Del(ctx context.Context, uids ...suid.UID) error
+	// Add adds UIDs to the pending set of the syncer
+	Add(ctx context.Context, txn storage.Txn, name string, uids ...suid.UID) error
+
+	// Del deletes UIDs from the pending set of the syncer
+	Del(ctx context.Context, txn storage.Txn, name string, uids ...suid.UID) error
+
+	// Range calls fn sequentially in ascending order of KSUID for the pending UID of the syncer after from,
+	// a Nil from means all. If fn returns error, range stops the iteration.
+	Range(ctx context.Context, txn storage.Txn, name string, from suid.KSUID, fn func(uid suid.UID) error) error
+
+	// Trim removes the pending UIDs of the syncer not after to
+	Trim(ctx context.Context, txn storage.Txn, name string, to suid.KSUID) error
+
+	// Remove removes the syncer with its pending set
+	Remove(ctx context.Context, txn storage.Txn, name string) error
+
+	// Names returns the names of all syncers that have been added to, even if their pending set is empty now
+	Names(ctx context.Context, txn storage.Txn) ([]string, error)
+
+	// Size returns the byte size of the stored pending set of the syncer
+	Size(ctx context.Context, txn storage.Txn, name string) (int, error)
 }
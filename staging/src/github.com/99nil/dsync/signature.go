@@ -0,0 +1,84 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"crypto/ed25519"
+	"fmt"
+
+	"github.com/99nil/dsync/suid"
+)
+
+// SignatureError indicates that the item is unsigned or the signature does not match the public key
+type SignatureError struct {
+	UID      suid.UID
+	Unsigned bool
+}
+
+func (e *SignatureError) Error() string {
+	if e.Unsigned {
+		return fmt.Sprintf("item %s is unsigned", e.UID)
+	}
+	return fmt.Sprintf("invalid signature for %s", e.UID)
+}
+
+// signatureVersion is the first byte of the signed message, it changes with the layout of the message,
+// so that the signatures of an older layout fail the verification instead of covering fewer fields.
+const signatureVersion byte = 2
+
+// signPayload returns the message signed for the item: the version, the UID, the encoding, each followed by a zero separator,
+// the digest and the tombstone flag. The digest is computed from the value as it is on the wire,
+// so the compressed value is verified before it is decompressed.
+func signPayload(item Item) []byte {
+	payload := make([]byte, 0, 1+len(item.UID)+1+len(item.Encoding)+1+32+1)
+	payload = append(payload, signatureVersion)
+	payload = append(payload, item.UID...)
+	payload = append(payload, 0)
+	payload = append(payload, item.Encoding...)
+	payload = append(payload, 0)
+	payload = append(payload, Digest(item.Value)...)
+	if item.Tombstone {
+		return append(payload, 1)
+	}
+	return append(payload, 0)
+}
+
+// Sign sets the ed25519 signature of the UID, the encoding, the value and the tombstone flag of the item,
+// the item is compressed before it is signed.
+func (i *Item) Sign(key ed25519.PrivateKey) {
+	i.Signature = ed25519.Sign(key, signPayload(*i))
+}
+
+// VerifySignature checks the signature of the item with the public key,
+// the compressed item is verified as it is, it is only decompressed when it is synchronized.
+func (i Item) VerifySignature(key ed25519.PublicKey) error {
+	if len(i.Signature) == 0 {
+		return &SignatureError{UID: i.UID, Unsigned: true}
+	}
+	if !ed25519.Verify(key, signPayload(i), i.Signature) {
+		return &SignatureError{UID: i.UID}
+	}
+	return nil
+}
+
+// VerifySignatures checks the items in order and returns the first unsigned or badly signed one.
+func VerifySignatures(items []Item, key ed25519.PublicKey) error {
+	for _, item := range items {
+		if err := item.VerifySignature(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
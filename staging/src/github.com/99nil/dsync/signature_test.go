@@ -0,0 +1,108 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+
+	"github.com/99nil/dsync/suid"
+)
+
+func newTestKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	return pub, priv
+}
+
+func syncerData(t *testing.T, ins Interface, values ...string) []Item {
+	t.Helper()
+	ctx := context.Background()
+	var uids []suid.UID
+	for _, value := range values {
+		uid := suid.New()
+		if err := ins.DataSet().Add(ctx, Item{UID: uid, Value: []byte(value)}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		uids = append(uids, uid)
+	}
+	if err := ins.Syncer("node").Add(ctx, uids...); err != nil {
+		t.Fatalf("Syncer.Add() error = %v", err)
+	}
+	manifest, err := ins.Syncer("node").Manifest(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	items, err := ins.Syncer("node").Data(ctx, manifest)
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	return items
+}
+
+func TestSyncer_Sign(t *testing.T) {
+	pub, priv := newTestKey(t)
+	other, _ := newTestKey(t)
+	ins := newTestInstance(t, WithSignerOption(priv))
+
+	items := syncerData(t, ins, "a", "b")
+	if err := VerifySignatures(items, pub); err != nil {
+		t.Fatalf("VerifySignatures() error = %v", err)
+	}
+	var sigErr *SignatureError
+	if err := VerifySignatures(items, other); !errors.As(err, &sigErr) || sigErr.Unsigned {
+		t.Errorf("VerifySignatures(other key) error = %v, want invalid signature", err)
+	}
+
+	tampered := append([]Item(nil), items...)
+	tampered[1].Value = []byte("tampered")
+	tampered[1].Digest = Digest(tampered[1].Value)
+	if err := VerifySignatures(tampered, pub); !errors.As(err, &sigErr) || sigErr.UID.String() != items[1].UID.String() {
+		t.Errorf("VerifySignatures(tampered) error = %v, want invalid signature of %s", err, items[1].UID)
+	}
+
+	// The tombstone flag is signed, a deletion can not be forged or dropped.
+	flipped := append([]Item(nil), items...)
+	flipped[0].Tombstone = !flipped[0].Tombstone
+	if err := VerifySignatures(flipped, pub); !errors.As(err, &sigErr) || sigErr.UID.String() != items[0].UID.String() {
+		t.Errorf("VerifySignatures(flipped tombstone) error = %v, want invalid signature of %s", err, items[0].UID)
+	}
+
+	// The signature of the layout before the version fails the verification.
+	legacy := items[0]
+	payload := append(append(append([]byte(nil), legacy.UID...), 0), Digest(legacy.Value)...)
+	legacy.Signature = ed25519.Sign(priv, payload)
+	if err := legacy.VerifySignature(pub); !errors.As(err, &sigErr) || sigErr.Unsigned {
+		t.Errorf("VerifySignature(legacy) error = %v, want invalid signature", err)
+	}
+
+	snapshot, err := ins.Syncer("node").Snapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	if err := VerifySignatures(snapshot.Items, pub); err != nil {
+		t.Errorf("VerifySignatures(snapshot) error = %v", err)
+	}
+
+	unsigned := syncerData(t, newTestInstance(t), "a")
+	if err := VerifySignatures(unsigned, pub); !errors.As(err, &sigErr) || !sigErr.Unsigned {
+		t.Errorf("VerifySignatures(unsigned) error = %v, want unsigned", err)
+	}
+}
@@ -17,7 +17,10 @@ package badger
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"sort"
 
 	"github.com/99nil/dsync/storage"
 
@@ -26,12 +29,29 @@ import (
 
 var _ storage.Interface = (*Client)(nil)
 
+// maxConflictRetries is the number of times a conflicting update is retried
+const maxConflictRetries = 10
+
+// layoutVersion is the version of the layout of the keys, the spaces are prefixed with their length since version 1.
+// The keys of the legacy layout without version are the space and the key joined by a hyphen.
+const layoutVersion byte = 1
+
+// layoutKey is the key of the layout version, it is outside of any space.
+var layoutKey = []byte("\xfflayout")
+
+// migrateBatchSize is the number of keys moved in each transaction of the layout migration
+const migrateBatchSize = 1000
+
+var ErrUnsupportedLayout = errors.New("unsupported layout")
+
 type Config struct {
 	Path string `json:"path"`
 }
 
 type Client struct {
 	db *badger.DB
+	// legacy is set when the store is written in the legacy layout and has not been migrated
+	legacy bool
 }
 
 func New(cfg *Config) (*Client, error) {
@@ -42,7 +62,11 @@ func New(cfg *Config) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	client := &Client{db: db}
+	client, err := newClient(db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
 	return client, nil
 }
 
@@ -50,80 +74,246 @@ func NewWithDB(db *badger.DB) (*Client, error) {
 	if db == nil {
 		return nil, errors.New("db unavailable")
 	}
+	return newClient(db)
+}
+
+// newClient checks the layout version of the store, the empty store is initialized with the current version.
+func newClient(db *badger.DB) (*Client, error) {
 	client := &Client{db: db}
+	err := db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(layoutKey)
+		if err == nil {
+			version, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if len(version) != 1 || version[0] > layoutVersion {
+				return fmt.Errorf("%w: %v", ErrUnsupportedLayout, version)
+			}
+			return nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		it := txn.NewIterator(badger.IteratorOptions{})
+		it.Rewind()
+		client.legacy = it.Valid()
+		it.Close()
+		if client.legacy {
+			return nil
+		}
+		return txn.Set(layoutKey, []byte{layoutVersion})
+	})
+	if err != nil {
+		return nil, err
+	}
 	return client, nil
 }
 
+type legacyEntry struct {
+	key   []byte
+	space string
+	value []byte
+}
+
+// MigrateLayout moves the keys of the spaces in the legacy layout to the current layout,
+// and returns the number of moved keys. It must be called before the spaces are used.
+// The legacy key can not be split by itself, so it is moved to the longest space it starts with followed by a hyphen.
+// The layout version is recorded once no key of the spaces is left to move, MigrateLayout does nothing afterwards.
+func (c *Client) MigrateLayout(_ context.Context, spaces ...string) (int, error) {
+	if !c.legacy {
+		return 0, nil
+	}
+	prefixes := make([]string, 0, len(spaces))
+	for _, space := range spaces {
+		prefixes = append(prefixes, space+"-")
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+
+	var (
+		moved int
+		seek  []byte
+	)
+	for {
+		var batch []legacyEntry
+		err := c.db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+			for it.Seek(seek); it.Valid() && len(batch) < migrateBatchSize; it.Next() {
+				item := it.Item()
+				key := item.KeyCopy(nil)
+				seek = append(key, 0)
+				for _, prefix := range prefixes {
+					if !bytes.HasPrefix(key, []byte(prefix)) {
+						continue
+					}
+					value, err := item.ValueCopy(nil)
+					if err != nil {
+						return err
+					}
+					batch = append(batch, legacyEntry{key: key, space: prefix[:len(prefix)-1], value: value})
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return moved, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		err = c.db.Update(func(txn *badger.Txn) error {
+			for _, entry := range batch {
+				key := string(entry.key[len(entry.space)+1:])
+				if err := txn.Set(buildKey(entry.space, key), entry.value); err != nil {
+					return err
+				}
+				if err := txn.Delete(entry.key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return moved, err
+		}
+		moved += len(batch)
+	}
+	if moved > 0 {
+		return moved, nil
+	}
+
+	err := c.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(layoutKey, []byte{layoutVersion})
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.legacy = false
+	return 0, nil
+}
+
 func (c *Client) Close() error {
 	return c.db.Close()
 }
 
+// buildPrefix prefixes the space with its length,
+// so that no space is the prefix of another one, e.g. a and a-b.
 func buildPrefix(space string) []byte {
-	return append([]byte(space), '-')
+	prefix := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(space))
+	n := binary.PutUvarint(prefix, uint64(len(space)))
+	return append(prefix[:n], space...)
+}
+
+func buildKey(space, key string) []byte {
+	return append(buildPrefix(space), key...)
 }
 
-func (c *Client) Get(_ context.Context, space, key string) ([]byte, error) {
+func (c *Client) Get(ctx context.Context, space, key string) ([]byte, error) {
 	var res []byte
 	err := c.db.View(func(txn *badger.Txn) error {
-		prefix := buildPrefix(space)
-		fmtKey := append(prefix, key...)
-		item, err := txn.Get(fmtKey)
-		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				return nil
-			}
-			return err
-		}
-		return item.Value(func(v []byte) error {
-			res = v
-			return nil
-		})
+		var err error
+		res, err = (&Txn{txn: txn}).Get(ctx, space, key)
+		return err
 	})
 	return res, err
 }
 
-func (c *Client) Add(_ context.Context, space, key string, value []byte) error {
-	return c.db.Update(func(txn *badger.Txn) error {
-		fmtKey := append(buildPrefix(space), key...)
-		err := txn.Set(fmtKey, value)
-		if err == badger.ErrKeyNotFound {
-			return nil
-		}
-		return err
+func (c *Client) Add(ctx context.Context, space, key string, value []byte) error {
+	return c.Update(ctx, func(txn storage.Txn) error {
+		return txn.Add(ctx, space, key, value)
 	})
 }
 
-func (c *Client) Del(_ context.Context, space, key string) error {
-	return c.db.Update(func(txn *badger.Txn) error {
-		fmtKey := append(buildPrefix(space), key...)
-		err := txn.Delete(fmtKey)
-		if err == badger.ErrKeyNotFound {
-			return nil
-		}
-		return err
+func (c *Client) Del(ctx context.Context, space, key string) error {
+	return c.Update(ctx, func(txn storage.Txn) error {
+		return txn.Del(ctx, space, key)
 	})
 }
 
 func (c *Client) Clear(_ context.Context, space string) error {
-	return c.db.DropPrefix([]byte(space))
+	return c.db.DropPrefix(buildPrefix(space))
 }
 
-func (c *Client) Range(_ context.Context, space string, fn func(key, value []byte) error) error {
+func (c *Client) Range(ctx context.Context, space string, fn func(key, value []byte) error) error {
+	return c.RangePrefix(ctx, space, "", "", fn)
+}
+
+func (c *Client) RangePrefix(ctx context.Context, space, prefix, start string, fn func(key, value []byte) error) error {
 	return c.db.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
-		defer it.Close()
-
-		prefix := buildPrefix(space)
-		for it.Rewind(); it.ValidForPrefix(prefix); it.Next() {
-			item := it.Item()
-			k := bytes.TrimPrefix(item.Key(), prefix)
-			err := item.Value(func(v []byte) error {
-				return fn(k, v)
-			})
-			if err != nil {
-				return err
-			}
+		return (&Txn{txn: txn}).RangePrefix(ctx, space, prefix, start, fn)
+	})
+}
+
+func (c *Client) Update(_ context.Context, fn func(txn storage.Txn) error) error {
+	var err error
+	for i := 0; i < maxConflictRetries; i++ {
+		err = c.db.Update(func(txn *badger.Txn) error {
+			return fn(&Txn{txn: txn})
+		})
+		if err != badger.ErrConflict {
+			return err
 		}
+	}
+	return err
+}
+
+var _ storage.Txn = (*Txn)(nil)
+
+// Txn implements storage.Txn with badger transaction
+type Txn struct {
+	txn *badger.Txn
+}
+
+func (t *Txn) Get(_ context.Context, space, key string) ([]byte, error) {
+	item, err := t.txn.Get(buildKey(space, key))
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (t *Txn) Add(_ context.Context, space, key string, value []byte) error {
+	return t.txn.Set(buildKey(space, key), value)
+}
+
+func (t *Txn) Del(_ context.Context, space, key string) error {
+	err := t.txn.Delete(buildKey(space, key))
+	if err == badger.ErrKeyNotFound {
 		return nil
-	})
+	}
+	return err
+}
+
+func (t *Txn) Range(ctx context.Context, space string, fn func(key, value []byte) error) error {
+	return t.RangePrefix(ctx, space, "", "", fn)
+}
+
+func (t *Txn) RangePrefix(_ context.Context, space, prefix, start string, fn func(key, value []byte) error) error {
+	it := t.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	spacePrefix := buildPrefix(space)
+	keyPrefix := buildKey(space, prefix)
+	seek := keyPrefix
+	if start > prefix {
+		seek = buildKey(space, start)
+	}
+	for it.Seek(seek); it.ValidForPrefix(keyPrefix); it.Next() {
+		item := it.Item()
+		k := bytes.TrimPrefix(item.KeyCopy(nil), spacePrefix)
+		v, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
 }
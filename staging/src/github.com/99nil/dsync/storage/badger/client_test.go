@@ -0,0 +1,148 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package badger
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/storage/storagetest"
+)
+
+func TestClient(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Interface {
+		client, err := New(&Config{Path: t.TempDir()})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		t.Cleanup(func() { _ = client.Close() })
+		return client
+	})
+}
+
+func TestClient_MigrateLayout(t *testing.T) {
+	ctx := context.Background()
+	path := t.TempDir()
+
+	// The store written in the legacy layout, the key of a space may look like the key of a longer space.
+	options := badger.DefaultOptions(path)
+	options.Logger = nil
+	db, err := badger.Open(options)
+	if err != nil {
+		t.Fatalf("badger.Open() error = %v", err)
+	}
+	legacy := map[string]string{
+		"dsync_tmp-a":             "tmp a",
+		"dsync_tmp_tombstone-a":   "tombstone a",
+		"dsync_log_node-1-b":      "log b",
+		"dsync_custom-ns/name-1":  "custom",
+		"other-space-not-dsync-c": "other",
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		for key, value := range legacy {
+			if err := txn.Set([]byte(key), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	client, err := New(&Config{Path: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	spaces := []string{"dsync_tmp", "dsync_tmp_tombstone", "dsync_custom"}
+	moved, err := client.MigrateLayout(ctx, spaces...)
+	if err != nil || moved != 3 {
+		t.Fatalf("MigrateLayout() = %d, %v, want 3", moved, err)
+	}
+	// The spaces found after the first migration are migrated in the next one.
+	moved, err = client.MigrateLayout(ctx, append(spaces, "dsync_log_node-1")...)
+	if err != nil || moved != 1 {
+		t.Fatalf("MigrateLayout() = %d, %v, want 1", moved, err)
+	}
+	if moved, err := client.MigrateLayout(ctx, spaces...); err != nil || moved != 0 {
+		t.Fatalf("MigrateLayout() = %d, %v, want 0", moved, err)
+	}
+
+	want := map[[2]string]string{
+		{"dsync_tmp", "a"}:            "tmp a",
+		{"dsync_tmp_tombstone", "a"}:  "tombstone a",
+		{"dsync_log_node-1", "b"}:     "log b",
+		{"dsync_custom", "ns/name-1"}: "custom",
+	}
+	for k, value := range want {
+		got, err := client.Get(ctx, k[0], k[1])
+		if err != nil || string(got) != value {
+			t.Errorf("Get(%s, %s) = %q, %v, want %q", k[0], k[1], got, err, value)
+		}
+	}
+	var keys []string
+	if err := client.Range(ctx, "dsync_tmp", func(key, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}); err != nil {
+		t.Fatalf("Range() error = %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Errorf("Range(dsync_tmp) = %v, want [a]", keys)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// The layout version is recorded, the reopened store is not migrated again.
+	client, err = New(&Config{Path: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer client.Close()
+	if client.legacy {
+		t.Errorf("New() opened the migrated store as legacy")
+	}
+}
+
+func TestClient_LayoutVersion(t *testing.T) {
+	path := t.TempDir()
+	client, err := New(&Config{Path: path})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if client.legacy {
+		t.Errorf("New() opened the empty store as legacy")
+	}
+	// The store of a newer layout is not misread.
+	if err := client.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(layoutKey, []byte{layoutVersion + 1})
+	}); err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := New(&Config{Path: path}); !errors.Is(err, ErrUnsupportedLayout) {
+		t.Errorf("New() error = %v, want %v", err, ErrUnsupportedLayout)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+
+	"github.com/99nil/dsync/storage"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var _ storage.Interface = (*Client)(nil)
+
+type Config struct {
+	Path string `json:"path"`
+}
+
+// Client is a storage implementation based on bbolt,
+// each space is stored in its own bucket.
+type Client struct {
+	db *bolt.DB
+}
+
+func New(cfg *Config) (*Client, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("bolt path must not be empty")
+	}
+	db, err := bolt.Open(cfg.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	client := &Client{db: db}
+	return client, nil
+}
+
+func NewWithDB(db *bolt.DB) (*Client, error) {
+	if db == nil {
+		return nil, errors.New("db unavailable")
+	}
+	client := &Client{db: db}
+	return client, nil
+}
+
+func (c *Client) Close() error {
+	return c.db.Close()
+}
+
+func (c *Client) Get(ctx context.Context, space, key string) ([]byte, error) {
+	var res []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		var err error
+		res, err = (&Txn{tx: tx}).Get(ctx, space, key)
+		return err
+	})
+	return res, err
+}
+
+func (c *Client) Add(ctx context.Context, space, key string, value []byte) error {
+	return c.Update(ctx, func(txn storage.Txn) error {
+		return txn.Add(ctx, space, key, value)
+	})
+}
+
+func (c *Client) Del(ctx context.Context, space, key string) error {
+	return c.Update(ctx, func(txn storage.Txn) error {
+		return txn.Del(ctx, space, key)
+	})
+}
+
+func (c *Client) Clear(_ context.Context, space string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(space))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+type pair struct {
+	key   []byte
+	value []byte
+}
+
+func (c *Client) Range(ctx context.Context, space string, fn func(key, value []byte) error) error {
+	return c.RangePrefix(ctx, space, "", "", fn)
+}
+
+// rangeBufferSize bounds the size of the pairs copied out of a transaction at a time by a range.
+const rangeBufferSize = 4 << 20
+
+// RangePrefix reads the pairs in one transaction, so that they are a consistent snapshot,
+// fn is called outside the transaction so that it can operate the storage.
+// If the pairs exceed rangeBufferSize, the range continues after the last pair in the next transaction,
+// so the larger range is only consistent within each rangeBufferSize of pairs.
+func (c *Client) RangePrefix(_ context.Context, space, prefix, start string, fn func(key, value []byte) error) error {
+	var after []byte
+	for {
+		var (
+			pairs []pair
+			more  bool
+		)
+		err := c.db.View(func(tx *bolt.Tx) error {
+			pairs, more = rangePairs(tx, space, prefix, start, after)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := callPairs(pairs, fn); err != nil || !more {
+			return err
+		}
+		after = pairs[len(pairs)-1].key
+	}
+}
+
+// rangePairs copies the pairs with the prefix and not less than start in the space, after the key if it is not nil,
+// until their size reaches rangeBufferSize, more reports whether there are pairs left.
+func rangePairs(tx *bolt.Tx, space, prefix, start string, after []byte) (pairs []pair, more bool) {
+	bucket := tx.Bucket([]byte(space))
+	if bucket == nil {
+		return nil, false
+	}
+	cursor := bucket.Cursor()
+	k, v := seekPrefix(cursor, prefix, start)
+	if after != nil {
+		if k, v = cursor.Seek(after); bytes.Equal(k, after) {
+			k, v = cursor.Next()
+		}
+	}
+	var size int
+	for ; k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = cursor.Next() {
+		if size >= rangeBufferSize {
+			return pairs, true
+		}
+		pairs = append(pairs, pair{key: copyBytes(k), value: copyBytes(v)})
+		size += len(k) + len(v)
+	}
+	return pairs, false
+}
+
+func callPairs(pairs []pair, fn func(key, value []byte) error) error {
+	for _, p := range pairs {
+		if err := fn(p.key, p.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seekPrefix moves the cursor to the first key with the prefix and not less than start.
+func seekPrefix(cursor *bolt.Cursor, prefix, start string) ([]byte, []byte) {
+	seek := prefix
+	if start > prefix {
+		seek = start
+	}
+	if seek == "" {
+		return cursor.First()
+	}
+	return cursor.Seek([]byte(seek))
+}
+
+func (c *Client) Update(_ context.Context, fn func(txn storage.Txn) error) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return fn(&Txn{tx: tx})
+	})
+}
+
+var _ storage.Txn = (*Txn)(nil)
+
+// Txn implements storage.Txn with bbolt transaction
+type Txn struct {
+	tx *bolt.Tx
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
+
+func (t *Txn) Get(_ context.Context, space, key string) ([]byte, error) {
+	bucket := t.tx.Bucket([]byte(space))
+	if bucket == nil {
+		return nil, nil
+	}
+	// The value returned by bbolt is only valid in the transaction.
+	return copyBytes(bucket.Get([]byte(key))), nil
+}
+
+func (t *Txn) Add(_ context.Context, space, key string, value []byte) error {
+	bucket, err := t.tx.CreateBucketIfNotExists([]byte(space))
+	if err != nil {
+		return err
+	}
+	// bbolt retains the value until the transaction is committed.
+	if value == nil {
+		value = []byte{}
+	}
+	return bucket.Put([]byte(key), copyBytes(value))
+}
+
+func (t *Txn) Del(_ context.Context, space, key string) error {
+	bucket := t.tx.Bucket([]byte(space))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Delete([]byte(key))
+}
+
+func (t *Txn) Range(ctx context.Context, space string, fn func(key, value []byte) error) error {
+	return t.RangePrefix(ctx, space, "", "", fn)
+}
+
+func (t *Txn) RangePrefix(_ context.Context, space, prefix, start string, fn func(key, value []byte) error) error {
+	// Collect the pairs first, modifying the bucket during cursor iteration is not allowed.
+	var after []byte
+	for {
+		pairs, more := rangePairs(t.tx, space, prefix, start, after)
+		if err := callPairs(pairs, fn); err != nil || !more {
+			return err
+		}
+		after = pairs[len(pairs)-1].key
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/storage/storagetest"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestNew(t *testing.T) {
+	if _, err := New(&Config{}); err == nil {
+		t.Error("New() with empty path error = nil, want error")
+	}
+}
+
+func TestClient(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Interface {
+		client, err := New(&Config{Path: filepath.Join(t.TempDir(), "dsync.db")})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		t.Cleanup(func() { _ = client.Close() })
+		return client
+	})
+}
+
+func TestClient_RangeBuffer(t *testing.T) {
+	ctx := context.Background()
+	client, err := New(&Config{Path: filepath.Join(t.TempDir(), "dsync.db")})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	value := bytes.Repeat([]byte("v"), 1<<20)
+	var want []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("p/%d", i)
+		if err := client.Add(ctx, "space", key, value); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		want = append(want, key)
+	}
+
+	// Only the pairs up to the buffer size are copied at a time.
+	err = client.db.View(func(tx *bolt.Tx) error {
+		pairs, more := rangePairs(tx, "space", "p/", "", nil)
+		if n := len(pairs); !more || n*len(value) > rangeBufferSize+len(value) {
+			t.Errorf("rangePairs() copied %d pairs, more = %v, want at most %d", n, more, rangeBufferSize/len(value)+1)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View() error = %v", err)
+	}
+
+	// The range continues after the buffer, while fn writes to the storage.
+	var got []string
+	err = client.RangePrefix(ctx, "space", "p/", "", func(key, value []byte) error {
+		got = append(got, string(key))
+		return client.Add(ctx, "space", "q/"+string(key), nil)
+	})
+	if err != nil {
+		t.Fatalf("RangePrefix() error = %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("RangePrefix() keys = %v, want %v", got, want)
+	}
+
+	got = got[:0]
+	err = client.Update(ctx, func(txn storage.Txn) error {
+		return txn.RangePrefix(ctx, "space", "p/", "", func(key, value []byte) error {
+			got = append(got, string(key))
+			return txn.Del(ctx, "space", string(key))
+		})
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Txn.RangePrefix() keys = %v, want %v", got, want)
+	}
+}
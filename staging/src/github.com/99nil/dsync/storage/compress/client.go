@@ -0,0 +1,172 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compress
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/99nil/dsync/storage"
+)
+
+var _ storage.Interface = (*Client)(nil)
+
+// magic is the header of the values written by the client, followed by the encoding id and the payload.
+// The values without it were written before the compression is enabled, and are returned as is.
+var magic = []byte("DSZ")
+
+// The encoding ids in the header of the stored values
+const (
+	idIdentity byte = iota
+	idZstd
+)
+
+// Config defines the compression of the values in storage.
+type Config struct {
+	// Threshold is the size in bytes below which the values are stored uncompressed,
+	// DefaultThreshold is used if it is 0.
+	Threshold int `json:"threshold,omitempty"`
+}
+
+// Client is a storage decorator that compresses the values with zstd.
+type Client struct {
+	storage.Interface
+	threshold int
+}
+
+func New(backend storage.Interface, cfg *Config) (*Client, error) {
+	if backend == nil {
+		return nil, errors.New("storage unavailable")
+	}
+	threshold := cfg.Threshold
+	if threshold == 0 {
+		threshold = DefaultThreshold
+	}
+	return &Client{Interface: backend, threshold: threshold}, nil
+}
+
+// Unwrap returns the decorated storage
+func (c *Client) Unwrap() storage.Interface {
+	return c.Interface
+}
+
+func (c *Client) encode(value []byte) ([]byte, error) {
+	if len(value) < c.threshold {
+		// Only the small value which looks like an encoded one needs the header to be read back.
+		if !bytes.HasPrefix(value, magic) {
+			return value, nil
+		}
+		return frame(idIdentity, value), nil
+	}
+	compressed, err := Compress(Zstd, value)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) >= len(value) && !bytes.HasPrefix(value, magic) {
+		return value, nil
+	}
+	return frame(idZstd, compressed), nil
+}
+
+func frame(id byte, payload []byte) []byte {
+	out := make([]byte, 0, len(magic)+1+len(payload))
+	out = append(out, magic...)
+	out = append(out, id)
+	return append(out, payload...)
+}
+
+func decode(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, magic) || len(value) < len(magic)+1 {
+		return value, nil
+	}
+	payload := value[len(magic)+1:]
+	switch value[len(magic)] {
+	case idIdentity:
+		return payload, nil
+	case idZstd:
+		return Decompress(Zstd, payload)
+	}
+	return nil, ErrUnsupportedEncoding
+}
+
+func decodeFunc(fn func(key, value []byte) error) func(key, value []byte) error {
+	return func(key, value []byte) error {
+		plain, err := decode(value)
+		if err != nil {
+			return err
+		}
+		return fn(key, plain)
+	}
+}
+
+func (c *Client) Get(ctx context.Context, space, key string) ([]byte, error) {
+	value, err := c.Interface.Get(ctx, space, key)
+	if err != nil || value == nil {
+		return value, err
+	}
+	return decode(value)
+}
+
+func (c *Client) Add(ctx context.Context, space, key string, value []byte) error {
+	encoded, err := c.encode(value)
+	if err != nil {
+		return err
+	}
+	return c.Interface.Add(ctx, space, key, encoded)
+}
+
+func (c *Client) Range(ctx context.Context, space string, fn func(key, value []byte) error) error {
+	return c.Interface.Range(ctx, space, decodeFunc(fn))
+}
+
+func (c *Client) RangePrefix(ctx context.Context, space, prefix, start string, fn func(key, value []byte) error) error {
+	return c.Interface.RangePrefix(ctx, space, prefix, start, decodeFunc(fn))
+}
+
+func (c *Client) Update(ctx context.Context, fn func(txn storage.Txn) error) error {
+	return c.Interface.Update(ctx, func(txn storage.Txn) error {
+		return fn(&compressTxn{Txn: txn, client: c})
+	})
+}
+
+type compressTxn struct {
+	storage.Txn
+	client *Client
+}
+
+func (t *compressTxn) Get(ctx context.Context, space, key string) ([]byte, error) {
+	value, err := t.Txn.Get(ctx, space, key)
+	if err != nil || value == nil {
+		return value, err
+	}
+	return decode(value)
+}
+
+func (t *compressTxn) Add(ctx context.Context, space, key string, value []byte) error {
+	encoded, err := t.client.encode(value)
+	if err != nil {
+		return err
+	}
+	return t.Txn.Add(ctx, space, key, encoded)
+}
+
+func (t *compressTxn) Range(ctx context.Context, space string, fn func(key, value []byte) error) error {
+	return t.Txn.Range(ctx, space, decodeFunc(fn))
+}
+
+func (t *compressTxn) RangePrefix(ctx context.Context, space, prefix, start string, fn func(key, value []byte) error) error {
+	return t.Txn.RangePrefix(ctx, space, prefix, start, decodeFunc(fn))
+}
@@ -0,0 +1,99 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compress
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/storage/memory"
+	"github.com/99nil/dsync/storage/storagetest"
+)
+
+func newTestClient(t *testing.T, threshold int) (*Client, storage.Interface) {
+	t.Helper()
+	backend, err := memory.New(&memory.Config{})
+	if err != nil {
+		t.Fatalf("memory.New() error = %v", err)
+	}
+	client, err := New(backend, &Config{Threshold: threshold})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return client, backend
+}
+
+func TestClient(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Interface {
+		client, _ := newTestClient(t, 4)
+		return client
+	})
+}
+
+func TestDecompress_MaxSize(t *testing.T) {
+	value, err := Compress(Zstd, make([]byte, MaxDecompressedSize+1))
+	if err != nil {
+		t.Fatalf("Compress() error = %v", err)
+	}
+	if _, err := Decompress(Zstd, value); err == nil {
+		t.Errorf("Decompress() of %d bytes into %d bytes succeeded, want error", len(value), MaxDecompressedSize+1)
+	}
+
+	value, err = Compress(Zstd, make([]byte, MaxDecompressedSize))
+	if err != nil {
+		t.Fatalf("Compress() error = %v", err)
+	}
+	if got, err := Decompress(Zstd, value); err != nil || len(got) != MaxDecompressedSize {
+		t.Errorf("Decompress() = %d bytes, %v, want %d bytes", len(got), err, MaxDecompressedSize)
+	}
+}
+
+func TestClient_Compressed(t *testing.T) {
+	ctx := context.Background()
+	client, backend := newTestClient(t, 0)
+
+	large := []byte(strings.Repeat(`{"apiVersion":"v1","kind":"ConfigMap"},`, 100))
+	small := []byte(`{"kind":"Pod"}`)
+	// The small value looks like an encoded one, it must not be misread.
+	tricky := append(append([]byte(nil), magic...), idZstd, 'x')
+	values := map[string][]byte{"large": large, "small": small, "tricky": tricky}
+	for key, value := range values {
+		if err := client.Add(ctx, "space", key, value); err != nil {
+			t.Fatalf("Add(%s) error = %v", key, err)
+		}
+	}
+	// The value written before the compression is enabled is returned as is.
+	if err := backend.Add(ctx, "space", "legacy", large); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	values["legacy"] = large
+
+	for key, value := range values {
+		got, err := client.Get(ctx, "space", key)
+		if err != nil || !bytes.Equal(got, value) {
+			t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, value)
+		}
+	}
+	raw, _ := backend.Get(ctx, "space", "large")
+	if !bytes.HasPrefix(raw, magic) || len(raw) >= len(large)/5 {
+		t.Errorf("large value is stored in %d bytes, want compressed from %d", len(raw), len(large))
+	}
+	if raw, _ := backend.Get(ctx, "space", "small"); !bytes.Equal(raw, small) {
+		t.Errorf("small value is stored as %q, want uncompressed", raw)
+	}
+}
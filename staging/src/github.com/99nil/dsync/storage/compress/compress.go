@@ -0,0 +1,103 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compress
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Encoding is the name of the compression algorithm of a value
+type Encoding string
+
+const (
+	// Identity means the value is not compressed
+	Identity Encoding = ""
+	Zstd     Encoding = "zstd"
+)
+
+// DefaultThreshold is the size in bytes below which the values are not compressed,
+// the frame overhead outweighs the saving for them.
+const DefaultThreshold = 512
+
+// MaxDecompressedSize is the size in bytes above which a value is not decompressed,
+// so that a small crafted frame can not exhaust the memory of the process.
+const MaxDecompressedSize = 64 << 20
+
+var ErrUnsupportedEncoding = errors.New("unsupported encoding")
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// initZstd creates the shared zstd encoder and decoder,
+// EncodeAll and DecodeAll can be called concurrently on them.
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxDecompressedSize))
+	})
+	return zstdErr
+}
+
+// Supported reports whether the encoding can be compressed and decompressed
+func Supported(encoding Encoding) bool {
+	return encoding == Identity || encoding == Zstd
+}
+
+// Compress compresses the value with the encoding.
+func Compress(encoding Encoding, value []byte) ([]byte, error) {
+	switch encoding {
+	case Identity:
+		return value, nil
+	case Zstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(value, nil), nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+}
+
+// Decompress decompresses the value compressed with the encoding,
+// it fails if the decompressed value is larger than MaxDecompressedSize.
+func Decompress(encoding Encoding, value []byte) ([]byte, error) {
+	switch encoding {
+	case Identity:
+		return value, nil
+	case Zstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		out, err := zstdDecoder.DecodeAll(value, nil)
+		if err != nil {
+			return nil, err
+		}
+		if out == nil {
+			out = []byte{}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+}
@@ -0,0 +1,343 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/99nil/dsync/storage"
+)
+
+var _ storage.Interface = (*Client)(nil)
+
+var (
+	ErrNoKey        = errors.New("no encryption key")
+	ErrUnknownKey   = errors.New("unknown encryption key")
+	ErrNotEncrypted = errors.New("value is not encrypted")
+)
+
+// magic is the header of the encrypted values, followed by the version,
+// the length of the key id, the key id, the nonce and the sealed value.
+// The values without it were written before the encryption is enabled,
+// they are rejected unless the plaintext is allowed for the migration.
+var magic = []byte("DSE")
+
+const version1 = 1
+
+// Config defines where to load the keys from, the file takes precedence over the environment variable.
+// The keys are a list of "<id>:<base64 encoded AES key>" separated by newlines or commas,
+// the last one encrypts the values written, and the others are only used to decrypt.
+// The AES key must be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256.
+type Config struct {
+	KeyFile string `json:"keyFile,omitempty"`
+	KeyEnv  string `json:"keyEnv,omitempty"`
+
+	// AllowPlaintext returns the values written before the encryption is enabled as is,
+	// so that Reencrypt can encrypt them. It is only meant for the migration,
+	// and should be disabled after Reencrypt finishes, otherwise a plaintext value written
+	// to the backend directly is accepted as if it was encrypted.
+	AllowPlaintext bool `json:"allowPlaintext,omitempty"`
+}
+
+// LoadKeys loads the keys from the file or the environment variable of the config.
+func (c *Config) LoadKeys() (*Keyring, error) {
+	var text string
+	switch {
+	case c.KeyFile != "":
+		b, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	case c.KeyEnv != "":
+		text = os.Getenv(c.KeyEnv)
+	}
+	return ParseKeys(text)
+}
+
+// Keyring holds the AES-GCM ciphers by key id
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// ParseKeys parses the keys in the format described in Config.
+func ParseKeys(text string) (*Keyring, error) {
+	kr := &Keyring{aeads: make(map[string]cipher.AEAD)}
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == '\n' || r == '\r' || r == ','
+	})
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 255 {
+			return nil, errors.New("encryption key must be in the format <id>:<base64 key>")
+		}
+		id := parts[0]
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s is not valid base64: %v", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s is invalid: %v", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		kr.aeads[id] = aead
+		kr.primary = id
+	}
+	if kr.primary == "" {
+		return nil, ErrNoKey
+	}
+	return kr, nil
+}
+
+// Primary returns the id of the key encrypting the values written
+func (kr *Keyring) Primary() string {
+	return kr.primary
+}
+
+// additionalData binds the encrypted value to its location,
+// so that it can not be moved to another key without being detected.
+func additionalData(space, key string) []byte {
+	return []byte(space + "\x00" + key)
+}
+
+func (kr *Keyring) encrypt(space, key string, value []byte) ([]byte, error) {
+	aead := kr.aeads[kr.primary]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(magic)+2+len(kr.primary)+len(nonce)+len(value)+aead.Overhead())
+	out = append(out, magic...)
+	out = append(out, version1, byte(len(kr.primary)))
+	out = append(out, kr.primary...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, value, additionalData(space, key)), nil
+}
+
+// keyID returns the id of the key encrypting the value, ok is false if the value is not encrypted.
+func keyID(value []byte) (id string, rest []byte, ok bool) {
+	if !bytes.HasPrefix(value, magic) || len(value) < len(magic)+2 || value[len(magic)] != version1 {
+		return "", nil, false
+	}
+	value = value[len(magic)+1:]
+	n := int(value[0])
+	if len(value) < 1+n {
+		return "", nil, false
+	}
+	return string(value[1 : 1+n]), value[1+n:], true
+}
+
+func (kr *Keyring) decrypt(space, key string, value []byte, allowPlaintext bool) ([]byte, error) {
+	id, rest, ok := keyID(value)
+	if !ok {
+		if allowPlaintext {
+			return value, nil
+		}
+		return nil, fmt.Errorf("%w: value of %s in %s", ErrNotEncrypted, key, space)
+	}
+	aead, ok := kr.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted value of %s in %s is truncated", key, space)
+	}
+	nonce, sealed := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, additionalData(space, key))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt value of %s in %s failed: %v", key, space, err)
+	}
+	if plain == nil {
+		plain = []byte{}
+	}
+	return plain, nil
+}
+
+// Client is a storage decorator that encrypts the values with AES-GCM,
+// the keys and the spaces are stored in plaintext for ordering and prefix ranges.
+type Client struct {
+	storage.Interface
+	keyring        *Keyring
+	allowPlaintext bool
+}
+
+func New(backend storage.Interface, cfg *Config) (*Client, error) {
+	keyring, err := cfg.LoadKeys()
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewWithKeyring(backend, keyring)
+	if err != nil {
+		return nil, err
+	}
+	client.allowPlaintext = cfg.AllowPlaintext
+	return client, nil
+}
+
+func NewWithKeyring(backend storage.Interface, keyring *Keyring) (*Client, error) {
+	if backend == nil {
+		return nil, errors.New("storage unavailable")
+	}
+	if keyring == nil {
+		return nil, ErrNoKey
+	}
+	return &Client{Interface: backend, keyring: keyring}, nil
+}
+
+// Unwrap returns the decorated storage
+func (c *Client) Unwrap() storage.Interface {
+	return c.Interface
+}
+
+func (c *Client) Get(ctx context.Context, space, key string) ([]byte, error) {
+	value, err := c.Interface.Get(ctx, space, key)
+	if err != nil || value == nil {
+		return value, err
+	}
+	return c.keyring.decrypt(space, key, value, c.allowPlaintext)
+}
+
+func (c *Client) Add(ctx context.Context, space, key string, value []byte) error {
+	sealed, err := c.keyring.encrypt(space, key, value)
+	if err != nil {
+		return err
+	}
+	return c.Interface.Add(ctx, space, key, sealed)
+}
+
+func (c *Client) Range(ctx context.Context, space string, fn func(key, value []byte) error) error {
+	return c.Interface.Range(ctx, space, decryptFunc(c.keyring, c.allowPlaintext, space, fn))
+}
+
+func (c *Client) RangePrefix(ctx context.Context, space, prefix, start string, fn func(key, value []byte) error) error {
+	return c.Interface.RangePrefix(ctx, space, prefix, start, decryptFunc(c.keyring, c.allowPlaintext, space, fn))
+}
+
+func (c *Client) Update(ctx context.Context, fn func(txn storage.Txn) error) error {
+	return c.Interface.Update(ctx, func(txn storage.Txn) error {
+		return fn(&encryptTxn{Txn: txn, keyring: c.keyring, allowPlaintext: c.allowPlaintext})
+	})
+}
+
+func decryptFunc(keyring *Keyring, allowPlaintext bool, space string, fn func(key, value []byte) error) func(key, value []byte) error {
+	return func(key, value []byte) error {
+		plain, err := keyring.decrypt(space, string(key), value, allowPlaintext)
+		if err != nil {
+			return err
+		}
+		return fn(key, plain)
+	}
+}
+
+// Reencrypt rewrites the values in the spaces that are not encrypted with the primary key,
+// and returns the number of them. The values written before the encryption is enabled
+// are only rewritten if the plaintext is allowed, otherwise it fails with ErrNotEncrypted.
+// After it finishes, the previous keys can be removed from the keyring, and the plaintext disallowed.
+func (c *Client) Reencrypt(ctx context.Context, spaces ...string) (int, error) {
+	var count int
+	for _, space := range spaces {
+		var keys []string
+		err := c.Interface.Range(ctx, space, func(key, value []byte) error {
+			if id, _, ok := keyID(value); !ok || id != c.keyring.primary {
+				keys = append(keys, string(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return count, err
+		}
+
+		for _, key := range keys {
+			var rewritten bool
+			err := c.Interface.Update(ctx, func(txn storage.Txn) error {
+				rewritten = false
+				// Check again in the transaction, the value may have been updated.
+				raw, err := txn.Get(ctx, space, key)
+				if err != nil || raw == nil {
+					return err
+				}
+				if id, _, ok := keyID(raw); ok && id == c.keyring.primary {
+					return nil
+				}
+				value, err := c.keyring.decrypt(space, key, raw, c.allowPlaintext)
+				if err != nil {
+					return err
+				}
+				sealed, err := c.keyring.encrypt(space, key, value)
+				if err != nil {
+					return err
+				}
+				rewritten = true
+				return txn.Add(ctx, space, key, sealed)
+			})
+			if err != nil {
+				return count, err
+			}
+			if rewritten {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+type encryptTxn struct {
+	storage.Txn
+	keyring        *Keyring
+	allowPlaintext bool
+}
+
+func (t *encryptTxn) Get(ctx context.Context, space, key string) ([]byte, error) {
+	value, err := t.Txn.Get(ctx, space, key)
+	if err != nil || value == nil {
+		return value, err
+	}
+	return t.keyring.decrypt(space, key, value, t.allowPlaintext)
+}
+
+func (t *encryptTxn) Add(ctx context.Context, space, key string, value []byte) error {
+	sealed, err := t.keyring.encrypt(space, key, value)
+	if err != nil {
+		return err
+	}
+	return t.Txn.Add(ctx, space, key, sealed)
+}
+
+func (t *encryptTxn) Range(ctx context.Context, space string, fn func(key, value []byte) error) error {
+	return t.Txn.Range(ctx, space, decryptFunc(t.keyring, t.allowPlaintext, space, fn))
+}
+
+func (t *encryptTxn) RangePrefix(ctx context.Context, space, prefix, start string, fn func(key, value []byte) error) error {
+	return t.Txn.RangePrefix(ctx, space, prefix, start, decryptFunc(t.keyring, t.allowPlaintext, space, fn))
+}
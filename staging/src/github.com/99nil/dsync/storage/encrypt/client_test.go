@@ -0,0 +1,214 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/storage/memory"
+	"github.com/99nil/dsync/storage/storagetest"
+)
+
+func newTestKey(t *testing.T, id string) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read() error = %v", err)
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+func newTestClient(t *testing.T, backend storage.Interface, keys string) *Client {
+	t.Helper()
+	keyring, err := ParseKeys(keys)
+	if err != nil {
+		t.Fatalf("ParseKeys() error = %v", err)
+	}
+	client, err := NewWithKeyring(backend, keyring)
+	if err != nil {
+		t.Fatalf("NewWithKeyring() error = %v", err)
+	}
+	return client
+}
+
+func newTestBackend(t *testing.T) storage.Interface {
+	t.Helper()
+	backend, err := memory.New(&memory.Config{})
+	if err != nil {
+		t.Fatalf("memory.New() error = %v", err)
+	}
+	return backend
+}
+
+func TestClient(t *testing.T) {
+	key := newTestKey(t, "k1")
+	storagetest.Run(t, func(t *testing.T) storage.Interface {
+		return newTestClient(t, newTestBackend(t), key)
+	})
+}
+
+func TestClient_Encrypted(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+	client := newTestClient(t, backend, newTestKey(t, "k1"))
+
+	if err := client.Add(ctx, "space", "a", []byte("secret")); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	raw, _ := backend.Get(ctx, "space", "a")
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Errorf("value is stored in plaintext: %q", raw)
+	}
+	if id, _, ok := keyID(raw); !ok || id != "k1" {
+		t.Errorf("keyID() = %s, %v, want k1", id, ok)
+	}
+
+	// The encrypted value can not be moved to another key.
+	if err := backend.Add(ctx, "space", "b", raw); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if _, err := client.Get(ctx, "space", "b"); err == nil {
+		t.Error("Get() of the moved value succeeded, want error")
+	}
+
+	// A keyring without the key can not decrypt it.
+	other := newTestClient(t, backend, newTestKey(t, "k2"))
+	if _, err := other.Get(ctx, "space", "a"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Get() error = %v, want %v", err, ErrUnknownKey)
+	}
+}
+
+func TestClient_Reencrypt(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+	k1, k2 := newTestKey(t, "k1"), newTestKey(t, "k2")
+
+	// The value written before the encryption is enabled is returned as is during the migration.
+	if err := backend.Add(ctx, "space", "plain", []byte("plain")); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	old := newTestClient(t, backend, k1)
+	old.allowPlaintext = true
+	if err := old.Add(ctx, "space", "old", []byte("old")); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if value, err := old.Get(ctx, "space", "plain"); err != nil || string(value) != "plain" {
+		t.Fatalf("Get(plain) = %q, %v, want %q", value, err, "plain")
+	}
+
+	// Rotate to k2, k1 is only used to decrypt.
+	client := newTestClient(t, backend, k1+"\n"+k2)
+	client.allowPlaintext = true
+	if client.keyring.Primary() != "k2" {
+		t.Fatalf("Primary() = %s, want k2", client.keyring.Primary())
+	}
+	if err := client.Add(ctx, "space", "new", []byte("new")); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	count, err := client.Reencrypt(ctx, "space")
+	if err != nil {
+		t.Fatalf("Reencrypt() error = %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Reencrypt() = %d, want 2", count)
+	}
+
+	// k1 can be dropped and the plaintext disallowed after re-encrypting.
+	rotated := newTestClient(t, backend, k2)
+	for _, key := range []string{"plain", "old", "new"} {
+		value, err := rotated.Get(ctx, "space", key)
+		if err != nil || string(value) != key {
+			t.Errorf("Get(%s) = %q, %v, want %q", key, value, err, key)
+		}
+	}
+	if count, _ := rotated.Reencrypt(ctx, "space"); count != 0 {
+		t.Errorf("Reencrypt() = %d again, want 0", count)
+	}
+}
+
+func TestClient_Plaintext(t *testing.T) {
+	ctx := context.Background()
+	backend := newTestBackend(t)
+	key := newTestKey(t, "k1")
+	client := newTestClient(t, backend, key)
+
+	if err := client.Add(ctx, "space", "a", []byte("a")); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := backend.Add(ctx, "space", "b", []byte("forged")); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	if _, err := client.Get(ctx, "space", "b"); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Get() error = %v, want %v", err, ErrNotEncrypted)
+	}
+	err := client.Range(ctx, "space", func(_, _ []byte) error { return nil })
+	if !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Range() error = %v, want %v", err, ErrNotEncrypted)
+	}
+	err = client.Update(ctx, func(txn storage.Txn) error {
+		_, err := txn.Get(ctx, "space", "b")
+		return err
+	})
+	if !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Txn.Get() error = %v, want %v", err, ErrNotEncrypted)
+	}
+	if _, err := client.Reencrypt(ctx, "space"); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Reencrypt() error = %v, want %v", err, ErrNotEncrypted)
+	}
+
+	// The plaintext is only accepted when it is allowed by the config.
+	t.Setenv("DSYNC_TEST_KEYS", key)
+	migrating, err := New(backend, &Config{KeyEnv: "DSYNC_TEST_KEYS", AllowPlaintext: true})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if count, err := migrating.Reencrypt(ctx, "space"); err != nil || count != 1 {
+		t.Fatalf("Reencrypt() = %d, %v, want 1", count, err)
+	}
+	if value, err := client.Get(ctx, "space", "b"); err != nil || string(value) != "forged" {
+		t.Errorf("Get() after Reencrypt() = %q, %v, want %q", value, err, "forged")
+	}
+}
+
+func TestConfig_LoadKeys(t *testing.T) {
+	key := newTestKey(t, "k1")
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if kr, err := (&Config{KeyFile: path}).LoadKeys(); err != nil || kr.Primary() != "k1" {
+		t.Errorf("LoadKeys(file) error = %v", err)
+	}
+
+	t.Setenv("DSYNC_TEST_KEYS", "k0:"+base64.StdEncoding.EncodeToString(make([]byte, 16))+","+key)
+	if kr, err := (&Config{KeyEnv: "DSYNC_TEST_KEYS"}).LoadKeys(); err != nil || kr.Primary() != "k1" {
+		t.Errorf("LoadKeys(env) error = %v", err)
+	}
+
+	for _, keys := range []string{"", "k1", "k1:not-base64", "k1:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := ParseKeys(keys); err == nil {
+			t.Errorf("ParseKeys(%q) succeeded, want error", keys)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/99nil/dsync/storage"
+)
+
+var _ storage.Interface = (*Client)(nil)
+
+// Config defines the memory storage config.
+// There is nothing to configure at present, it is used to select the backend.
+type Config struct{}
+
+// Client is a storage implementation that keeps all data in memory.
+// The data will be lost when the process exits.
+type Client struct {
+	mux    sync.RWMutex
+	spaces map[string]map[string][]byte
+}
+
+func New(_ *Config) (*Client, error) {
+	client := &Client{spaces: make(map[string]map[string][]byte)}
+	return client, nil
+}
+
+func (c *Client) Close() error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.spaces = make(map[string]map[string][]byte)
+	return nil
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
+
+func (c *Client) Get(_ context.Context, space, key string) ([]byte, error) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return copyBytes(c.spaces[space][key]), nil
+}
+
+func (c *Client) Add(ctx context.Context, space, key string, value []byte) error {
+	return c.Update(ctx, func(txn storage.Txn) error {
+		return txn.Add(ctx, space, key, value)
+	})
+}
+
+func (c *Client) Del(ctx context.Context, space, key string) error {
+	return c.Update(ctx, func(txn storage.Txn) error {
+		return txn.Del(ctx, space, key)
+	})
+}
+
+func (c *Client) Clear(_ context.Context, space string) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.spaces, space)
+	return nil
+}
+
+func (c *Client) Range(ctx context.Context, space string, fn func(key, value []byte) error) error {
+	return c.RangePrefix(ctx, space, "", "", fn)
+}
+
+func (c *Client) RangePrefix(_ context.Context, space, prefix, start string, fn func(key, value []byte) error) error {
+	// Take a snapshot of the space, so that fn can operate the storage during iteration.
+	c.mux.RLock()
+	values := make(map[string][]byte)
+	for k, v := range c.spaces[space] {
+		if matchKey(k, prefix, start) {
+			values[k] = v
+		}
+	}
+	c.mux.RUnlock()
+	return rangeValues(values, fn)
+}
+
+// matchKey reports whether the key has the prefix and is not less than start.
+func matchKey(key, prefix, start string) bool {
+	return strings.HasPrefix(key, prefix) && key >= start
+}
+
+// rangeValues calls fn in the lexicographical order of the keys to keep consistent with badger.
+func rangeValues(values map[string][]byte, fn func(key, value []byte) error) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn([]byte(k), copyBytes(values[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update executes fn while holding the write lock, transactions are therefore serialized.
+// fn must only operate the storage through txn, otherwise it will deadlock.
+func (c *Client) Update(_ context.Context, fn func(txn storage.Txn) error) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	txn := &Txn{client: c, writes: make(map[string]map[string][]byte)}
+	if err := fn(txn); err != nil {
+		return err
+	}
+	txn.commit()
+	return nil
+}
+
+var _ storage.Txn = (*Txn)(nil)
+
+// Txn buffers the writes in a transaction until it is committed.
+// A deleted key is recorded as a nil value.
+type Txn struct {
+	client *Client
+	writes map[string]map[string][]byte
+}
+
+func (t *Txn) write(space, key string, value []byte) {
+	data, ok := t.writes[space]
+	if !ok {
+		data = make(map[string][]byte)
+		t.writes[space] = data
+	}
+	data[key] = value
+}
+
+func (t *Txn) commit() {
+	for space, writes := range t.writes {
+		data, ok := t.client.spaces[space]
+		if !ok {
+			data = make(map[string][]byte)
+			t.client.spaces[space] = data
+		}
+		for k, v := range writes {
+			if v == nil {
+				delete(data, k)
+				continue
+			}
+			data[k] = v
+		}
+	}
+}
+
+func (t *Txn) Get(_ context.Context, space, key string) ([]byte, error) {
+	if v, ok := t.writes[space][key]; ok {
+		return copyBytes(v), nil
+	}
+	return copyBytes(t.client.spaces[space][key]), nil
+}
+
+func (t *Txn) Add(_ context.Context, space, key string, value []byte) error {
+	// Keep consistent with badger, an empty value is still a value.
+	if value == nil {
+		value = []byte{}
+	}
+	t.write(space, key, copyBytes(value))
+	return nil
+}
+
+func (t *Txn) Del(_ context.Context, space, key string) error {
+	t.write(space, key, nil)
+	return nil
+}
+
+func (t *Txn) Range(ctx context.Context, space string, fn func(key, value []byte) error) error {
+	return t.RangePrefix(ctx, space, "", "", fn)
+}
+
+func (t *Txn) RangePrefix(_ context.Context, space, prefix, start string, fn func(key, value []byte) error) error {
+	values := make(map[string][]byte)
+	for k, v := range t.client.spaces[space] {
+		if matchKey(k, prefix, start) {
+			values[k] = v
+		}
+	}
+	for k, v := range t.writes[space] {
+		if !matchKey(k, prefix, start) {
+			continue
+		}
+		if v == nil {
+			delete(values, k)
+			continue
+		}
+		values[k] = v
+	}
+	return rangeValues(values, fn)
+}
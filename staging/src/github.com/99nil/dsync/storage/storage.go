@@ -33,4 +33,38 @@ type Interface interface {
 	// Range calls fn sequentially for each key and value present in the storage.
 	// If fn returns error, range stops the iteration.
 	Range(ctx context.Context, space string, fn func(key, value []byte) error) error
+
+	// RangePrefix calls fn sequentially in ascending order of key for each key with the prefix,
+	// starting from the first key not less than start, an empty start means starting from the prefix.
+	// If fn returns error, range stops the iteration.
+	RangePrefix(ctx context.Context, space, prefix, start string, fn func(key, value []byte) error) error
+
+	// Update executes fn in a read-write transaction.
+	// All writes made through txn are committed atomically when fn returns nil,
+	// and discarded when fn returns error.
+	// fn may be called more than once when the transaction conflicts with others,
+	// so it should not have side effects except through txn.
+	Update(ctx context.Context, fn func(txn Txn) error) error
+}
+
+// Txn defines the operations available in a transaction.
+// Reads in a transaction observe the writes made earlier in the same transaction.
+type Txn interface {
+	// Get gets data according to the specified key in current space
+	Get(ctx context.Context, space, key string) ([]byte, error)
+
+	// Add adds a set of key/value pairs in current space
+	Add(ctx context.Context, space, key string, value []byte) error
+
+	// Del deletes key/value pairs according to the specified key in current space
+	Del(ctx context.Context, space, key string) error
+
+	// Range calls fn sequentially for each key and value present in the storage.
+	// If fn returns error, range stops the iteration.
+	Range(ctx context.Context, space string, fn func(key, value []byte) error) error
+
+	// RangePrefix calls fn sequentially in ascending order of key for each key with the prefix,
+	// starting from the first key not less than start, an empty start means starting from the prefix.
+	// If fn returns error, range stops the iteration.
+	RangePrefix(ctx context.Context, space, prefix, start string, fn func(key, value []byte) error) error
 }
@@ -0,0 +1,535 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storagetest provides the behavioral tests that
+// every storage.Interface implementation is expected to pass.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/99nil/dsync/storage"
+)
+
+// Factory returns an empty storage for each test case.
+type Factory func(t *testing.T) storage.Interface
+
+type testCase struct {
+	name string
+	fn   func(t *testing.T, s storage.Interface)
+}
+
+var testCases = []testCase{
+	{name: "get missing key", fn: testGetMissing},
+	{name: "add and get", fn: testAddGet},
+	{name: "value is copied", fn: testValueCopied},
+	{name: "delete", fn: testDel},
+	{name: "space isolation", fn: testSpaceIsolation},
+	{name: "clear only its own space", fn: testClear},
+	{name: "range in key order", fn: testRangeOrder},
+	{name: "range stops on error", fn: testRangeStop},
+	{name: "range is a snapshot", fn: testRangeSnapshot},
+	{name: "range prefix", fn: testRangePrefix},
+	{name: "range prefix in batches", fn: testRangePrefixBatches},
+	{name: "range prefix in update", fn: testUpdateRangePrefix},
+	{name: "concurrent writers", fn: testConcurrentWriters},
+	{name: "update commits atomically", fn: testUpdateCommit},
+	{name: "update discards on error", fn: testUpdateRollback},
+	{name: "update reads its own writes", fn: testUpdateReadOwnWrites},
+	{name: "concurrent updates", fn: testConcurrentUpdates},
+}
+
+// Run runs the whole suite against the storage created by factory.
+func Run(t *testing.T, factory Factory) {
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, factory(t))
+		})
+	}
+}
+
+func mustAdd(t *testing.T, s storage.Interface, space, key, value string) {
+	t.Helper()
+	if err := s.Add(context.Background(), space, key, []byte(value)); err != nil {
+		t.Fatalf("Add(%s, %s) error = %v", space, key, err)
+	}
+}
+
+func mustGet(t *testing.T, s storage.Interface, space, key string) []byte {
+	t.Helper()
+	value, err := s.Get(context.Background(), space, key)
+	if err != nil {
+		t.Fatalf("Get(%s, %s) error = %v", space, key, err)
+	}
+	return value
+}
+
+func rangeKeys(t *testing.T, s storage.Interface, space string) []string {
+	t.Helper()
+	var keys []string
+	err := s.Range(context.Background(), space, func(key, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Range(%s) error = %v", space, err)
+	}
+	return keys
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testGetMissing(t *testing.T, s storage.Interface) {
+	if value := mustGet(t, s, "space", "missing"); value != nil {
+		t.Errorf("Get() = %q, want nil", value)
+	}
+	// Reading from a space that has never been written must behave the same.
+	if value := mustGet(t, s, "missing", "missing"); value != nil {
+		t.Errorf("Get() = %q, want nil", value)
+	}
+}
+
+func testAddGet(t *testing.T, s storage.Interface) {
+	mustAdd(t, s, "space", "key", "v1")
+	if value := mustGet(t, s, "space", "key"); string(value) != "v1" {
+		t.Errorf("Get() = %q, want %q", value, "v1")
+	}
+	mustAdd(t, s, "space", "key", "v2")
+	if value := mustGet(t, s, "space", "key"); string(value) != "v2" {
+		t.Errorf("Get() after overwrite = %q, want %q", value, "v2")
+	}
+}
+
+func testValueCopied(t *testing.T, s storage.Interface) {
+	ctx := context.Background()
+	value := []byte("value")
+	if err := s.Add(ctx, "space", "key", value); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	copy(value, "xxxxx")
+
+	got := mustGet(t, s, "space", "key")
+	if string(got) != "value" {
+		t.Fatalf("Get() = %q, the storage must not retain the caller's slice", got)
+	}
+	copy(got, "yyyyy")
+	if got := mustGet(t, s, "space", "key"); string(got) != "value" {
+		t.Errorf("Get() = %q, the caller must be able to retain the returned slice", got)
+	}
+}
+
+func testDel(t *testing.T, s storage.Interface) {
+	ctx := context.Background()
+	mustAdd(t, s, "space", "key", "value")
+	if err := s.Del(ctx, "space", "key"); err != nil {
+		t.Fatalf("Del() error = %v", err)
+	}
+	if value := mustGet(t, s, "space", "key"); value != nil {
+		t.Errorf("Get() after Del() = %q, want nil", value)
+	}
+	if err := s.Del(ctx, "space", "missing"); err != nil {
+		t.Errorf("Del() of missing key error = %v, want nil", err)
+	}
+}
+
+func testSpaceIsolation(t *testing.T, s storage.Interface) {
+	mustAdd(t, s, "a", "key", "a")
+	mustAdd(t, s, "a_b", "key", "a_b")
+	mustAdd(t, s, "a_b", "other", "a_b")
+	mustAdd(t, s, "a-b", "b-key", "a-b")
+
+	if value := mustGet(t, s, "a", "key"); string(value) != "a" {
+		t.Errorf("Get(a) = %q, want %q", value, "a")
+	}
+	if value := mustGet(t, s, "a_b", "key"); string(value) != "a_b" {
+		t.Errorf("Get(a_b) = %q, want %q", value, "a_b")
+	}
+	if value := mustGet(t, s, "a", "other"); value != nil {
+		t.Errorf("Get(a, other) = %q, want nil", value)
+	}
+	if value := mustGet(t, s, "a", "b-key"); value != nil {
+		t.Errorf("Get(a, b-key) = %q, want nil", value)
+	}
+	if keys := rangeKeys(t, s, "a"); !equalKeys(keys, []string{"key"}) {
+		t.Errorf("Range(a) keys = %v, want [key]", keys)
+	}
+	if keys := rangeKeys(t, s, "a-b"); !equalKeys(keys, []string{"b-key"}) {
+		t.Errorf("Range(a-b) keys = %v, want [b-key]", keys)
+	}
+}
+
+func testClear(t *testing.T, s storage.Interface) {
+	mustAdd(t, s, "a", "key", "a")
+	mustAdd(t, s, "a_b", "key", "a_b")
+	mustAdd(t, s, "a-b", "key", "a-b")
+	mustAdd(t, s, "b", "key", "b")
+
+	if err := s.Clear(context.Background(), "a"); err != nil {
+		t.Fatalf("Clear() error = %v", err)
+	}
+	if keys := rangeKeys(t, s, "a"); len(keys) != 0 {
+		t.Errorf("Range(a) after Clear() keys = %v, want empty", keys)
+	}
+	if value := mustGet(t, s, "a_b", "key"); string(value) != "a_b" {
+		t.Errorf("Get(a_b) after Clear(a) = %q, want %q", value, "a_b")
+	}
+	if value := mustGet(t, s, "a-b", "key"); string(value) != "a-b" {
+		t.Errorf("Get(a-b) after Clear(a) = %q, want %q", value, "a-b")
+	}
+	if value := mustGet(t, s, "b", "key"); string(value) != "b" {
+		t.Errorf("Get(b) after Clear(a) = %q, want %q", value, "b")
+	}
+}
+
+func testRangeSnapshot(t *testing.T, s storage.Interface) {
+	ctx := context.Background()
+	var want []string
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		mustAdd(t, s, "space", key, "value")
+		want = append(want, key)
+	}
+
+	// The writes during iteration are not seen by the range that has started.
+	var got []string
+	err := s.Range(ctx, "space", func(key, _ []byte) error {
+		if len(got) == 0 {
+			if err := s.Del(ctx, "space", want[len(want)-1]); err != nil {
+				return err
+			}
+			if err := s.Add(ctx, "space", "key-999", []byte("value")); err != nil {
+				return err
+			}
+		}
+		got = append(got, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Range() error = %v", err)
+	}
+	if !equalKeys(got, want) {
+		t.Errorf("Range() got %d keys, want the %d keys before iteration", len(got), len(want))
+	}
+}
+
+func testRangeOrder(t *testing.T, s storage.Interface) {
+	want := []string{"c", "a", "e", "b", "d", "aa", "ab"}
+	for _, key := range want {
+		mustAdd(t, s, "space", key, "value-"+key)
+	}
+	sort.Strings(want)
+
+	var got []string
+	err := s.Range(context.Background(), "space", func(key, value []byte) error {
+		if !bytes.Equal(value, []byte("value-"+string(key))) {
+			return fmt.Errorf("value of key %q is %q", key, value)
+		}
+		got = append(got, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Range() error = %v", err)
+	}
+	if !equalKeys(got, want) {
+		t.Errorf("Range() keys = %v, want %v", got, want)
+	}
+}
+
+func rangePrefixKeys(t *testing.T, fn func(fn func(key, value []byte) error) error) []string {
+	t.Helper()
+	var keys []string
+	err := fn(func(key, _ []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RangePrefix() error = %v", err)
+	}
+	return keys
+}
+
+func testRangePrefix(t *testing.T, s storage.Interface) {
+	for _, key := range []string{"a", "a/1", "a/2", "a/3", "ab", "b/1", "b/2"} {
+		mustAdd(t, s, "space", key, key)
+	}
+	mustAdd(t, s, "space_a", "a/4", "a/4")
+
+	tests := []struct {
+		prefix string
+		start  string
+		want   []string
+	}{
+		{prefix: "", start: "", want: []string{"a", "a/1", "a/2", "a/3", "ab", "b/1", "b/2"}},
+		{prefix: "a/", start: "", want: []string{"a/1", "a/2", "a/3"}},
+		{prefix: "a/", start: "a/2", want: []string{"a/2", "a/3"}},
+		{prefix: "a/", start: "a/20", want: []string{"a/3"}},
+		{prefix: "a/", start: "a", want: []string{"a/1", "a/2", "a/3"}},
+		{prefix: "a/", start: "b", want: nil},
+		{prefix: "b", start: "", want: []string{"b/1", "b/2"}},
+		{prefix: "c", start: "", want: nil},
+	}
+	for _, tt := range tests {
+		got := rangePrefixKeys(t, func(fn func(key, value []byte) error) error {
+			return s.RangePrefix(context.Background(), "space", tt.prefix, tt.start, fn)
+		})
+		if !equalKeys(got, tt.want) {
+			t.Errorf("RangePrefix(%q, %q) keys = %v, want %v", tt.prefix, tt.start, got, tt.want)
+		}
+	}
+}
+
+func testRangePrefixBatches(t *testing.T, s storage.Interface) {
+	var want []string
+	for i := 0; i < 250; i++ {
+		key := fmt.Sprintf("p/%03d", i)
+		mustAdd(t, s, "space", key, key)
+		want = append(want, key)
+		mustAdd(t, s, "space", fmt.Sprintf("q/%03d", i), key)
+	}
+
+	got := rangePrefixKeys(t, func(fn func(key, value []byte) error) error {
+		return s.RangePrefix(context.Background(), "space", "p/", "", fn)
+	})
+	if !equalKeys(got, want) {
+		t.Errorf("RangePrefix() returned %d keys, want %d", len(got), len(want))
+	}
+}
+
+func testUpdateRangePrefix(t *testing.T, s storage.Interface) {
+	for _, key := range []string{"a/1", "a/2", "b/1"} {
+		mustAdd(t, s, "space", key, key)
+	}
+
+	ctx := context.Background()
+	err := s.Update(ctx, func(txn storage.Txn) error {
+		if err := txn.Add(ctx, "space", "a/0", []byte("a/0")); err != nil {
+			return err
+		}
+		if err := txn.Del(ctx, "space", "a/2"); err != nil {
+			return err
+		}
+		got := rangePrefixKeys(t, func(fn func(key, value []byte) error) error {
+			return txn.RangePrefix(ctx, "space", "a/", "", fn)
+		})
+		if want := []string{"a/0", "a/1"}; !equalKeys(got, want) {
+			t.Errorf("Txn.RangePrefix() keys = %v, want %v", got, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+}
+
+func testRangeStop(t *testing.T, s storage.Interface) {
+	for _, key := range []string{"a", "b", "c", "d"} {
+		mustAdd(t, s, "space", key, key)
+	}
+
+	stop := errors.New("stop")
+	var count int
+	err := s.Range(context.Background(), "space", func(_, _ []byte) error {
+		count++
+		if count == 2 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop {
+		t.Errorf("Range() error = %v, want %v", err, stop)
+	}
+	if count != 2 {
+		t.Errorf("Range() called fn %d times, want 2", count)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, s storage.Interface) {
+	const (
+		writers = 8
+		keys    = 50
+	)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < keys; j++ {
+				key := fmt.Sprintf("%02d-%03d", i, j)
+				if err := s.Add(ctx, "space", key, []byte(key)); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("concurrent Add() error = %v", err)
+	}
+
+	if got := rangeKeys(t, s, "space"); len(got) != writers*keys {
+		t.Errorf("Range() got %d keys, want %d", len(got), writers*keys)
+	}
+}
+
+func testUpdateCommit(t *testing.T, s storage.Interface) {
+	ctx := context.Background()
+	mustAdd(t, s, "space", "del", "value")
+	err := s.Update(ctx, func(txn storage.Txn) error {
+		if err := txn.Add(ctx, "space", "a", []byte("a")); err != nil {
+			return err
+		}
+		if err := txn.Add(ctx, "other", "b", []byte("b")); err != nil {
+			return err
+		}
+		return txn.Del(ctx, "space", "del")
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if value := mustGet(t, s, "space", "a"); string(value) != "a" {
+		t.Errorf("Get(space, a) = %q, want %q", value, "a")
+	}
+	if value := mustGet(t, s, "other", "b"); string(value) != "b" {
+		t.Errorf("Get(other, b) = %q, want %q", value, "b")
+	}
+	if value := mustGet(t, s, "space", "del"); value != nil {
+		t.Errorf("Get(space, del) = %q, want nil", value)
+	}
+}
+
+func testUpdateRollback(t *testing.T, s storage.Interface) {
+	ctx := context.Background()
+	mustAdd(t, s, "space", "keep", "value")
+
+	abort := errors.New("abort")
+	err := s.Update(ctx, func(txn storage.Txn) error {
+		if err := txn.Add(ctx, "space", "a", []byte("a")); err != nil {
+			return err
+		}
+		if err := txn.Del(ctx, "space", "keep"); err != nil {
+			return err
+		}
+		return abort
+	})
+	if err != abort {
+		t.Fatalf("Update() error = %v, want %v", err, abort)
+	}
+	if value := mustGet(t, s, "space", "a"); value != nil {
+		t.Errorf("Get(space, a) = %q, want nil", value)
+	}
+	if value := mustGet(t, s, "space", "keep"); string(value) != "value" {
+		t.Errorf("Get(space, keep) = %q, want %q", value, "value")
+	}
+}
+
+func testUpdateReadOwnWrites(t *testing.T, s storage.Interface) {
+	ctx := context.Background()
+	mustAdd(t, s, "space", "a", "a")
+	mustAdd(t, s, "space", "b", "b")
+
+	err := s.Update(ctx, func(txn storage.Txn) error {
+		if err := txn.Add(ctx, "space", "c", []byte("c")); err != nil {
+			return err
+		}
+		if err := txn.Del(ctx, "space", "a"); err != nil {
+			return err
+		}
+		value, err := txn.Get(ctx, "space", "c")
+		if err != nil {
+			return err
+		}
+		if string(value) != "c" {
+			return fmt.Errorf("txn.Get(space, c) = %q, want %q", value, "c")
+		}
+		if value, err = txn.Get(ctx, "space", "a"); err != nil {
+			return err
+		}
+		if value != nil {
+			return fmt.Errorf("txn.Get(space, a) = %q, want nil", value)
+		}
+
+		var keys []string
+		err = txn.Range(ctx, "space", func(key, _ []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !equalKeys(keys, []string{"b", "c"}) {
+			return fmt.Errorf("txn.Range() keys = %v, want [b c]", keys)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testConcurrentUpdates(t *testing.T, s storage.Interface) {
+	const workers = 8
+	ctx := context.Background()
+
+	// Every worker increases the same counter in a read-modify-write transaction,
+	// no increment may be lost.
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.Update(ctx, func(txn storage.Txn) error {
+				value, err := txn.Get(ctx, "space", "counter")
+				if err != nil {
+					return err
+				}
+				return txn.Add(ctx, "space", "counter", append(value, 'x'))
+			})
+			if err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("concurrent Update() error = %v", err)
+	}
+
+	if value := mustGet(t, s, "space", "counter"); len(value) != workers {
+		t.Errorf("Get(counter) = %q, want %d increments", value, workers)
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
+)
+
+// subscription appends the UIDs to an ordered log shared by all bound syncers,
+// so the cost of adding does not grow with the number of syncers.
+//
+// The storage layout is as follows:
+//   - log space of each subscription: KSUID => UID
+//   - member space of each subscription: syncer name => empty
+//   - binding space: syncer name => names of the bound subscriptions
+//   - cursor space: syncer name => the latest state synchronized by the syncer
+//
+// The appends of the instance are serialized by appendMux, the cursor of a syncer moves past the KSUIDs
+// it has synchronized, so a smaller KSUID appended afterwards would never be synchronized.
+type subscription struct {
+	name              string
+	storage           storage.Interface
+	notifier          *notifier
+	appendMux         *sync.Mutex
+	logOperation      OperateInterface
+	memberOperation   OperateInterface
+	registryOperation OperateInterface
+	bindingOperation  OperateInterface
+	cursorOperation   OperateInterface
+	customOperation   OperateInterface
+}
+
+func newSubscription(insName string, name string, storage storage.Interface, notifier *notifier, appendMux *sync.Mutex) *subscription {
+	s := &subscription{name: name, storage: storage, notifier: notifier, appendMux: appendMux}
+	s.logOperation = newSpaceOperation(buildName(spaceLogPrefix, insName, name), storage)
+	s.memberOperation = newSpaceOperation(buildName(spaceMemberPrefix, insName, name), storage)
+	s.registryOperation = newSpaceOperation(buildName(spaceSubscriptionPrefix, insName), storage)
+	s.bindingOperation = newSpaceOperation(buildName(spaceBindingPrefix, insName), storage)
+	s.cursorOperation = newSpaceOperation(buildName(spaceCursorPrefix, insName), storage)
+	s.customOperation = newSpaceOperation(buildName(spaceRelatePrefix, insName), storage)
+	return s
+}
+
+func (s *subscription) Add(ctx context.Context, uids ...suid.UID) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	s.appendMux.Lock()
+	uids, err := filterUIDs(ctx, s.customOperation, uids)
+	if err == nil {
+		err = s.storage.Update(ctx, func(txn storage.Txn) error {
+			return s.append(ctx, txn, uids...)
+		})
+	}
+	s.appendMux.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.notify(ctx, uids...)
+}
+
+func (s *subscription) append(ctx context.Context, txn storage.Txn, uids ...suid.UID) error {
+	logOperation := s.logOperation.WithTxn(txn)
+	for _, uid := range uids {
+		if err := logOperation.Add(ctx, uid.KSUID().String(), uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notify sends the appended UIDs to the watchers of the members
+func (s *subscription) notify(ctx context.Context, uids ...suid.UID) error {
+	if !s.notifier.watched() {
+		return nil
+	}
+	members, err := s.Members(ctx)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		s.notifier.notify(member, uids...)
+	}
+	return nil
+}
+
+func (s *subscription) Members(ctx context.Context) ([]string, error) {
+	var members []string
+	err := s.memberOperation.Range(ctx, func(key, _ []byte) error {
+		members = append(members, string(key))
+		return nil
+	})
+	return members, err
+}
+
+func (s *subscription) Bind(ctx context.Context, syncer string) error {
+	return s.storage.Update(ctx, func(txn storage.Txn) error {
+		bindings, err := getBindings(ctx, s.bindingOperation.WithTxn(txn), syncer)
+		if err != nil {
+			return err
+		}
+		for _, name := range bindings {
+			if name == s.name {
+				return nil
+			}
+		}
+		bindings = append(bindings, s.name)
+		if err := setBindings(ctx, s.bindingOperation.WithTxn(txn), syncer, bindings); err != nil {
+			return err
+		}
+		if err := s.memberOperation.WithTxn(txn).Add(ctx, syncer, nil); err != nil {
+			return err
+		}
+		if err := s.registryOperation.WithTxn(txn).Add(ctx, s.name, nil); err != nil {
+			return err
+		}
+
+		// The UIDs appended before binding are not synchronized to the syncer,
+		// so the cursor of a syncer that has never synchronized starts from the end of the log.
+		cursorOperation := s.cursorOperation.WithTxn(txn)
+		cursor, err := cursorOperation.Get(ctx, syncer)
+		if err != nil || cursor != nil {
+			return err
+		}
+		var last []byte
+		err = s.logOperation.WithTxn(txn).Range(ctx, func(key, _ []byte) error {
+			last = key
+			return nil
+		})
+		if err != nil || last == nil {
+			return err
+		}
+		return cursorOperation.Add(ctx, syncer, last)
+	})
+}
+
+func (s *subscription) Unbind(ctx context.Context, syncer string) error {
+	return s.storage.Update(ctx, func(txn storage.Txn) error {
+		return s.unbind(ctx, txn, syncer)
+	})
+}
+
+func (s *subscription) unbind(ctx context.Context, txn storage.Txn, syncer string) error {
+	bindingOperation := s.bindingOperation.WithTxn(txn)
+	bindings, err := getBindings(ctx, bindingOperation, syncer)
+	if err != nil {
+		return err
+	}
+	set := make([]string, 0, len(bindings))
+	for _, name := range bindings {
+		if name != s.name {
+			set = append(set, name)
+		}
+	}
+	if len(set) == 0 {
+		if err := bindingOperation.Del(ctx, syncer); err != nil {
+			return err
+		}
+	} else if err := setBindings(ctx, bindingOperation, syncer, set); err != nil {
+		return err
+	}
+	memberOperation := s.memberOperation.WithTxn(txn)
+	if err := memberOperation.Del(ctx, syncer); err != nil {
+		return err
+	}
+
+	// The subscription without members is removed with its log.
+	var exists bool
+	err = memberOperation.Range(ctx, func(_, _ []byte) error {
+		exists = true
+		return nil
+	})
+	if err != nil || exists {
+		return err
+	}
+	if err := s.registryOperation.WithTxn(txn).Del(ctx, s.name); err != nil {
+		return err
+	}
+	logOperation := s.logOperation.WithTxn(txn)
+	return logOperation.Range(ctx, func(key, _ []byte) error {
+		return logOperation.Del(ctx, string(key))
+	})
+}
+
+func (s *subscription) Trim(ctx context.Context) ([]suid.KSUID, error) {
+	var trimmed []suid.KSUID
+	err := s.storage.Update(ctx, func(txn storage.Txn) error {
+		trimmed = nil
+		// Find the minimum cursor of all members,
+		// the UIDs before it have been synchronized by all members.
+		var (
+			min    suid.KSUID
+			exists bool
+		)
+		cursorOperation := s.cursorOperation.WithTxn(txn)
+		err := s.memberOperation.WithTxn(txn).Range(ctx, func(key, _ []byte) error {
+			value, err := cursorOperation.Get(ctx, string(key))
+			if err != nil {
+				return err
+			}
+			cursor := suid.UID(value).KSUID()
+			if !exists || suid.CompareKSUID(cursor, min) < 0 {
+				min = cursor
+			}
+			exists = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		logOperation := s.logOperation.WithTxn(txn)
+		return logOperation.Range(ctx, func(key, _ []byte) error {
+			id, err := suid.ParseKSUID(string(key))
+			if err != nil {
+				return err
+			}
+			// When there is no member, the log is useless.
+			if exists && suid.CompareKSUID(id, min) > 0 {
+				return nil
+			}
+			trimmed = append(trimmed, id)
+			return logOperation.Del(ctx, string(key))
+		})
+	})
+	return trimmed, err
+}
+
+func getBindings(ctx context.Context, op OperateInterface, syncer string) ([]string, error) {
+	value, err := op.Get(ctx, syncer)
+	if err != nil || len(value) == 0 {
+		return nil, err
+	}
+	var bindings []string
+	err = json.Unmarshal(value, &bindings)
+	return bindings, err
+}
+
+func setBindings(ctx context.Context, op OperateInterface, syncer string, bindings []string) error {
+	return op.AddData(ctx, syncer, bindings)
+}
+
+// filterUIDs completes the KSUIDs of the custom UIDs, and ignores those without association relationships.
+func filterUIDs(ctx context.Context, customOperation OperateInterface, uids []suid.UID) ([]suid.UID, error) {
+	set := make([]suid.UID, 0, len(uids))
+	for _, uid := range uids {
+		if uid.IsCustom() {
+			custom := uid.CustomUID()
+			value, err := customOperation.Get(ctx, custom)
+			if err != nil {
+				return nil, err
+			}
+			id, err := suid.ParseKSUID(string(value))
+			if err != nil {
+				return nil, err
+			}
+			if id.IsNil() {
+				continue
+			}
+			uid = suid.NewWithCustom(id, custom)
+		}
+		set = append(set, uid)
+	}
+	return set, nil
+}
@@ -0,0 +1,305 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/99nil/dsync/suid"
+)
+
+func manifestUIDs(t *testing.T, m *suid.AssembleManifest) []string {
+	t.Helper()
+	var uids []string
+	for iter := m.Iter(); iter.Next(); {
+		uids = append(uids, m.GetUID(iter.KSUID).String())
+	}
+	return uids
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSubscription(t *testing.T) {
+	ctx := context.Background()
+	ins := newTestInstance(t)
+	sub := ins.Subscription("sub")
+
+	before := suid.New()
+	if err := sub.Add(ctx, before); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := sub.Bind(ctx, name); err != nil {
+			t.Fatalf("Bind() error = %v", err)
+		}
+	}
+
+	own, u1, u2 := suid.New(), suid.New(), suid.New()
+	if err := ins.Syncer("a").Add(ctx, own); err != nil {
+		t.Fatalf("Syncer.Add() error = %v", err)
+	}
+	if err := sub.Add(ctx, u1, u2); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	// The UIDs appended before binding are not synchronized,
+	// the own sync set and the log are merged in order.
+	m, err := ins.Syncer("a").Manifest(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	want := []string{own.String(), u1.String(), u2.String()}
+	if got := manifestUIDs(t, m); !equalStrings(got, want) {
+		t.Errorf("Manifest() = %v, want %v", got, want)
+	}
+
+	m, err = ins.Syncer("a").Manifest(ctx, u1, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	want = []string{u1.String(), u2.String()}
+	if got := manifestUIDs(t, m); !equalStrings(got, want) {
+		t.Errorf("Manifest(u1) = %v, want %v", got, want)
+	}
+	if _, err := ins.Syncer("a").Manifest(ctx, u2, 0); err != ErrEmptyManifest {
+		t.Errorf("Manifest(u2) error = %v, want %v", err, ErrEmptyManifest)
+	}
+
+	// b has not synchronized u1 yet, only the UIDs before binding can be trimmed.
+	trimmed, err := sub.Trim(ctx)
+	if err != nil {
+		t.Fatalf("Trim() error = %v", err)
+	}
+	if len(trimmed) != 1 || trimmed[0] != before.KSUID() {
+		t.Errorf("Trim() = %v, want [%s]", trimmed, before)
+	}
+	if _, err := ins.Syncer("b").Manifest(ctx, u1, 0); err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	if trimmed, _ = sub.Trim(ctx); len(trimmed) != 1 || trimmed[0] != u1.KSUID() {
+		t.Errorf("Trim() = %v, want [%s]", trimmed, u1)
+	}
+
+	if err := ins.RemoveSyncer(ctx, "b"); err != nil {
+		t.Fatalf("RemoveSyncer() error = %v", err)
+	}
+	if members, _ := sub.Members(ctx); !equalStrings(members, []string{"a"}) {
+		t.Errorf("Members() = %v, want [a]", members)
+	}
+	if trimmed, _ = sub.Trim(ctx); len(trimmed) != 1 || trimmed[0] != u2.KSUID() {
+		t.Errorf("Trim() = %v, want [%s]", trimmed, u2)
+	}
+
+	// The subscription is removed with its log when the last member is removed.
+	if err := sub.Add(ctx, suid.New()); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := ins.RemoveSyncer(ctx, "a"); err != nil {
+		t.Fatalf("RemoveSyncer() error = %v", err)
+	}
+	if names, _ := ins.Subscriptions(ctx); len(names) != 0 {
+		t.Errorf("Subscriptions() = %v, want none", names)
+	}
+	if n := countSpace(t, ins.(*instance).storage, buildName(spaceLogPrefix, "", "sub")); n != 0 {
+		t.Errorf("log has %d UIDs after the last member is removed, want 0", n)
+	}
+}
+
+func TestInstance_Publish(t *testing.T) {
+	ctx := context.Background()
+	ins := newTestInstance(t)
+	if err := ins.Subscription("sub").Bind(ctx, "a"); err != nil {
+		t.Fatalf("Bind() error = %v", err)
+	}
+
+	const publishers, count = 8, 50
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				item := Item{UID: suid.NewByCustom(fmt.Sprintf("item-%d-%d", p, i)), Value: []byte("value")}
+				if err := ins.Publish(ctx, []string{"sub"}, item); err != nil {
+					t.Errorf("Publish() error = %v", err)
+					return
+				}
+			}
+		}(p)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// The syncer keeps moving its cursor while the items are published,
+	// none of the items published concurrently is skipped.
+	seen := make(map[string]struct{})
+	var state suid.UID
+	for finished := false; ; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		m, err := ins.Syncer("a").Manifest(ctx, state, 0)
+		if err == ErrEmptyManifest {
+			if finished {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Manifest() error = %v", err)
+		}
+		for iter := m.Iter(); iter.Next(); {
+			state = m.GetUID(iter.KSUID)
+			seen[state.CustomUID()] = struct{}{}
+		}
+	}
+	if len(seen) != publishers*count {
+		t.Errorf("synchronized %d items, want %d", len(seen), publishers*count)
+	}
+}
+
+func TestSubscription_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ins := newTestInstance(t)
+	sub := ins.Subscription("sub")
+	if err := sub.Bind(ctx, "a"); err != nil {
+		t.Fatalf("Bind() error = %v", err)
+	}
+
+	ch := ins.Syncer("a").Watch(ctx)
+	uid := suid.New()
+	if err := sub.Add(ctx, uid); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	select {
+	case got := <-ch:
+		if got.String() != uid.String() {
+			t.Errorf("Watch() received %s, want %s", got, uid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Watch() received nothing")
+	}
+}
+
+// The number of UIDs pending in each syncer before the benchmark
+const benchPending = 100
+
+var benchNodes = []int{10, 100, 1000}
+
+// BenchmarkSyncer_Add adds a UID to the sync set of every syncer,
+// the cost grows with the number of syncers.
+func BenchmarkSyncer_Add(b *testing.B) {
+	for _, nodes := range benchNodes {
+		b.Run(fmt.Sprintf("nodes=%d", nodes), func(b *testing.B) {
+			ctx := context.Background()
+			ins, _ := New(WithStorageOption(newTestStorage(b)))
+			for i := 0; i < nodes; i++ {
+				for j := 0; j < benchPending; j++ {
+					_ = ins.Syncer(fmt.Sprint(i)).Add(ctx, suid.New())
+				}
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				uid := suid.New()
+				for i := 0; i < nodes; i++ {
+					if err := ins.Syncer(fmt.Sprint(i)).Add(ctx, uid); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSubscription_Add appends a UID to the log shared by all syncers,
+// the cost does not change with the number of syncers.
+func BenchmarkSubscription_Add(b *testing.B) {
+	for _, nodes := range benchNodes {
+		b.Run(fmt.Sprintf("nodes=%d", nodes), func(b *testing.B) {
+			ctx := context.Background()
+			ins, _ := New(WithStorageOption(newTestStorage(b)))
+			sub := ins.Subscription("*")
+			for i := 0; i < nodes; i++ {
+				_ = sub.Bind(ctx, fmt.Sprint(i))
+			}
+			for j := 0; j < benchPending; j++ {
+				_ = sub.Add(ctx, suid.New())
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if err := sub.Add(ctx, suid.New()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// The number of UIDs in the log before the manifest benchmark
+const benchLog = 10000
+
+// BenchmarkSubscription_Manifest gets the manifest of a syncer which is close to the end of a long log,
+// the cost does not grow with the length of the log before the cursor.
+func BenchmarkSubscription_Manifest(b *testing.B) {
+	for _, nodes := range benchNodes {
+		b.Run(fmt.Sprintf("nodes=%d,log=%d", nodes, benchLog), func(b *testing.B) {
+			ctx := context.Background()
+			ins, _ := New(WithStorageOption(newTestStorage(b)))
+			sub := ins.Subscription("*")
+			for i := 0; i < nodes; i++ {
+				_ = sub.Bind(ctx, fmt.Sprint(i))
+			}
+			last := suid.New()
+			for j := 0; j < benchLog; j++ {
+				last = suid.New()
+				_ = sub.Add(ctx, last)
+			}
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				uid := suid.New()
+				if err := sub.Add(ctx, uid); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := ins.Syncer(fmt.Sprint(n%nodes)).Manifest(ctx, last, 0); err != nil {
+					b.Fatal(err)
+				}
+				last = uid
+			}
+		})
+	}
+}
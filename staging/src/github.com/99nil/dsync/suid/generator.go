@@ -0,0 +1,67 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package suid
+
+import (
+	"sync"
+
+	"github.com/segmentio/ksuid"
+)
+
+var defaultGenerator = NewMonotonicGenerator()
+
+// Generator defines the KSUID generator
+type Generator interface {
+	// Next generates a new KSUID
+	Next() KSUID
+
+	// Observe tells the generator an existing KSUID, e.g. the persisted state.
+	// The KSUIDs generated afterwards are greater than it.
+	Observe(id KSUID)
+}
+
+// NewMonotonicGenerator returns a generator whose KSUIDs are strictly increasing.
+// KSUID only has one-second timestamp resolution and a random payload,
+// when the new KSUID is not greater than the last one,
+// the payload of the last one is incremented as a counter instead.
+func NewMonotonicGenerator() Generator {
+	return &monotonicGenerator{}
+}
+
+type monotonicGenerator struct {
+	mux  sync.Mutex
+	last KSUID
+}
+
+func (g *monotonicGenerator) Next() KSUID {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	id := ksuid.New()
+	if CompareKSUID(id, g.last) < 1 {
+		id = g.last.Next()
+	}
+	g.last = id
+	return id
+}
+
+func (g *monotonicGenerator) Observe(id KSUID) {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+
+	if CompareKSUID(id, g.last) > 0 {
+		g.last = id
+	}
+}
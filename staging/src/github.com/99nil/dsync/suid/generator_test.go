@@ -0,0 +1,84 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package suid
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+func TestMonotonicGenerator_Next(t *testing.T) {
+	g := NewMonotonicGenerator()
+	last := g.Next()
+	for i := 0; i < 10000; i++ {
+		id := g.Next()
+		if CompareKSUID(last, id) >= 0 {
+			t.Fatalf("Next() = %s, not greater than %s", id, last)
+		}
+		last = id
+	}
+}
+
+func TestMonotonicGenerator_Concurrent(t *testing.T) {
+	const (
+		workers = 8
+		number  = 1000
+	)
+	g := NewMonotonicGenerator()
+
+	var (
+		mux sync.Mutex
+		wg  sync.WaitGroup
+	)
+	set := make(map[KSUID]struct{}, workers*number)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < number; j++ {
+				id := g.Next()
+				mux.Lock()
+				set[id] = struct{}{}
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(set) != workers*number {
+		t.Errorf("Next() generated %d unique KSUIDs, want %d", len(set), workers*number)
+	}
+}
+
+func TestMonotonicGenerator_Observe(t *testing.T) {
+	// Simulate the state persisted by a process whose clock was ahead.
+	future, err := ksuid.NewRandomWithTime(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("NewRandomWithTime() error = %v", err)
+	}
+
+	g := NewMonotonicGenerator()
+	g.Observe(future)
+	if id := g.Next(); CompareKSUID(future, id) >= 0 {
+		t.Errorf("Next() = %s, not greater than the observed %s", id, future)
+	}
+
+	g.Observe(Nil)
+	if id := g.Next(); CompareKSUID(future, id) >= 0 {
+		t.Errorf("Next() = %s, observing a smaller KSUID must not go backwards", id)
+	}
+}
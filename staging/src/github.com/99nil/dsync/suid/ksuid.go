@@ -33,10 +33,11 @@ type KSUID = ksuid.KSUID
 // list of KSUIDs stored in a set.
 type CompressedSetIter = ksuid.CompressedSetIter
 
-// NewKSUID generates a new KSUID. In the strange case that random bytes
-// can't be read, it will panic.
+// NewKSUID generates a new KSUID with the default monotonic generator,
+// the KSUIDs generated in the process are strictly increasing.
+// In the strange case that random bytes can't be read, it will panic.
 func NewKSUID() KSUID {
-	return ksuid.New()
+	return defaultGenerator.Next()
 }
 
 // CompareKSUID references Compare implementation.
@@ -16,7 +16,11 @@ package suid
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"sort"
 
 	"github.com/segmentio/ksuid"
 )
@@ -33,27 +37,73 @@ func NewManifestFromBytes(b []byte) (*AssembleManifest, error) {
 	return manifest, nil
 }
 
+// ManifestVersion defines the version of the manifest wire format
+type ManifestVersion byte
+
+const (
+	// ManifestVersionLegacy is the format before versioning,
+	// it is only kept for the peers that do not support versions.
+	ManifestVersionLegacy ManifestVersion = 0
+
+	// ManifestVersion1 is the length-prefixed binary format
+	ManifestVersion1 ManifestVersion = 1
+
+	// LatestManifestVersion is the version used by default
+	LatestManifestVersion = ManifestVersion1
+)
+
+var (
+	ErrInvalidManifest            = errors.New("invalid manifest")
+	ErrUnsupportedManifestVersion = errors.New("unsupported manifest version")
+)
+
 var sep = []byte("...")
 
-// AssembleManifest defines a list of UIDs to be synchronized
+// manifestMagic marks the versioned format,
+// the legacy format always starts with the raw KSUID tag of the compressed set or the separator.
+var manifestMagic = []byte("DSM")
+
+// AssembleManifest defines a list of UIDs to be synchronized.
+// The KSUIDs are kept in a sorted slice, and the custom UIDs are indexed by KSUID,
+// so that iteration is O(n), and looking up a KSUID or seeking to it is O(log n).
+// It is not safe for concurrent use.
 type AssembleManifest struct {
-	cs  ksuid.CompressedSet
-	set map[KSUID]string
+	// ids is in ascending order without duplicates when sorted is true
+	ids    []KSUID
+	sorted bool
+	set    map[KSUID]string
 }
 
-func (am *AssembleManifest) getIds() []KSUID {
-	var set []KSUID
-	for iter := am.cs.Iter(); iter.Next(); {
-		set = append(set, iter.KSUID)
+// normalize sorts and deduplicates the KSUIDs appended out of order.
+func (am *AssembleManifest) normalize() {
+	if am.sorted {
+		return
+	}
+	ksuid.Sort(am.ids)
+	ids := am.ids[:0]
+	for i, id := range am.ids {
+		if i > 0 && am.ids[i-1] == id {
+			continue
+		}
+		ids = append(ids, id)
 	}
-	return set
+	am.ids = ids
+	am.sorted = true
+}
+
+// search returns the index of the first KSUID not less than id.
+func (am *AssembleManifest) search(id KSUID) int {
+	am.normalize()
+	return sort.Search(len(am.ids), func(i int) bool {
+		return CompareKSUID(am.ids[i], id) >= 0
+	})
 }
 
 func (am *AssembleManifest) Clone() *AssembleManifest {
-	manifest := &AssembleManifest{}
-	manifest.cs = am.cs[:]
+	manifest := &AssembleManifest{sorted: am.sorted}
+	manifest.ids = append([]KSUID(nil), am.ids...)
 	if am.set != nil {
-		manifest.set = make(map[KSUID]string)
+		manifest.set = make(map[KSUID]string, len(am.set))
 		for k, v := range am.set {
 			manifest.set[k] = v
 		}
@@ -61,22 +111,46 @@ func (am *AssembleManifest) Clone() *AssembleManifest {
 	return manifest
 }
 
-func (am *AssembleManifest) Iter() CompressedSetIter {
-	set := am.getIds()
-	for id := range am.set {
-		set = append(set, id)
-	}
-	manifest := ksuid.Compress(set...)
-	return manifest.Iter()
+// Len returns the number of KSUIDs
+func (am *AssembleManifest) Len() int {
+	am.normalize()
+	return len(am.ids)
+}
+
+// Iter returns an iterator over the KSUIDs in ascending order
+func (am *AssembleManifest) Iter() ManifestIter {
+	am.normalize()
+	return ManifestIter{ids: am.ids}
+}
+
+// IterFrom returns an iterator over the KSUIDs not less than id in ascending order
+func (am *AssembleManifest) IterFrom(id KSUID) ManifestIter {
+	// search normalizes ids, so it is called before ids is read.
+	i := am.search(id)
+	return ManifestIter{ids: am.ids[i:]}
+}
+
+// Contains reports whether the KSUID is in the manifest
+func (am *AssembleManifest) Contains(id KSUID) bool {
+	i := am.search(id)
+	return i < len(am.ids) && am.ids[i] == id
 }
 
 func (am *AssembleManifest) Sort() {
-	set := am.getIds()
-	am.cs = ksuid.Compress(set...)
+	am.normalize()
 }
 
 func (am *AssembleManifest) Append(ids ...KSUID) {
-	am.cs = ksuid.AppendCompressed(am.cs, ids...)
+	if len(am.ids) == 0 {
+		am.sorted = true
+	}
+	for _, id := range ids {
+		// Appending in ascending order keeps the manifest sorted.
+		if am.sorted && len(am.ids) > 0 && CompareKSUID(am.ids[len(am.ids)-1], id) >= 0 {
+			am.sorted = false
+		}
+		am.ids = append(am.ids, id)
+	}
 }
 
 func (am *AssembleManifest) AppendCustom(id KSUID, custom string) {
@@ -84,6 +158,7 @@ func (am *AssembleManifest) AppendCustom(id KSUID, custom string) {
 		am.set = make(map[KSUID]string)
 	}
 	am.set[id] = custom
+	am.Append(id)
 }
 
 func (am *AssembleManifest) AppendUID(uids ...UID) {
@@ -96,48 +171,260 @@ func (am *AssembleManifest) AppendUID(uids ...UID) {
 	}
 }
 
+// Delete deletes the KSUIDs and their custom UIDs
+func (am *AssembleManifest) Delete(ids ...KSUID) {
+	if len(ids) == 0 {
+		return
+	}
+	deleted := make(map[KSUID]struct{}, len(ids))
+	for _, id := range ids {
+		deleted[id] = struct{}{}
+		delete(am.set, id)
+	}
+
+	result := am.ids[:0]
+	for _, id := range am.ids {
+		if _, ok := deleted[id]; !ok {
+			result = append(result, id)
+		}
+	}
+	am.ids = result
+}
+
 func (am *AssembleManifest) GetUID(id KSUID) UID {
 	return NewWithCustom(id, am.set[id])
 }
 
+// plainIDs returns the KSUIDs without custom UID.
+func (am *AssembleManifest) plainIDs() []KSUID {
+	am.normalize()
+	if len(am.set) == 0 {
+		return am.ids
+	}
+	ids := make([]KSUID, 0, len(am.ids))
+	for _, id := range am.ids {
+		if _, ok := am.set[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ManifestIter is an iterator over the KSUIDs of the manifest
+type ManifestIter struct {
+	// KSUID is the current KSUID after Next returns true
+	KSUID KSUID
+
+	ids    []KSUID
+	offset int
+}
+
+// Next moves the iterator to the next KSUID, and returns false when there is none.
+func (it *ManifestIter) Next() bool {
+	if it.offset >= len(it.ids) {
+		return false
+	}
+	it.KSUID = it.ids[it.offset]
+	it.offset++
+	return true
+}
+
+// Bytes encodes the manifest in the latest version.
 func (am *AssembleManifest) Bytes() ([]byte, error) {
+	return am.Encode(LatestManifestVersion)
+}
+
+// Encode encodes the manifest in the specified version, an empty manifest is always encoded as nil.
+//
+// The legacy version joins the compressed set and the JSON-encoded custom UIDs with the separator "...".
+//
+// The version 1 is length-prefixed, all integers are unsigned varints:
+//
+//	magic    "DSM"
+//	version  1 byte
+//	set      length, compressed set of the KSUIDs without custom UID
+//	count    number of the custom UIDs
+//	custom   KSUID (20 bytes), length, custom UID; repeated count times in ascending order of KSUID
+func (am *AssembleManifest) Encode(version ManifestVersion) ([]byte, error) {
+	if am.Len() == 0 {
+		return nil, nil
+	}
+
+	switch version {
+	case ManifestVersionLegacy:
+		return am.encodeLegacy()
+	case ManifestVersion1:
+		return am.encodeV1(), nil
+	}
+	return nil, ErrUnsupportedManifestVersion
+}
+
+func (am *AssembleManifest) encodeLegacy() ([]byte, error) {
+	cs := ksuid.Compress(am.plainIDs()...)
 	if len(am.set) == 0 {
-		return am.cs, nil
+		return cs, nil
 	}
 
 	b, err := json.Marshal(am.set)
 	if err != nil {
 		return nil, err
 	}
-	out := make([]byte, 0, len(am.cs)+len(b)+1)
-	out = append(out, am.cs...)
+	out := make([]byte, 0, len(cs)+len(b)+len(sep))
+	out = append(out, cs...)
 	out = append(out, sep...)
 	out = append(out, b...)
 	return out, nil
 }
 
+func (am *AssembleManifest) encodeV1() []byte {
+	cs := ksuid.Compress(am.plainIDs()...)
+	ids := make([]KSUID, 0, len(am.set))
+	size := len(manifestMagic) + 1 + 2*binary.MaxVarintLen64 + len(cs)
+	for id, custom := range am.set {
+		ids = append(ids, id)
+		size += len(id) + binary.MaxVarintLen64 + len(custom)
+	}
+	ksuid.Sort(ids)
+
+	out := make([]byte, 0, size)
+	out = append(out, manifestMagic...)
+	out = append(out, byte(ManifestVersion1))
+	out = appendUvarint(out, uint64(len(cs)))
+	out = append(out, cs...)
+	out = appendUvarint(out, uint64(len(ids)))
+	for _, id := range ids {
+		custom := am.set[id]
+		out = append(out, id[:]...)
+		out = appendUvarint(out, uint64(len(custom)))
+		out = append(out, custom...)
+	}
+	return out
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// FromBytes decodes the manifest in any supported version.
 func (am *AssembleManifest) FromBytes(b []byte) error {
-	bytesSet := bytes.SplitN(b, sep, 2)
-	if len(bytesSet[0]) > 0 {
-		am.cs = bytesSet[0]
+	if !bytes.HasPrefix(b, manifestMagic) {
+		return am.decodeLegacy(b)
 	}
+
+	b = b[len(manifestMagic):]
+	if len(b) == 0 {
+		return ErrInvalidManifest
+	}
+	switch ManifestVersion(b[0]) {
+	case ManifestVersion1:
+		return am.decodeV1(b[1:])
+	}
+	return ErrUnsupportedManifestVersion
+}
+
+func (am *AssembleManifest) decodeLegacy(b []byte) error {
+	bytesSet := bytes.SplitN(b, sep, 2)
+	am.appendCompressed(bytesSet[0])
 	if len(bytesSet) == 2 {
-		return json.Unmarshal(bytesSet[1], &am.set)
+		var set map[KSUID]string
+		if err := json.Unmarshal(bytesSet[1], &set); err != nil {
+			return err
+		}
+		for id, custom := range set {
+			am.AppendCustom(id, custom)
+		}
+	}
+	return nil
+}
+
+func (am *AssembleManifest) appendCompressed(cs ksuid.CompressedSet) {
+	for iter := cs.Iter(); iter.Next(); {
+		am.Append(iter.KSUID)
+	}
+}
+
+func (am *AssembleManifest) decodeV1(b []byte) error {
+	// next reads a length-prefixed field
+	next := func() ([]byte, error) {
+		n, size := binary.Uvarint(b)
+		if size <= 0 || n > uint64(len(b)-size) {
+			return nil, ErrInvalidManifest
+		}
+		field := b[size : size+int(n)]
+		b = b[size+int(n):]
+		return field, nil
+	}
+
+	cs, err := next()
+	if err != nil {
+		return err
+	}
+	am.appendCompressed(cs)
+
+	count, size := binary.Uvarint(b)
+	if size <= 0 {
+		return ErrInvalidManifest
+	}
+	b = b[size:]
+	for i := uint64(0); i < count; i++ {
+		if len(b) < len(Nil) {
+			return ErrInvalidManifest
+		}
+		id, err := ParseKSUIDFromBytes(b[:len(Nil)])
+		if err != nil {
+			return err
+		}
+		b = b[len(Nil):]
+
+		custom, err := next()
+		if err != nil {
+			return err
+		}
+		am.AppendCustom(id, string(custom))
+	}
+	if len(b) > 0 {
+		return ErrInvalidManifest
 	}
 	return nil
 }
 
+// MarshalText encodes the manifest in the latest version as base64.
 func (am *AssembleManifest) MarshalText() ([]byte, error) {
-	b, err := am.Bytes()
+	return am.MarshalTextVersion(LatestManifestVersion)
+}
+
+// MarshalTextVersion encodes the manifest in the specified version as text,
+// the legacy version is the base64 JSON string, which is expected by the peers without version support.
+func (am *AssembleManifest) MarshalTextVersion(version ManifestVersion) ([]byte, error) {
+	b, err := am.Encode(version)
 	if err != nil {
 		return nil, err
 	}
-	return json.Marshal(b)
+	if version == ManifestVersionLegacy {
+		return json.Marshal(b)
+	}
+	out := make([]byte, base64.StdEncoding.EncodedLen(len(b)))
+	base64.StdEncoding.Encode(out, b)
+	return out, nil
 }
 
+// UnmarshalText decodes the text encoded in any supported version.
 func (am *AssembleManifest) UnmarshalText(data []byte) error {
-	var b []byte
-	if err := json.Unmarshal(data, &b); err != nil {
+	var (
+		b   []byte
+		err error
+	)
+	if len(data) > 0 && data[0] == '"' {
+		err = json.Unmarshal(data, &b)
+	} else {
+		b = make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		var n int
+		n, err = base64.StdEncoding.Decode(b, data)
+		b = b[:n]
+	}
+	if err != nil {
 		return err
 	}
 	return am.FromBytes(b)
@@ -0,0 +1,284 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package suid
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// manifestUIDs returns the UIDs of the manifest in order
+func manifestUIDs(am *AssembleManifest) []string {
+	var uids []string
+	for iter := am.Iter(); iter.Next(); {
+		uids = append(uids, am.GetUID(iter.KSUID).String())
+	}
+	return uids
+}
+
+func TestAssembleManifest_Encode(t *testing.T) {
+	// The payload contains the legacy separator, which breaks the legacy format.
+	payload := bytes.Repeat([]byte("."), 16)
+	tricky, err := ksuid.FromParts(time.Now(), payload)
+	if err != nil {
+		t.Fatalf("FromParts() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		uids []UID
+	}{
+		{name: "empty"},
+		{name: "ksuid", uids: []UID{New(), New()}},
+		{name: "custom", uids: []UID{NewWithCustom(NewKSUID(), "apps/v1,Deployment,default/test,1")}},
+		{name: "mixed", uids: []UID{New(), NewWithCustom(NewKSUID(), "a"), New(), NewWithCustom(NewKSUID(), "b")}},
+		{name: "separator in custom", uids: []UID{NewWithCustom(NewKSUID(), "a...b"), New()}},
+		{name: "separator in set", uids: []UID{[]byte(tricky.String()), NewWithCustom(NewKSUID(), "c")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			am := NewManifest()
+			am.AppendUID(tt.uids...)
+			want := manifestUIDs(am)
+
+			b, err := am.Bytes()
+			if err != nil {
+				t.Fatalf("Bytes() error = %v", err)
+			}
+			if len(tt.uids) == 0 && b != nil {
+				t.Errorf("Bytes() = %v, want nil", b)
+			}
+			got, err := NewManifestFromBytes(b)
+			if err != nil {
+				t.Fatalf("NewManifestFromBytes() error = %v", err)
+			}
+			if !reflect.DeepEqual(manifestUIDs(got), want) {
+				t.Errorf("NewManifestFromBytes() = %v, want %v", manifestUIDs(got), want)
+			}
+
+			text, err := json.Marshal(am)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			var fromText AssembleManifest
+			if err := json.Unmarshal(text, &fromText); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(manifestUIDs(&fromText), want) {
+				t.Errorf("Unmarshal() = %v, want %v", manifestUIDs(&fromText), want)
+			}
+		})
+	}
+}
+
+func TestAssembleManifest_Legacy(t *testing.T) {
+	am := NewManifest()
+	am.AppendUID(New(), NewWithCustom(NewKSUID(), "a"), New())
+	want := manifestUIDs(am)
+
+	b, err := am.Encode(ManifestVersionLegacy)
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	got, err := NewManifestFromBytes(b)
+	if err != nil {
+		t.Fatalf("NewManifestFromBytes() error = %v", err)
+	}
+	if !reflect.DeepEqual(manifestUIDs(got), want) {
+		t.Errorf("NewManifestFromBytes() = %v, want %v", manifestUIDs(got), want)
+	}
+
+	// The legacy text is the JSON string of the base64 encoded bytes.
+	text, err := am.MarshalTextVersion(ManifestVersionLegacy)
+	if err != nil {
+		t.Fatalf("MarshalTextVersion() error = %v", err)
+	}
+	legacy, err := json.Marshal(b)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if !bytes.Equal(text, legacy) {
+		t.Errorf("MarshalTextVersion() = %s, want %s", text, legacy)
+	}
+	var fromText AssembleManifest
+	if err := fromText.UnmarshalText(text); err != nil {
+		t.Fatalf("UnmarshalText() error = %v", err)
+	}
+	if !reflect.DeepEqual(manifestUIDs(&fromText), want) {
+		t.Errorf("UnmarshalText() = %v, want %v", manifestUIDs(&fromText), want)
+	}
+}
+
+func TestAssembleManifest_FromBytesInvalid(t *testing.T) {
+	am := NewManifest()
+	am.AppendUID(New(), NewWithCustom(NewKSUID(), "custom"))
+	b, err := am.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{name: "no version", b: []byte("DSM"), want: ErrInvalidManifest},
+		{name: "unsupported version", b: []byte("DSM\x09"), want: ErrUnsupportedManifestVersion},
+		{name: "truncated", b: b[:len(b)-3], want: ErrInvalidManifest},
+		{name: "trailing", b: append(append([]byte(nil), b...), 0), want: ErrInvalidManifest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewManifestFromBytes(tt.b); err != tt.want {
+				t.Errorf("NewManifestFromBytes() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssembleManifest_IterFrom(t *testing.T) {
+	ids := []KSUID{NewKSUID(), NewKSUID(), NewKSUID(), NewKSUID()}
+	am := NewManifest()
+	// Appending out of order is sorted on read.
+	am.Append(ids[2], ids[0], ids[3], ids[1], ids[2])
+	if am.Len() != len(ids) {
+		t.Errorf("Len() = %d, want %d", am.Len(), len(ids))
+	}
+
+	var got []KSUID
+	for iter := am.IterFrom(ids[1]); iter.Next(); {
+		got = append(got, iter.KSUID)
+	}
+	if !reflect.DeepEqual(got, ids[1:]) {
+		t.Errorf("IterFrom() = %v, want %v", got, ids[1:])
+	}
+
+	// Seeking is the first read of the KSUIDs appended out of order.
+	unsorted := NewManifest()
+	unsorted.Append(ids[3], ids[1], ids[1], ids[2], ids[0], ids[3])
+	got = got[:0]
+	for iter := unsorted.IterFrom(ids[2]); iter.Next(); {
+		got = append(got, iter.KSUID)
+	}
+	if !reflect.DeepEqual(got, ids[2:]) {
+		t.Errorf("IterFrom() of unsorted = %v, want %v", got, ids[2:])
+	}
+
+	am.Delete(ids[1], ids[3])
+	if am.Contains(ids[1]) || !am.Contains(ids[2]) {
+		t.Errorf("Contains() after Delete() is wrong")
+	}
+	got = got[:0]
+	for iter := am.Iter(); iter.Next(); {
+		got = append(got, iter.KSUID)
+	}
+	if want := []KSUID{ids[0], ids[2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Iter() = %v, want %v", got, want)
+	}
+}
+
+var benchmarkSizes = []int{10000, 100000, 1000000}
+
+// newBenchmarkManifest returns a manifest of n UIDs, half of them are custom.
+func newBenchmarkManifest(n int) (*AssembleManifest, []KSUID) {
+	g := NewMonotonicGenerator()
+	ids := make([]KSUID, n)
+	am := NewManifest()
+	for i := range ids {
+		ids[i] = g.Next()
+		if i%2 == 0 {
+			am.AppendCustom(ids[i], "apps/v1,Deployment,default/test,"+ids[i].String())
+		} else {
+			am.Append(ids[i])
+		}
+	}
+	return am, ids
+}
+
+func BenchmarkAssembleManifest_Iter(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		am, _ := newBenchmarkManifest(n)
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for iter := am.Iter(); iter.Next(); {
+					_ = am.GetUID(iter.KSUID)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAssembleManifest_IterFrom(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		am, ids := newBenchmarkManifest(n)
+		// Seek to the last 100 UIDs, like a syncer that is almost up to date.
+		state := ids[n-100]
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for iter := am.IterFrom(state); iter.Next(); {
+					_ = am.GetUID(iter.KSUID)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAssembleManifest_Append(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				newBenchmarkManifest(n)
+			}
+		})
+	}
+}
+
+func BenchmarkAssembleManifest_Delete(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		am, ids := newBenchmarkManifest(n)
+		deleted := ids[:100]
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				current := am.Clone()
+				b.StartTimer()
+				current.Delete(deleted...)
+			}
+		})
+	}
+}
+
+func BenchmarkAssembleManifest_Bytes(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		am, _ := newBenchmarkManifest(n)
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				data, err := am.Bytes()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := NewManifestFromBytes(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -16,192 +16,454 @@ package dsync
 
 import (
 	"context"
+	"crypto/ed25519"
 	"errors"
+	"sort"
 
+	"github.com/99nil/dsync/operation"
 	"github.com/99nil/dsync/storage"
 	"github.com/99nil/dsync/suid"
 )
 
 var (
 	ErrEmptyManifest = errors.New("empty manifest")
+	ErrUnknownState  = errors.New("unknown state")
 )
 
 type syncer struct {
+	insName          string
 	name             string
-	syncerOperation  OperateInterface
+	storage          storage.Interface
+	notifier         *notifier
+	keyFunc          KeyFunc
+	signer           ed25519.PrivateKey
+	strategy         operation.SyncerOperation
+	stateOperation   OperateInterface
 	dataSetOperation OperateInterface
 	customOperation  OperateInterface
+	digestOperation  OperateInterface
+	tombstone        *tombstones
+	bindingOperation OperateInterface
+	cursorOperation  OperateInterface
 }
 
-func newSyncer(insName string, name string, storage storage.Interface) *syncer {
-	s := &syncer{name: name}
-	s.syncerOperation = newSpaceOperation(buildName(spaceSyncerPrefix, insName), storage)
+func newSyncer(
+	insName string,
+	name string,
+	storage storage.Interface,
+	notifier *notifier,
+	keyFunc KeyFunc,
+	signer ed25519.PrivateKey,
+	strategy operation.SyncerOperation,
+) *syncer {
+	s := &syncer{
+		insName:  insName,
+		name:     name,
+		storage:  storage,
+		notifier: notifier,
+		keyFunc:  keyFunc,
+		signer:   signer,
+		strategy: strategy,
+	}
+	s.stateOperation = newSpaceOperation(buildName(spaceStatePrefix, insName), storage)
 	s.dataSetOperation = newSpaceOperation(buildName(spaceDatasetPrefix, insName), storage)
 	s.customOperation = newSpaceOperation(buildName(spaceRelatePrefix, insName), storage)
+	s.digestOperation = newSpaceOperation(buildName(spaceDigestPrefix, insName), storage)
+	s.tombstone = newTombstones(insName, storage, keyFunc)
+	s.bindingOperation = newSpaceOperation(buildName(spaceBindingPrefix, insName), storage)
+	s.cursorOperation = newSpaceOperation(buildName(spaceCursorPrefix, insName), storage)
 	return s
 }
 
-func (s *syncer) filterUIDs(ctx context.Context, uids []suid.UID) ([]suid.UID, error) {
-	set := make([]suid.UID, 0, len(uids))
-	for _, uid := range uids {
-		if uid.IsCustom() {
-			custom := uid.CustomUID()
-			value, err := s.customOperation.Get(ctx, custom)
-			if err != nil {
-				return nil, err
-			}
-			id, err := suid.ParseKSUID(string(value))
-			if err != nil {
-				return nil, err
-			}
-			if id.IsNil() {
-				continue
-			}
-			uid = suid.NewWithCustom(id, custom)
-		}
-		set = append(set, uid)
-	}
-	return set, nil
-}
-
-func (s *syncer) setManifest(ctx context.Context, manifest *suid.AssembleManifest) error {
-	var (
-		b   []byte
-		err error
-	)
-	if manifest != nil {
-		b, err = manifest.Bytes()
-		if err != nil {
-			return err
-		}
-	}
-	return s.syncerOperation.Add(ctx, s.name, b)
-}
-
-func (s *syncer) getManifest(ctx context.Context) (*suid.AssembleManifest, error) {
-	value, err := s.syncerOperation.Get(ctx, s.name)
-	if err != nil {
-		return nil, err
-	}
-	if len(value) == 0 {
-		return suid.NewManifest(), ErrEmptyManifest
-	}
-	return suid.NewManifestFromBytes(value)
-}
-
 func (s *syncer) Add(ctx context.Context, uids ...suid.UID) error {
 	if len(uids) == 0 {
 		return nil
 	}
-	uids, err := s.filterUIDs(ctx, uids)
+	uids, err := filterUIDs(ctx, s.customOperation, uids)
 	if err != nil {
 		return err
 	}
 
-	manifest, err := s.getManifest(ctx)
-	if err != nil && err != ErrEmptyManifest {
+	err = s.storage.Update(ctx, func(txn storage.Txn) error {
+		return s.strategy.Add(ctx, txn, s.name, uids...)
+	})
+	if err != nil {
 		return err
 	}
-	manifest.AppendUID(uids...)
-	return s.setManifest(ctx, manifest)
+	s.notifier.notify(s.name, uids...)
+	return nil
 }
 
 func (s *syncer) Del(ctx context.Context, uids ...suid.UID) error {
 	if len(uids) == 0 {
 		return nil
 	}
-	manifest, err := s.getManifest(ctx)
-	if err != nil && err != ErrEmptyManifest {
+	return s.storage.Update(ctx, func(txn storage.Txn) error {
+		return s.strategy.Del(ctx, txn, s.name, uids...)
+	})
+}
+
+func (s *syncer) Manifest(ctx context.Context, uid suid.UID, limit int) (*suid.AssembleManifest, error) {
+	var result *suid.AssembleManifest
+	err := s.storage.Update(ctx, func(txn storage.Txn) error {
+		var err error
+		result, err = s.manifest(ctx, txn, uid, limit)
 		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, ErrEmptyManifest
+	}
+	return result, nil
+}
+
+// manifest returns the manifest after uid, and removes the synchronized UIDs from the stored manifest.
+// A nil manifest without error means there is nothing to synchronize.
+func (s *syncer) manifest(ctx context.Context, txn storage.Txn, uid suid.UID, limit int) (*suid.AssembleManifest, error) {
+	// The uid newer than the state of the dataset was not produced by this dataset,
+	// e.g. the dataset has been rebuilt, so the synchronization can not resume from it.
+	state, err := s.stateOperation.WithTxn(txn).Get(ctx, keyState)
+	if err != nil {
+		return nil, err
+	}
+	if len(state) > 0 && suid.CompareKSUID(uid.KSUID(), suid.UID(state).KSUID()) > 0 {
+		return nil, ErrUnknownState
 	}
 
 	var set []suid.UID
-	for iter := manifest.Iter(); iter.Next(); {
-		var current suid.UID
-		for _, uid := range uids {
-			if uid.KSUID() == iter.KSUID {
-				current = uid[:]
-				break
-			}
-		}
-		if len(current) > 0 {
-			set = append(set, current)
+	current := uid.KSUID()
+	if current != suid.Nil {
+		set = append(set, uid)
+	}
+	err = s.strategy.Range(ctx, txn, s.name, current, func(uid suid.UID) error {
+		set = append(set, uid)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Remove the synchronized UIDs before uid.
+	if current != suid.Nil {
+		if err := s.strategy.Trim(ctx, txn, s.name, current); err != nil {
+			return nil, err
 		}
 	}
 
-	manifest = suid.NewManifest()
-	manifest.AppendUID(set...)
-	return s.setManifest(ctx, manifest)
+	cursor, err := s.advanceCursor(ctx, txn, current)
+	if err != nil {
+		return nil, err
+	}
+	logUIDs, err := s.logUIDs(ctx, txn, cursor)
+	if err != nil {
+		return nil, err
+	}
+	set = mergeUIDs(set, logUIDs)
+	if current != suid.Nil && len(set) > 0 {
+		// The first one is uid itself, which marks the position and is not compacted.
+		set = append(set[:1], compactUIDs(set[1:], s.keyFunc)...)
+	} else {
+		set = compactUIDs(set, s.keyFunc)
+	}
+
+	// If there is none or only uid itself, there is nothing to synchronize.
+	if len(set) == 0 || (current != suid.Nil && len(set) < 2) {
+		return nil, nil
+	}
+	if limit > 0 && len(set) > limit {
+		set = set[:limit]
+	}
+	result := suid.NewManifest()
+	result.AppendUID(set...)
+	return result, nil
 }
 
-func (s *syncer) Manifest(ctx context.Context, uid suid.UID, limit int) (*suid.AssembleManifest, error) {
-	manifest, err := s.getManifest(ctx)
+// advanceCursor moves the cursor of the syncer forward to the state,
+// and returns the cursor.
+func (s *syncer) advanceCursor(ctx context.Context, txn storage.Txn, state suid.KSUID) (suid.KSUID, error) {
+	cursorOperation := s.cursorOperation.WithTxn(txn)
+	value, err := cursorOperation.Get(ctx, s.name)
 	if err != nil {
-		return manifest, err
+		return suid.Nil, err
+	}
+	cursor := suid.UID(value).KSUID()
+	if suid.CompareKSUID(state, cursor) < 1 {
+		return cursor, nil
+	}
+	// Only the syncer bound to subscriptions needs the cursor.
+	bindings, err := getBindings(ctx, s.bindingOperation.WithTxn(txn), s.name)
+	if err != nil || len(bindings) == 0 {
+		return state, err
 	}
+	return state, cursorOperation.Add(ctx, s.name, []byte(state.String()))
+}
 
-	result := suid.NewManifest()
-	number := 0
+// logUIDs returns the UIDs after the cursor in the logs of the bound subscriptions.
+func (s *syncer) logUIDs(ctx context.Context, txn storage.Txn, cursor suid.KSUID) ([]suid.UID, error) {
+	bindings, err := getBindings(ctx, s.bindingOperation.WithTxn(txn), s.name)
+	if err != nil {
+		return nil, err
+	}
 
-	current := uid.KSUID()
-	if current == suid.Nil {
-		for iter := manifest.Iter(); iter.Next(); {
-			keyUID := manifest.GetUID(iter.KSUID)
-			if limit > 0 && number >= limit {
-				break
+	// The logs are keyed by KSUID, so the iteration seeks to the cursor instead of scanning the whole log.
+	var start string
+	if cursor != suid.Nil {
+		start = cursor.String()
+	}
+	var uids []suid.UID
+	for _, name := range bindings {
+		logOperation := newSpaceOperation(buildName(spaceLogPrefix, s.insName, name), txn)
+		err := logOperation.RangePrefix(ctx, "", start, func(key, value []byte) error {
+			id, err := suid.ParseKSUID(string(key))
+			if err != nil {
+				return err
+			}
+			if suid.CompareKSUID(id, cursor) > 0 {
+				uids = append(uids, value)
 			}
-			result.AppendUID(keyUID)
-			number++
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
-		return result, nil
 	}
+	return uids, nil
+}
 
-	var (
-		set    []suid.UID
-		exists bool
-	)
-	manifest.AppendUID(uid)
-	for iter := manifest.Iter(); iter.Next(); {
-		if iter.KSUID == current {
-			exists = true
-		}
-		if !exists {
+// mergeUIDs merges the UIDs in ascending order of KSUID, and removes the duplicates.
+func mergeUIDs(set []suid.UID, others []suid.UID) []suid.UID {
+	if len(others) == 0 {
+		return set
+	}
+	set = append(set, others...)
+	sort.SliceStable(set, func(i, j int) bool {
+		return suid.CompareKSUID(set[i].KSUID(), set[j].KSUID()) < 0
+	})
+
+	result := set[:0]
+	for i, uid := range set {
+		if i > 0 && set[i-1].KSUID() == uid.KSUID() {
 			continue
 		}
+		result = append(result, uid)
+	}
+	return result
+}
 
-		keyUID := manifest.GetUID(iter.KSUID)
-		if limit <= 0 || number < limit {
-			result.AppendUID(keyUID)
-			number++
+// compactUIDs keeps only the newest UID of each key in the ascending UIDs.
+// The UIDs with an empty key are always kept.
+func compactUIDs(set []suid.UID, keyFunc KeyFunc) []suid.UID {
+	if keyFunc == nil || len(set) < 2 {
+		return set
+	}
+	newest := make(map[string]int, len(set))
+	for i, uid := range set {
+		if key := keyFunc(uid); key != "" {
+			newest[key] = i
 		}
-		set = append(set, keyUID)
 	}
 
-	// If there is none or only uid itself, there is nothing to synchronize.
-	if len(set) < 2 {
-		_ = s.setManifest(ctx, nil)
-		return nil, ErrEmptyManifest
-	}
-	manifest = suid.NewManifest()
-	manifest.AppendUID(set...)
-	manifest.Sort()
-	if err := s.setManifest(ctx, manifest); err != nil {
-		return nil, err
+	result := make([]suid.UID, 0, len(newest))
+	for i, uid := range set {
+		if key := keyFunc(uid); key != "" && newest[key] != i {
+			continue
+		}
+		result = append(result, uid)
 	}
-	return result, nil
+	return result
 }
 
-func (s *syncer) Data(ctx context.Context, manifest *suid.AssembleManifest) ([]Item, error) {
+func (s *syncer) Data(ctx context.Context, manifest *suid.AssembleManifest, opts ...DataOption) ([]Item, error) {
+	o := newDataOptions(opts)
 	var items []Item
 	for iter := manifest.Iter(); iter.Next(); {
 		value, err := s.dataSetOperation.Get(ctx, iter.KSUID.String())
 		if err != nil {
 			return nil, err
 		}
-		items = append(items, Item{
-			UID:   manifest.GetUID(iter.KSUID),
-			Value: value,
-		})
+		digest, err := s.digestOperation.Get(ctx, iter.KSUID.String())
+		if err != nil {
+			return nil, err
+		}
+		uid := manifest.GetUID(iter.KSUID)
+		tombstone, err := s.tombstone.is(ctx, s.tombstone.tombstoneOperation, uid)
+		if err != nil {
+			return nil, err
+		}
+		item, err := s.serve(Item{
+			UID:       uid,
+			Value:     value,
+			Digest:    digest,
+			Tombstone: tombstone,
+		}, o)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
 	}
 	return items, nil
 }
+
+// serve compresses the item with the options, then signs it if the syncer has a signer.
+func (s *syncer) serve(item Item, o *dataOptions) (Item, error) {
+	if err := item.Compress(o.encoding, o.threshold); err != nil {
+		return item, err
+	}
+	if s.signer != nil {
+		item.Sign(s.signer)
+	}
+	return item, nil
+}
+
+func (s *syncer) Watch(ctx context.Context) <-chan suid.UID {
+	return s.notifier.watch(ctx, s.name)
+}
+
+func (s *syncer) Stats(ctx context.Context) (*SyncerStats, error) {
+	size, err := s.strategy.Size(ctx, s.storage, s.name)
+	if err != nil {
+		return nil, err
+	}
+	stats := &SyncerStats{Size: size}
+
+	var set []suid.UID
+	err = s.strategy.Range(ctx, s.storage, s.name, suid.Nil, func(uid suid.UID) error {
+		set = append(set, uid)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := s.cursorOperation.Get(ctx, s.name)
+	if err != nil {
+		return nil, err
+	}
+	logUIDs, err := s.logUIDs(ctx, s.storage, suid.UID(cursor).KSUID())
+	if err != nil {
+		return nil, err
+	}
+	set = compactUIDs(mergeUIDs(set, logUIDs), s.keyFunc)
+
+	stats.Pending = len(set)
+	if len(set) > 0 {
+		// The set is in ascending order, the first one is the oldest.
+		stats.Oldest = set[0].KSUID().Time()
+	}
+	return stats, nil
+}
+
+func (s *syncer) Snapshot(ctx context.Context, opts ...DataOption) (*Snapshot, error) {
+	var items []Item
+	snapshot, err := s.StreamSnapshot(ctx, func(item Item) error {
+		items = append(items, item)
+		return nil
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Items = items
+	return snapshot, nil
+}
+
+func (s *syncer) StreamSnapshot(ctx context.Context, fn func(item Item) error, opts ...DataOption) (*Snapshot, error) {
+	o := newDataOptions(opts)
+	var (
+		snapshot *Snapshot
+		uids     []suid.UID
+	)
+	err := s.storage.Update(ctx, func(txn storage.Txn) error {
+		var err error
+		snapshot, uids, err = s.snapshot(ctx, txn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The value of a KSUID never changes, so the values are read one by one after the transaction.
+	for _, uid := range uids {
+		id := uid.KSUID().String()
+		value, err := s.dataSetOperation.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		digest, err := s.digestOperation.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		item, err := s.serve(Item{UID: uid, Value: value, Digest: digest}, o)
+		if err != nil {
+			return nil, err
+		}
+		if err := fn(item); err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+// snapshot returns the state and the epoch of the snapshot, and the UIDs of the latest items at the state,
+// only the UIDs are held in memory.
+func (s *syncer) snapshot(ctx context.Context, txn storage.Txn) (*Snapshot, []suid.UID, error) {
+	state, err := s.stateOperation.WithTxn(txn).Get(ctx, keyState)
+	if err != nil {
+		return nil, nil, err
+	}
+	epoch, err := s.stateOperation.WithTxn(txn).Get(ctx, keyEpoch)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot := &Snapshot{State: state, Epoch: string(epoch)}
+	current := snapshot.State.KSUID()
+
+	customs := make(map[suid.KSUID]string)
+	err = s.customOperation.WithTxn(txn).Range(ctx, func(key, value []byte) error {
+		id, err := suid.ParseKSUID(string(value))
+		if err != nil {
+			return err
+		}
+		customs[id] = string(key)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var set []suid.UID
+	err = s.dataSetOperation.WithTxn(txn).Range(ctx, func(key, _ []byte) error {
+		id, err := suid.ParseKSUID(string(key))
+		if err != nil {
+			return err
+		}
+		if suid.CompareKSUID(id, current) > 0 {
+			return nil
+		}
+		set = append(set, suid.NewWithCustom(id, customs[id]))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	var uids []suid.UID
+	tombstoneOperation := s.tombstone.tombstoneOperation.WithTxn(txn)
+	for _, uid := range compactUIDs(set, s.keyFunc) {
+		// The deleted keys do not exist at the snapshot state, there is nothing to delete for the receiver.
+		tombstone, err := s.tombstone.is(ctx, tombstoneOperation, uid)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !tombstone {
+			uids = append(uids, uid)
+		}
+	}
+
+	// The UIDs before the state are included in the snapshot,
+	// so the synchronization resumes from the state.
+	if err := s.strategy.Trim(ctx, txn, s.name, current); err != nil {
+		return nil, nil, err
+	}
+	_, err = s.advanceCursor(ctx, txn, current)
+	return snapshot, uids, err
+}
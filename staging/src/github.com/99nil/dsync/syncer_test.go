@@ -0,0 +1,486 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99nil/dsync/operation"
+	"github.com/99nil/dsync/storage/badger"
+	"github.com/99nil/dsync/suid"
+)
+
+func newTestInstance(t *testing.T, opts ...Option) Interface {
+	opts = append([]Option{WithStorageOption(newTestStorage(t))}, opts...)
+	ins, err := New(opts...)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	return ins
+}
+
+func TestSyncer_Watch(t *testing.T) {
+	ins := newTestInstance(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := ins.Syncer("node").Watch(ctx)
+	other := ins.Syncer("other").Watch(ctx)
+
+	uid := suid.New()
+	if err := ins.Syncer("node").Add(ctx, uid); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	select {
+	case got := <-ch:
+		if got.String() != uid.String() {
+			t.Errorf("Watch() received %s, want %s", got, uid)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Watch() received nothing")
+	}
+	select {
+	case got := <-other:
+		t.Errorf("Watch() of other syncer received %s", got)
+	default:
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("Watch() channel should be closed after ctx is done")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Watch() channel is not closed")
+	}
+}
+
+func TestInstance_Syncers(t *testing.T) {
+	ctx := context.Background()
+	ins := newTestInstance(t)
+
+	oldest := suid.New()
+	if err := ins.Syncer("a").Add(ctx, suid.New(), oldest); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := ins.Syncer("b").Add(ctx, suid.New()); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	stats, err := ins.Syncer("a").Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if stats.Pending != 2 || stats.Size == 0 || !stats.Oldest.Equal(oldest.KSUID().Time()) {
+		t.Errorf("Stats() = %+v, want 2 pending since %v", stats, oldest.KSUID().Time())
+	}
+
+	if err := ins.RemoveSyncer(ctx, "a"); err != nil {
+		t.Fatalf("RemoveSyncer() error = %v", err)
+	}
+	names, err := ins.Syncers(ctx)
+	if err != nil {
+		t.Fatalf("Syncers() error = %v", err)
+	}
+	if len(names) != 1 || names[0] != "b" {
+		t.Errorf("Syncers() = %v, want [b]", names)
+	}
+	if stats, _ := ins.Syncer("a").Stats(ctx); stats.Pending != 0 {
+		t.Errorf("Stats() of removed syncer = %+v, want empty", stats)
+	}
+}
+
+// testKeyFunc returns the custom UID without the version after the last comma.
+func testKeyFunc(uid suid.UID) string {
+	custom := uid.CustomUID()
+	if i := strings.LastIndex(custom, ","); i > -1 {
+		return custom[:i]
+	}
+	return ""
+}
+
+func TestSyncer_Compact(t *testing.T) {
+	ctx := context.Background()
+	ins := newTestInstance(t, WithCompactOption(testKeyFunc))
+
+	customs := []string{"a,1", "b,1", "a,2", "c", "a,3", "b,2"}
+	var uids []suid.UID
+	for _, custom := range customs {
+		uid := suid.NewByCustom(custom)
+		if err := ins.DataSet().Add(ctx, Item{UID: uid, Value: []byte(custom)}); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+		uids = append(uids, uid)
+	}
+	syncer := ins.Syncer("node")
+	if err := syncer.Add(ctx, uids...); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+
+	customUIDs := func(manifest *suid.AssembleManifest) []string {
+		var result []string
+		for iter := manifest.Iter(); iter.Next(); {
+			result = append(result, manifest.GetUID(iter.KSUID).CustomUID())
+		}
+		return result
+	}
+
+	stats, err := syncer.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if stats.Pending != 3 {
+		t.Errorf("Stats() Pending = %d, want 3", stats.Pending)
+	}
+
+	manifest, err := syncer.Manifest(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	got := customUIDs(manifest)
+	if want := []string{"c", "a,3", "b,2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Manifest() = %v, want %v", got, want)
+	}
+
+	// The synchronized UID marks the position, and is kept even if it is superseded.
+	var synced suid.UID
+	if err := ins.DataSet().RangeCustom(ctx, func(uid suid.UID) error {
+		if uid.CustomUID() == "a,1" {
+			synced = uid
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("RangeCustom() error = %v", err)
+	}
+	manifest, err = syncer.Manifest(ctx, synced, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	got = customUIDs(manifest)
+	if want := []string{"a,1", "c", "a,3", "b,2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Manifest() = %v, want %v", got, want)
+	}
+}
+
+func TestSyncer_Snapshot(t *testing.T) {
+	ctx := context.Background()
+	server := newTestInstance(t, WithCompactOption(testKeyFunc))
+	agent := newTestInstance(t)
+
+	add := func(customs ...string) {
+		t.Helper()
+		var uids []suid.UID
+		for _, custom := range customs {
+			uid := suid.NewByCustom(custom)
+			if err := server.DataSet().Add(ctx, Item{UID: uid, Value: []byte(custom)}); err != nil {
+				t.Fatalf("Add() error = %v", err)
+			}
+			uids = append(uids, uid)
+		}
+		if err := server.Syncer("node").Add(ctx, uids...); err != nil {
+			t.Fatalf("Syncer.Add() error = %v", err)
+		}
+	}
+	add("a,1", "b,1", "a,2")
+
+	snapshot, err := server.Syncer("node").Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	if got := snapshot.State.CustomUID(); got != "a,2" {
+		t.Errorf("Snapshot() State = %s, want a,2", got)
+	}
+	var got []string
+	for _, item := range snapshot.Items {
+		if item.UID.CustomUID() != string(item.Value) {
+			t.Errorf("Snapshot() item %s has value %s", item.UID, item.Value)
+		}
+		got = append(got, item.UID.CustomUID())
+	}
+	if want := []string{"b,1", "a,2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshot() Items = %v, want %v", got, want)
+	}
+
+	// The items before the snapshot state are not synchronized again.
+	if _, err := server.Syncer("node").Manifest(ctx, snapshot.State, 0); err != ErrEmptyManifest {
+		t.Errorf("Manifest() error = %v, want %v", err, ErrEmptyManifest)
+	}
+	if _, err := server.Syncer("node").Manifest(ctx, suid.UID(newFutureKSUID(t).String()), 0); err != ErrUnknownState {
+		t.Errorf("Manifest() error = %v, want %v", err, ErrUnknownState)
+	}
+
+	if err := agent.DataSet().Add(ctx, Item{UID: suid.NewByCustom("stale"), Value: []byte("stale")}); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	var installed []string
+	err = agent.DataSet().InstallSnapshot(ctx, snapshot, func(ctx context.Context, item Item) error {
+		if item.Tombstone && item.Value == nil {
+			installed = append(installed, "deleted "+item.UID.CustomUID())
+			return nil
+		}
+		installed = append(installed, item.UID.CustomUID())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("InstallSnapshot() error = %v", err)
+	}
+	// The local item missing from the snapshot has been deleted while the agent was behind.
+	if want := append([]string{"deleted stale"}, got...); !reflect.DeepEqual(installed, want) {
+		t.Errorf("InstallSnapshot() called back %v, want %v", installed, want)
+	}
+	if state := agent.DataSet().State(ctx); state.String() != snapshot.State.String() {
+		t.Errorf("State() = %s, want %s", state, snapshot.State)
+	}
+	var customs []string
+	if err := agent.DataSet().RangeCustom(ctx, func(uid suid.UID) error {
+		customs = append(customs, uid.CustomUID())
+		return nil
+	}); err != nil {
+		t.Fatalf("RangeCustom() error = %v", err)
+	}
+	if want := []string{"a,2", "b,1"}; !reflect.DeepEqual(customs, want) {
+		t.Errorf("RangeCustom() = %v, want %v", customs, want)
+	}
+
+	// The incremental synchronization resumes from the snapshot state.
+	add("c,1")
+	manifest, err := server.Syncer("node").Manifest(ctx, agent.DataSet().State(ctx), 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	items, err := server.Syncer("node").Data(ctx, manifest)
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	agent.DataSet().SyncManifest(ctx, manifest)
+	if err := agent.DataSet().Sync(ctx, items, nil); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if state := agent.DataSet().State(ctx); state.CustomUID() != "c,1" {
+		t.Errorf("State() = %s, want c,1", state)
+	}
+}
+
+func TestDataSet_InstallSnapshotLarge(t *testing.T) {
+	ctx := context.Background()
+	backend, err := badger.New(&badger.Config{Path: t.TempDir()})
+	if err != nil {
+		t.Fatalf("badger.New() error = %v", err)
+	}
+	defer backend.Close()
+
+	// The snapshot is far above the transaction limit of badger.
+	const count = 5000
+	generator := suid.NewMonotonicGenerator()
+	snapshot := &Snapshot{Epoch: "epoch"}
+	for i := 0; i < count; i++ {
+		value := []byte(strings.Repeat(fmt.Sprintf("%04d", i), 1024))
+		uid := suid.NewWithCustom(generator.Next(), fmt.Sprintf("item/%d", i))
+		snapshot.Items = append(snapshot.Items, Item{UID: uid, Value: value, Digest: Digest(value)})
+		snapshot.State = uid
+	}
+
+	// The installation interrupted halfway is resumed after the installed batches.
+	const installed = 20
+	crash := &crashStorage{Interface: backend, crashAt: 1 + 8 + installed + 1}
+	agent := newTestInstance(t, WithStorageOption(crash))
+	if err := agent.DataSet().InstallSnapshot(ctx, snapshot, nil); err != errCrash {
+		t.Fatalf("InstallSnapshot() error = %v, want %v", err, errCrash)
+	}
+	if state := agent.DataSet().State(ctx); !state.IsNil() {
+		t.Errorf("State() after interruption = %s, want nil", state)
+	}
+
+	resumed := &crashStorage{Interface: backend}
+	agent = newTestInstance(t, WithStorageOption(resumed))
+	var delivered int
+	err = agent.DataSet().InstallSnapshot(ctx, snapshot, func(ctx context.Context, item Item) error {
+		delivered++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("InstallSnapshot() error = %v", err)
+	}
+	if want := count/snapshotBatchSize - installed + 1; resumed.updates != want {
+		t.Errorf("InstallSnapshot() resumed in %d transactions, want %d", resumed.updates, want)
+	}
+	if delivered != count {
+		t.Errorf("InstallSnapshot() called back %d items, want %d", delivered, count)
+	}
+	if state := agent.DataSet().State(ctx); state.String() != snapshot.State.String() {
+		t.Errorf("State() = %s, want %s", state, snapshot.State)
+	}
+	if got := countSpace(t, backend, buildName(spaceRelatePrefix)); got != count {
+		t.Errorf("custom space has %d keys, want %d", got, count)
+	}
+	item, err := agent.DataSet().Get(ctx, snapshot.Items[count-1].UID)
+	if err != nil || string(item.Value) != string(snapshot.Items[count-1].Value) {
+		t.Errorf("Get() = %v, want the last item of the snapshot", err)
+	}
+}
+
+func TestSyncer_Del(t *testing.T) {
+	ctx := context.Background()
+	syncer := newTestInstance(t).Syncer("node")
+
+	a, b, c := suid.New(), suid.New(), suid.New()
+	if err := syncer.Add(ctx, a, b, c); err != nil {
+		t.Fatalf("Add() error = %v", err)
+	}
+	if err := syncer.Del(ctx, b); err != nil {
+		t.Fatalf("Del() error = %v", err)
+	}
+	manifest, err := syncer.Manifest(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	want := []string{a.String(), c.String()}
+	if got := manifestUIDs(t, manifest); !equalStrings(got, want) {
+		t.Errorf("Manifest() = %v, want %v", got, want)
+	}
+}
+
+func TestSyncer_Strategies(t *testing.T) {
+	strategies := map[string]operation.SyncerFactory{
+		"manifest": operation.NewManifestSyncer,
+		"log":      operation.NewLogSyncer,
+	}
+	for name, factory := range strategies {
+		factory := factory
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			ins := newTestInstance(t, WithCompactOption(testKeyFunc), WithSyncerOption(factory))
+			sub := ins.Subscription("sub")
+			if err := sub.Bind(ctx, "node"); err != nil {
+				t.Fatalf("Bind() error = %v", err)
+			}
+
+			add := func(customs ...string) []suid.UID {
+				t.Helper()
+				var uids []suid.UID
+				for _, custom := range customs {
+					uid := suid.NewByCustom(custom)
+					if err := ins.DataSet().Add(ctx, Item{UID: uid, Value: []byte(custom)}); err != nil {
+						t.Fatalf("Add() error = %v", err)
+					}
+					item, err := ins.DataSet().Get(ctx, uid)
+					if err != nil {
+						t.Fatalf("Get() error = %v", err)
+					}
+					uids = append(uids, item.UID)
+				}
+				return uids
+			}
+			uids := add("a,1", "b,1", "a,2", "c,1")
+			if err := ins.Syncer("node").Add(ctx, uids[0], uids[2]); err != nil {
+				t.Fatalf("Syncer.Add() error = %v", err)
+			}
+			if err := sub.Add(ctx, uids[1], uids[3]); err != nil {
+				t.Fatalf("Subscription.Add() error = %v", err)
+			}
+
+			// The own sync set and the log are merged in order, and compacted by key.
+			m, err := ins.Syncer("node").Manifest(ctx, nil, 0)
+			if err != nil {
+				t.Fatalf("Manifest() error = %v", err)
+			}
+			if got, want := manifestUIDs(t, m), []string{uids[1].String(), uids[2].String(), uids[3].String()}; !equalStrings(got, want) {
+				t.Errorf("Manifest() = %v, want %v", got, want)
+			}
+			stats, err := ins.Syncer("node").Stats(ctx)
+			if err != nil {
+				t.Fatalf("Stats() error = %v", err)
+			}
+			if stats.Pending != 3 || stats.Size == 0 {
+				t.Errorf("Stats() = %+v, want 3 pending", stats)
+			}
+
+			// The pending UIDs are still referenced, so GC keeps them.
+			result, err := ins.GC(ctx, GCOptions{})
+			if err != nil {
+				t.Fatalf("GC() error = %v", err)
+			}
+			if len(result.Dataset) != 0 {
+				t.Errorf("GC() removed dataset %v, want none", result.Dataset)
+			}
+
+			// The synchronized UIDs before the position are removed.
+			m, err = ins.Syncer("node").Manifest(ctx, uids[2], 0)
+			if err != nil {
+				t.Fatalf("Manifest() error = %v", err)
+			}
+			if got, want := manifestUIDs(t, m), []string{uids[2].String(), uids[3].String()}; !equalStrings(got, want) {
+				t.Errorf("Manifest(a,2) = %v, want %v", got, want)
+			}
+			if _, err := ins.Syncer("node").Manifest(ctx, uids[3], 0); err != ErrEmptyManifest {
+				t.Errorf("Manifest(c,1) error = %v, want %v", err, ErrEmptyManifest)
+			}
+			if stats, _ := ins.Syncer("node").Stats(ctx); stats.Pending != 0 {
+				t.Errorf("Stats() = %+v after synchronized, want none pending", stats)
+			}
+
+			names, err := ins.Syncers(ctx)
+			if err != nil {
+				t.Fatalf("Syncers() error = %v", err)
+			}
+			if want := []string{"node"}; !equalStrings(names, want) {
+				t.Errorf("Syncers() = %v, want %v", names, want)
+			}
+			if err := ins.RemoveSyncer(ctx, "node"); err != nil {
+				t.Fatalf("RemoveSyncer() error = %v", err)
+			}
+			if names, _ := ins.Syncers(ctx); len(names) != 0 {
+				t.Errorf("Syncers() = %v after removed, want none", names)
+			}
+		})
+	}
+}
+
+func TestSyncer_StrategyPerInstance(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStorage(t)
+	// The instances are created with the same option, each of them owns its space.
+	opt := WithSyncerOption(operation.NewLogSyncer)
+	a, err := New(WithStorageOption(s), WithNameOption("a"), opt)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	b, err := New(WithStorageOption(s), WithNameOption("b"), opt)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := a.Syncer("node").Add(ctx, suid.New()); err != nil {
+		t.Fatalf("Syncer.Add() error = %v", err)
+	}
+	if names, _ := a.Syncers(ctx); !equalStrings(names, []string{"node"}) {
+		t.Errorf("Syncers() of a = %v, want [node]", names)
+	}
+	if names, _ := b.Syncers(ctx); len(names) != 0 {
+		t.Errorf("Syncers() of b = %v, want none", names)
+	}
+
+	if _, err := New(WithStorageOption(s), WithSyncerOption(func(string) (operation.SyncerOperation, error) {
+		return nil, operation.ErrEmptySpace
+	})); err != operation.ErrEmptySpace {
+		t.Errorf("New() error = %v, want %v", err, operation.ErrEmptySpace)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"errors"
+
+	"github.com/99nil/dsync/storage"
+	"github.com/99nil/dsync/suid"
+)
+
+var ErrTombstoneWithoutKey = errors.New("tombstone requires a custom UID")
+
+// tombstones records the delete marker of each logical key,
+// the marker is kept until every syncer has passed it, and then purged by GC.
+type tombstones struct {
+	keyFunc            KeyFunc
+	tombstoneOperation OperateInterface
+	// pendingOperation marks the tombstones received but not synchronized yet in the tmp space
+	pendingOperation OperateInterface
+}
+
+func newTombstones(insName string, storage storage.Interface, keyFunc KeyFunc) *tombstones {
+	return &tombstones{
+		keyFunc:            keyFunc,
+		tombstoneOperation: newSpaceOperation(buildName(spaceTombstonePrefix, insName), storage),
+		pendingOperation:   newSpaceOperation(buildName(spaceTmpTombstonePrefix, insName), storage),
+	}
+}
+
+// get returns the UID of the tombstone of the key, or nil if the key is not deleted.
+func (t *tombstones) get(ctx context.Context, op OperateInterface, key string) (suid.UID, error) {
+	if key == "" {
+		return nil, nil
+	}
+	value, err := op.Get(ctx, key)
+	if err != nil || len(value) == 0 {
+		return nil, err
+	}
+	return suid.UID(value), nil
+}
+
+// is reports whether the UID is the tombstone of its key.
+func (t *tombstones) is(ctx context.Context, op OperateInterface, uid suid.UID) (bool, error) {
+	current, err := t.get(ctx, op, logicalKey(t.keyFunc, uid))
+	if err != nil || current == nil {
+		return false, err
+	}
+	return current.KSUID() == uid.KSUID(), nil
+}
+
+// update records the tombstone of the item, or removes the tombstone of its key when it is recreated.
+// The item older than the current tombstone is ignored, unless force is true.
+func (t *tombstones) update(ctx context.Context, txn storage.Txn, item Item, force bool) error {
+	key := logicalKey(t.keyFunc, item.UID)
+	if key == "" {
+		if item.Tombstone {
+			return ErrTombstoneWithoutKey
+		}
+		return nil
+	}
+	op := t.tombstoneOperation.WithTxn(txn)
+	current, err := t.get(ctx, op, key)
+	if err != nil {
+		return err
+	}
+	if !force && current != nil && suid.CompareKSUID(current.KSUID(), item.UID.KSUID()) > 0 {
+		return nil
+	}
+	if item.Tombstone {
+		return op.Add(ctx, key, item.UID)
+	}
+	if current == nil {
+		return nil
+	}
+	return op.Del(ctx, key)
+}
+
+// remove removes the tombstone of the key of the UID if it is the UID.
+func (t *tombstones) remove(ctx context.Context, txn storage.Txn, uid suid.UID) error {
+	op := t.tombstoneOperation.WithTxn(txn)
+	ok, err := t.is(ctx, op, uid)
+	if err != nil || !ok {
+		return err
+	}
+	return op.Del(ctx, logicalKey(t.keyFunc, uid))
+}
+
+func (ds *dataSet) Tombstone(ctx context.Context, key string) (*Item, error) {
+	uid, err := ds.tombstone.get(ctx, ds.tombstone.tombstoneOperation, key)
+	if err != nil || uid == nil {
+		return nil, err
+	}
+	id := uid.KSUID().String()
+	value, err := ds.dataSetOperation.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := ds.digestOperation.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &Item{UID: uid, Value: value, Digest: digest, Tombstone: true}, nil
+}
@@ -0,0 +1,173 @@
+// Copyright © 2021 zc2638 <zc2638@qq.com>.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsync
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/99nil/dsync/suid"
+)
+
+func tombstoneValue(t *testing.T, ds DataSet, key string) string {
+	t.Helper()
+	item, err := ds.Tombstone(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Tombstone(%s) error = %v", key, err)
+	}
+	if item == nil {
+		return ""
+	}
+	if !item.Tombstone {
+		t.Errorf("Tombstone(%s) returned an item not marked as tombstone", key)
+	}
+	return string(item.Value)
+}
+
+func TestDataSet_Tombstone(t *testing.T) {
+	ctx := context.Background()
+	ds := newTestInstance(t, WithCompactOption(testKeyFunc)).DataSet()
+
+	add := func(custom string, tombstone bool) {
+		t.Helper()
+		if err := ds.Add(ctx, Item{UID: suid.NewByCustom(custom), Value: []byte(custom), Tombstone: tombstone}); err != nil {
+			t.Fatalf("Add(%s) error = %v", custom, err)
+		}
+	}
+	add("a,1", false)
+	add("a,2", true)
+	add("b,1", false)
+
+	if got := tombstoneValue(t, ds, "a"); got != "a,2" {
+		t.Errorf("Tombstone(a) = %q, want %q", got, "a,2")
+	}
+	// The key that exists or never existed has no tombstone.
+	for _, key := range []string{"b", "c"} {
+		if got := tombstoneValue(t, ds, key); got != "" {
+			t.Errorf("Tombstone(%s) = %q, want none", key, got)
+		}
+	}
+	item, err := ds.Get(ctx, suid.NewByCustom("a,2"))
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !item.Tombstone {
+		t.Errorf("Get(a,2) Tombstone = false, want true")
+	}
+
+	// The tombstone is removed when the key is recreated.
+	add("a,3", false)
+	if got := tombstoneValue(t, ds, "a"); got != "" {
+		t.Errorf("Tombstone(a) = %q after recreated, want none", got)
+	}
+
+	if err := ds.Add(ctx, Item{UID: suid.New(), Tombstone: true}); err != ErrTombstoneWithoutKey {
+		t.Errorf("Add() error = %v, want %v", err, ErrTombstoneWithoutKey)
+	}
+}
+
+func TestSyncer_Tombstone(t *testing.T) {
+	ctx := context.Background()
+	server := newTestInstance(t, WithCompactOption(testKeyFunc))
+	agent := newTestInstance(t, WithCompactOption(testKeyFunc))
+
+	add := func(custom string, tombstone bool) {
+		t.Helper()
+		uid := suid.NewByCustom(custom)
+		if err := server.DataSet().Add(ctx, Item{UID: uid, Value: []byte(custom), Tombstone: tombstone}); err != nil {
+			t.Fatalf("Add(%s) error = %v", custom, err)
+		}
+		if err := server.Syncer("node").Add(ctx, uid); err != nil {
+			t.Fatalf("Syncer.Add() error = %v", err)
+		}
+	}
+	add("a,1", false)
+	add("b,1", false)
+	add("a,2", true)
+
+	// A new node never needs the delete markers.
+	snapshot, err := server.Syncer("other").Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	var customs []string
+	for _, item := range snapshot.Items {
+		customs = append(customs, item.UID.CustomUID())
+	}
+	if want := []string{"b,1"}; !reflect.DeepEqual(customs, want) {
+		t.Errorf("Snapshot() Items = %v, want %v", customs, want)
+	}
+
+	// The tombstone is kept while the node has not synchronized it.
+	result, err := server.GC(ctx, GCOptions{KeepOrphans: true})
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	if len(result.Tombstone) != 0 {
+		t.Errorf("GC() purged tombstones %v while pending", result.Tombstone)
+	}
+
+	manifest, err := server.Syncer("node").Manifest(ctx, nil, 0)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	items, err := server.Syncer("node").Data(ctx, manifest)
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	var deleted []string
+	agent.DataSet().SyncManifest(ctx, manifest)
+	err = agent.DataSet().Sync(ctx, items, func(_ context.Context, item Item) error {
+		if item.Tombstone {
+			deleted = append(deleted, item.UID.CustomUID())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if want := []string{"a,2"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("Sync() called back tombstones %v, want %v", deleted, want)
+	}
+	if got := tombstoneValue(t, agent.DataSet(), "a"); got != "a,2" {
+		t.Errorf("agent Tombstone(a) = %q, want %q", got, "a,2")
+	}
+
+	// The tombstone is purged after the node has passed it.
+	if _, err := server.Syncer("node").Manifest(ctx, agent.DataSet().State(ctx), 0); err != ErrEmptyManifest {
+		t.Fatalf("Manifest() error = %v, want %v", err, ErrEmptyManifest)
+	}
+	result, err = server.GC(ctx, GCOptions{KeepOrphans: true})
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(result.Tombstone, want) {
+		t.Errorf("GC() purged tombstones %v, want %v", result.Tombstone, want)
+	}
+	if got := tombstoneValue(t, server.DataSet(), "a"); got != "" {
+		t.Errorf("Tombstone(a) = %q after purged, want none", got)
+	}
+	customs = nil
+	if err := server.DataSet().RangeCustom(ctx, func(uid suid.UID) error {
+		customs = append(customs, uid.CustomUID())
+		return nil
+	}); err != nil {
+		t.Fatalf("RangeCustom() error = %v", err)
+	}
+	if want := []string{"a,1", "b,1"}; !reflect.DeepEqual(customs, want) {
+		t.Errorf("RangeCustom() = %v after purged, want %v", customs, want)
+	}
+}